@@ -1,18 +1,18 @@
 package cluster
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/metcalf/ctf3/level4/db"
-	"github.com/metcalf/ctf3/level4/debuglog"
 	"github.com/metcalf/ctf3/level4/transport"
+	"github.com/metcalf/ctf3/level4/transport/dump"
 	"github.com/metcalf/raft"
-	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"path/filepath"
 	"time"
@@ -23,28 +23,71 @@ type EncodableCommand interface {
 	raft.CommandEncoder
 }
 
+// A DedupCommand carries a token that lets the state machine recognize a
+// command that has been proposed more than once and apply it only once.  Only
+// commands with dedup tokens are re-proposed after a leadership change.
+type DedupCommand interface {
+	EncodableCommand
+	DedupToken() uint64
+}
+
+// Servers that expose their log can report their last entry in pre-votes.
+type logServer interface {
+	LogEntries() []*raft.LogEntry
+}
+
 type RequestHandler func(do CommandHandler, mux *mux.Router) error
 type CommandHandler func(cmd EncodableCommand) (int, error)
 
+// Controls how Do re-proposes a pending command when the leader changes (or
+// becomes unreachable) before the command is acknowledged.
+type RetryPolicy struct {
+	// Number of times to re-propose a command.  Zero disables retries.
+	Attempts int
+	// How long to wait for a new leader to be elected before giving up on an
+	// attempt.
+	LeaderWait time.Duration
+	// Re-propose commands that have no dedup token.  Such commands may be
+	// applied twice if the original proposal was committed after all.
+	RetryWithoutToken bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	LeaderWait: 2 * time.Second,
+}
+
 type Cluster struct {
-	listen     string
-	path       string
-	name       string
-	handler    RequestHandler
-	raftServer raft.Server
-	router     *mux.Router
-	context    interface{}
-	client     *transport.Client
+	listen          string
+	path            string
+	name            string
+	handler         RequestHandler
+	raftServer      raft.Server
+	installed       raft.Server
+	extend          func(raft.Server) raft.Server
+	router          *mux.Router
+	context         interface{}
+	forwarder       *transport.Forwarder
+	transporter     *transport.HTTPTransporter
+	retry           RetryPolicy
+	recorder        *transport.Recorder
+	admin           bool
+	transportConfig transport.Config
+	unixSocket      transport.UnixSocketOptions
+	options         []transport.Option
+	advertise       []string
+	nats            *transport.NATSTransporter
 }
 
 func New(path string, listen string, handler RequestHandler, context interface{}) (*Cluster, error) {
 	c := &Cluster{
-		listen:  listen,
-		path:    path,
-		handler: handler,
-		router:  mux.NewRouter(),
-		context: context,
-		client:  transport.NewClient(),
+		listen:     listen,
+		path:       path,
+		handler:    handler,
+		router:     mux.NewRouter(),
+		context:    context,
+		retry:      DefaultRetryPolicy,
+		unixSocket: transport.DefaultUnixSocketOptions,
 	}
 
 	// Read existing name or generate a new one.
@@ -57,6 +100,66 @@ func New(path string, listen string, handler RequestHandler, context interface{}
 	return c, nil
 }
 
+// Sets the policy used to re-propose commands across leadership changes.
+func (c *Cluster) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
+}
+
+// Records every Raft RPC sent and received to a trace for later replay.
+func (c *Cluster) SetRecorder(recorder *transport.Recorder) {
+	c.recorder = recorder
+}
+
+// Exposes the transport's read-only admin endpoints alongside the Raft routes.
+func (c *Cluster) EnableAdmin() {
+	c.admin = true
+}
+
+// Sets options for constructing the transporter, such as connection reuse
+// and HTTP/2.  They take effect when ListenAndServe is called.
+func (c *Cluster) SetTransportOptions(options ...transport.Option) {
+	c.options = options
+}
+
+// Sets the addresses peers reach this server at, in order of preference, for
+// servers reachable over several interfaces.  By default peers use the listen
+// address.
+func (c *Cluster) SetAdvertise(addrs ...string) {
+	c.advertise = addrs
+}
+
+// Carries Raft RPCs over NATS instead of HTTP.  Joins and forwarded writes
+// still go over HTTP, so servers must remain reachable at their connection
+// strings for those.
+func (c *Cluster) SetNATS(transporter *transport.NATSTransporter) {
+	c.nats = transporter
+}
+
+// Wraps the Raft server before its routes are installed.  raft.Server doesn't
+// implement leadership transfer, pre-vote or read index, so their routes are
+// only served if the wrapper adds them by implementing
+// transport.TimeoutNowServer, transport.PreVoteServer or
+// transport.ReadIndexServer.
+func (c *Cluster) SetServerExtension(extend func(raft.Server) raft.Server) {
+	c.extend = extend
+}
+
+// Sets the options used when listening on a Unix socket.
+func (c *Cluster) SetUnixSocketOptions(opts transport.UnixSocketOptions) {
+	c.unixSocket = opts
+}
+
+// Sets the transport configuration.  Whether the cluster serves TLS is decided
+// by the configuration in place when ListenAndServe is called; once running,
+// other changes are applied to the live transporter.
+func (c *Cluster) UpdateTransportConfig(cfg transport.Config) error {
+	c.transportConfig = cfg
+	if c.transporter != nil {
+		return c.transporter.UpdateConfig(cfg)
+	}
+	return nil
+}
+
 // Starts the server.
 func (c *Cluster) ListenAndServe(leader string) error {
 	var err error
@@ -64,13 +167,54 @@ func (c *Cluster) ListenAndServe(leader string) error {
 	log.Printf("Initializing Raft Server: %s", c.path)
 
 	// Initialize and start Raft server.
-	transporter := transport.NewHTTPTransporter("/raft")
+	options := c.options
+	var dumper *dump.Dumper
+	if c.admin {
+		dumper = dump.New()
+		options = append(options[:len(options):len(options)], transport.WithClientMiddleware(dumper.RoundTripper))
+	}
+	transporter := transport.NewHTTPTransporter("/raft", options...)
+	if err := transporter.UpdateConfig(c.transportConfig); err != nil {
+		return err
+	}
+
+	capture := transport.DefaultCaptureConfig
+	capture.Dir = filepath.Join(c.path, "debug")
+	transporter.SetCaptureConfig(capture)
+
+	var raftTransporter transport.Transporter = transporter
+	if c.nats != nil {
+		raftTransporter = c.nats
+	}
+	if c.recorder != nil {
+		raftTransporter = transport.Chain(raftTransporter, transport.Recording(c.recorder))
+	}
 
-	c.raftServer, err = raft.NewServer(c.name, c.path, transporter, nil, c.context, "")
+	c.raftServer, err = raft.NewServer(c.name, c.path, raftTransporter, nil, c.context, "")
 	if err != nil {
 		return err
 	}
-	transporter.Install(c.raftServer, c)
+
+	var installed raft.Server = c.raftServer
+	if c.recorder != nil {
+		installed = transport.RecordServer(c.raftServer, c.recorder)
+	}
+	if c.extend != nil {
+		installed = c.extend(installed)
+	}
+	c.installed = installed
+	transporter.Install(installed, c)
+	if c.nats != nil {
+		if err := c.nats.Install(installed); err != nil {
+			return err
+		}
+	}
+	if c.admin {
+		transporter.InstallAdmin(c.raftServer, c)
+		c.router.Handle(transporter.AdminDumpPath(), dumper)
+	}
+	c.transporter = transporter
+	c.forwarder = transport.NewForwarder(transporter, c.raftServer)
 	c.raftServer.Start()
 
 	if !c.raftServer.IsLogEmpty() {
@@ -105,15 +249,19 @@ func (c *Cluster) ListenAndServe(leader string) error {
 	httpServer := &http.Server{
 		Handler: c.router,
 	}
-
-	c.router.HandleFunc("/join", c.joinHandler).Methods("POST")
-	c.router.HandleFunc("/do/{command}", c.doHandler).Methods("POST")
+	if dumper != nil {
+		httpServer.Handler = dumper.Handler(c.router)
+	}
+	transporter.ConfigureServer(httpServer)
 
 	// Start Unix transport
-	l, err := transport.Listen(c.listen)
+	l, err := transport.ListenWithOptions(c.listen, c.unixSocket)
 	if err != nil {
 		return err
 	}
+	if c.transportConfig.TLS != nil {
+		l = tls.NewListener(l, transporter.ServerTLSConfig())
+	}
 
 	log.Println("Initializing HTTP server")
 	c.handler(c.Do, c.router)
@@ -134,23 +282,18 @@ func (c *Cluster) Join(leader string) error {
 		ConnectionString: c.connectionString(),
 	}
 
-	var b bytes.Buffer
-	json.NewEncoder(&b).Encode(command)
-	jsonReader := bytes.NewReader(b.Bytes())
-
 	cs, err := transport.Encode(leader)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Sending join command with contents: %s", b.Bytes())
+	log.Printf("Sending join command for %s to %s", command.Name, cs)
 	for {
-		_, err := c.client.SafePost(cs, "/join", jsonReader)
+		err := c.transporter.SendJoinRequest(cs, command)
 
 		if err != nil {
 			log.Printf("Unable to join cluster: %s", err)
 			time.Sleep(500 * time.Millisecond)
-			jsonReader.Seek(0, 0)
 		} else {
 			break
 		}
@@ -159,115 +302,209 @@ func (c *Cluster) Join(leader string) error {
 	return nil
 }
 
-func (c *Cluster) connectionString() string {
-	conn, err := transport.Encode(c.listen)
-	if err != nil {
-		log.Fatalf("Error determining connectionString: %s", err)
+// Hands leadership to a follower by asking it to start an election at once.
+// The follower must serve TimeoutNow (see SetServerExtension) and should be
+// caught up, or it will lose the election.
+func (c *Cluster) TransferLeadership(name string) error {
+	if c.raftServer.State() != raft.Leader {
+		return raft.NotLeaderError
+	}
+	peer, ok := c.raftServer.Peers()[name]
+	if !ok {
+		return fmt.Errorf("Unknown peer %s", name)
 	}
 
-	return conn
+	resp := c.transporter.SendTimeoutNowRequest(c.raftServer, peer, &transport.TimeoutNowRequest{
+		Term:       c.raftServer.Term(),
+		LeaderName: c.raftServer.Name(),
+	})
+	if resp == nil {
+		return fmt.Errorf("No response to TimeoutNow from %s", name)
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s refused to take leadership in term %d", name, resp.Term)
+	}
+	return nil
 }
 
-func (c *Cluster) joinHandler(w http.ResponseWriter, req *http.Request) {
-	debuglog.Debugf("Received join request (I am %s)", c.raftServer.State())
+// Asks every peer whether it would grant this server its vote in the next
+// term, and reports whether a quorum would.  raft.Server campaigns without
+// asking, so this is for server extensions that can hold off an election they
+// would lose.  Peers must serve PreVote (see SetServerExtension); those that
+// don't count as refusing.
+func (c *Cluster) PreVote() bool {
+	req := &transport.PreVoteRequest{
+		Term:          c.raftServer.Term() + 1,
+		CandidateName: c.raftServer.Name(),
+	}
+	if ls, ok := c.raftServer.(logServer); ok {
+		if entries := ls.LogEntries(); len(entries) > 0 {
+			last := entries[len(entries)-1]
+			req.LastLogIndex = last.Index
+			req.LastLogTerm = last.Term
+		}
+	}
+
+	peers := c.raftServer.Peers()
+	votes := make(chan bool, len(peers))
+	for _, peer := range peers {
+		go func(peer *raft.Peer) {
+			resp := c.transporter.SendPreVoteRequest(c.raftServer, peer, req)
+			votes <- resp != nil && resp.VoteGranted
+		}(peer)
+	}
 
-	command := &raft.DefaultJoinCommand{}
+	granted := 1
+	for range peers {
+		if <-votes {
+			granted++
+		}
+	}
+	return granted >= c.raftServer.QuorumSize()
+}
 
-	err := json.NewDecoder(req.Body).Decode(&command)
-	if err != nil && err != io.EOF {
-		log.Printf("Could not decode join command: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// Returns an index at which a linearizable read may be served, from the
+// leader's ReadIndex.  The caller answers the read once this server has
+// applied that far.  The leader must serve ReadIndex (see
+// SetServerExtension).
+func (c *Cluster) ReadIndex() (uint64, error) {
+	req := &transport.ReadIndexRequest{
+		Term:       c.raftServer.Term(),
+		ServerName: c.raftServer.Name(),
 	}
 
-	if command.ConnectionString == "" {
-		cErr := fmt.Errorf("Join request with empty connection string.  JSON err was: %s", err)
-		log.Print(cErr)
-		http.Error(w, cErr.Error(), http.StatusInternalServerError)
-		return
+	var resp *transport.ReadIndexResponse
+	if c.raftServer.State() == raft.Leader {
+		ri, ok := c.installed.(transport.ReadIndexServer)
+		if !ok {
+			return 0, fmt.Errorf("Server does not support ReadIndex")
+		}
+		resp = ri.ReadIndex(req)
+	} else {
+		leader, ok := c.raftServer.Peers()[c.raftServer.Leader()]
+		if !ok {
+			return 0, raft.NotLeaderError
+		}
+		resp = c.transporter.SendReadIndexRequest(c.raftServer, leader, req)
 	}
 
-	debuglog.Debugf("Processing join request from %s", command.ConnectionString)
-	if _, err := c.raftServer.Do(command); err != nil {
-		log.Printf("Could not execute join command: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if resp == nil {
+		return 0, fmt.Errorf("No response to ReadIndex")
+	}
+	if !resp.Success {
+		return 0, raft.NotLeaderError
 	}
-	debuglog.Debugf("Processed join request from %s", command.ConnectionString)
+	return resp.ReadIndex, nil
 }
 
-func (c *Cluster) Do(cmd EncodableCommand) (int, error) {
-	var index uint32
+func (c *Cluster) connectionString() string {
+	addrs := c.advertise
+	if len(addrs) == 0 {
+		addrs = []string{c.unixSocket.Resolve(c.listen)}
+	}
 
-	switch c.raftServer.State() {
-	case raft.Stopped:
-		return 0, fmt.Errorf("Raft server is currently stopped")
-	case raft.Leader:
-		debuglog.Debugln("I'm the leader, executing action locally")
-		index, err := c.raftServer.Do(cmd)
+	encoded := make([]string, len(addrs))
+	for i, addr := range addrs {
+		conn, err := transport.Encode(addr)
 		if err != nil {
-			return 0, err
-		} else {
-			return index.(int), err
-		}
-	default:
-		if c.raftServer.Leader() == "" {
-			return 0, fmt.Errorf("No leader elected")
-		}
-		debuglog.Debugf("Forwarding Action to the leader (in state %s): %s",
-			c.raftServer.State(), c.raftServer.Leader())
-		var cmdBuf bytes.Buffer
-		cmd.Encode(&cmdBuf)
-
-		leader := c.raftServer.Peers()[c.raftServer.Leader()]
-		if leader == nil {
-			return 0, fmt.Errorf("Unable to find leader `%s` in peers list",
-				c.raftServer.Leader())
+			log.Fatalf("Error determining connectionString: %s", err)
 		}
+		encoded[i] = conn
+	}
 
-		resp, err := c.client.SafePost(
-			leader.ConnectionString,
-			fmt.Sprintf("/do/%s", cmd.CommandName()),
-			&cmdBuf)
-		if err != nil {
-			return 0, err
+	return transport.JoinAddresses(encoded...)
+}
+
+// Executes a command on the leader, re-proposing it according to the retry
+// policy if leadership changes before the command is acknowledged.
+func (c *Cluster) Do(cmd EncodableCommand) (int, error) {
+	index, err := c.do(cmd)
+	if err == nil || !retryable(err) || !c.canRetry(cmd) {
+		return index, err
+	}
+
+	for attempt := 1; attempt <= c.retry.Attempts; attempt++ {
+		log.Printf("Re-proposing %s (attempt %d of %d) after error: %s",
+			cmd.CommandName(), attempt, c.retry.Attempts, err)
+
+		if wErr := c.waitForLeader(c.retry.LeaderWait); wErr != nil {
+			return 0, wErr
 		}
 
-		if err := binary.Read(resp, binary.BigEndian, &index); err != nil {
-			return 0, err
+		if index, err = c.do(cmd); err == nil || !retryable(err) {
+			return index, err
 		}
+	}
+
+	return 0, err
+}
 
-		return int(index), nil
+// Reports whether a proposal failed because leadership changed or the leader
+// couldn't be reached, rather than because the command was refused, so that
+// proposing it again may succeed.
+func retryable(err error) bool {
+	switch err {
+	case raft.NotLeaderError, raft.StopError, raft.CommandTimeoutError:
+		return true
 	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var reqErr *transport.RequestError
+	return errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusServiceUnavailable
 }
 
-func (c *Cluster) doHandler(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	cmdName := vars["command"]
+func (c *Cluster) canRetry(cmd EncodableCommand) bool {
+	if c.retry.Attempts <= 0 || c.raftServer.State() == raft.Stopped {
+		return false
+	}
+	if dc, ok := cmd.(DedupCommand); ok && dc.DedupToken() != 0 {
+		return true
+	}
+	return c.retry.RetryWithoutToken
+}
 
-	if cmdName != "action" {
-		err := fmt.Sprintf("Currently only support forwarding actions, got: %s", cmdName)
-		log.Printf(err)
-		http.Error(w, err, http.StatusInternalServerError)
-		return
+// Blocks until a leader is known or the timeout expires.
+func (c *Cluster) waitForLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for c.raftServer.Leader() == "" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("No leader elected after %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	return nil
+}
 
-	cmd := &db.Action{}
+func (c *Cluster) do(cmd EncodableCommand) (int, error) {
+	if c.raftServer.State() == raft.Stopped {
+		return 0, fmt.Errorf("Raft server is currently stopped")
+	}
 
-	if err := cmd.Decode(req.Body); err != nil {
-		log.Printf("Error decoding forwarded command: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	timeout := c.retry.LeaderWait
+	if timeout <= 0 {
+		timeout = DefaultRetryPolicy.LeaderWait
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	index, err := c.raftServer.Do(cmd)
+	result, err := c.forwarder.ForwardToLeader(ctx, cmd)
 	if err != nil {
-		log.Printf("Error applying forwarded command: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, err
 	}
 
-	if err := binary.Write(w, binary.BigEndian, uint32(index.(int))); err != nil {
-		log.Printf("Error writing response to forwarded command: %s", err)
+	// Local results are ints; forwarded ones come back as JSON numbers.
+	switch index := result.(type) {
+	case int:
+		return index, nil
+	case json.Number:
+		i, err := index.Int64()
+		return int(i), err
+	default:
+		return 0, fmt.Errorf("Unexpected result %v from %s", result, cmd.CommandName())
 	}
 }
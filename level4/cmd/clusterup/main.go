@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type node struct {
+	name     string
+	dir      string
+	listen   string
+	args     []string
+	logFile  *os.File
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	restarts int
+	faults   int
+}
+
+type launcher struct {
+	bin     string
+	nodes   []*node
+	stopped bool
+	mutex   sync.Mutex
+}
+
+func main() {
+	var count, basePort, verbose, logRing, logSample int
+	var bin, dir, faults string
+	var useUnix, keep, admin bool
+	var faultInterval, faultDuration time.Duration
+
+	flag.IntVar(&count, "n", 3, "Number of nodes")
+	flag.StringVar(&bin, "bin", "./level4", "Path to the level4 binary")
+	flag.StringVar(&dir, "d", "/tmp/clusterup", "Directory for node storage, sockets and logs")
+	flag.BoolVar(&useUnix, "unix", false, "Listen on Unix sockets instead of loopback TCP")
+	flag.IntVar(&basePort, "port", 4000, "First TCP port (node i listens on port+i)")
+	flag.IntVar(&verbose, "v", 1, "Verbosity passed to each node")
+	flag.BoolVar(&admin, "admin", true, "Serve each node's cluster state and Prometheus metrics under /raft/admin")
+	flag.IntVar(&logRing, "log-ring", 1000, "Recent debug lines each node keeps, served under /raft/admin/log with -admin")
+	flag.IntVar(&logSample, "log-sample", 0, "Debug lines of each kind a node writes per second (0 for all)")
+	flag.BoolVar(&keep, "keep", false, "Keep node directories on exit")
+	flag.StringVar(&faults, "faults", "", "Fault to inject periodically: pause, kill or mixed")
+	flag.DurationVar(&faultInterval, "fault-interval", 10*time.Second, "Time between injected faults")
+	flag.DurationVar(&faultDuration, "fault-duration", 3*time.Second, "How long a paused or killed node stays down")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [options]
+
+Launch a local SQLCluster of N nodes for development.  Node 0 starts the
+cluster and the rest join it.  Output from every node is prefixed with its
+name on stderr and written to <dir>/<name>.log.  Press Ctrl-C to tear the
+cluster down.
+
+OPTIONS:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if count < 1 || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch faults {
+	case "", "pause", "kill", "mixed":
+	default:
+		log.Fatalf("Unknown fault type %s", faults)
+	}
+
+	bin, err := filepath.Abs(bin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		log.Fatalf("Error while creating directory: %s", err)
+	}
+
+	l := &launcher{bin: bin}
+
+	for i := 0; i < count; i++ {
+		n := &node{
+			name: "node" + strconv.Itoa(i),
+		}
+		n.dir = filepath.Join(dir, n.name)
+		if useUnix {
+			n.listen = filepath.Join(dir, n.name+".sock")
+		} else {
+			n.listen = "127.0.0.1:" + strconv.Itoa(basePort+i)
+		}
+
+		n.args = []string{"-d", n.dir, "-l", n.listen, "-v", strconv.Itoa(verbose)}
+		if admin {
+			n.args = append(n.args, "-admin", "-log-ring", strconv.Itoa(logRing))
+		}
+		if logSample > 0 {
+			n.args = append(n.args, "-log-sample", strconv.Itoa(logSample))
+		}
+		if i > 0 {
+			n.args = append(n.args, "-join", l.nodes[0].listen)
+		}
+
+		if n.logFile, err = os.Create(filepath.Join(dir, n.name+".log")); err != nil {
+			log.Fatal(err)
+		}
+
+		l.nodes = append(l.nodes, n)
+	}
+
+	for i, n := range l.nodes {
+		if err := l.start(n); err != nil {
+			l.teardown(dir, keep)
+			log.Fatalf("Could not start %s: %s", n.name, err)
+		}
+		if i == 0 {
+			// Give the first node time to elect itself before others join.
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	log.Printf("Cluster of %d nodes is up:", count)
+	for _, n := range l.nodes {
+		log.Printf("  %s listening on %s", n.name, n.listen)
+		if !admin {
+			continue
+		}
+		if useUnix {
+			log.Printf("    metrics: curl --unix-socket %s http://%s/raft/admin/metrics", n.listen, n.name)
+		} else {
+			log.Printf("    metrics: http://%s/raft/admin/metrics", n.listen)
+		}
+	}
+
+	if faults != "" {
+		go l.injectFaults(faults, faultInterval, faultDuration)
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigchan
+
+	l.teardown(dir, keep)
+}
+
+func (l *launcher) start(n *node) error {
+	cmd := exec.Command(l.bin, n.args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go n.pipe(stdout, &wg)
+	go n.pipe(stderr, &wg)
+
+	go func() {
+		wg.Wait()
+		err := cmd.Wait()
+
+		l.mutex.Lock()
+		stopped := l.stopped
+		l.mutex.Unlock()
+		if !stopped {
+			log.Printf("%s exited: %v", n.name, err)
+		}
+		close(exited)
+	}()
+
+	n.mutex.Lock()
+	n.cmd = cmd
+	n.exited = exited
+	n.mutex.Unlock()
+
+	return nil
+}
+
+// Copies a node's output to its log file and to stderr, prefixed with its
+// name.
+func (n *node) pipe(r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(n.logFile, line)
+		fmt.Fprintf(os.Stderr, "[%s] %s\n", n.name, line)
+	}
+}
+
+func (n *node) process() (*exec.Cmd, chan struct{}) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.cmd, n.exited
+}
+
+// Periodically picks a random node and either pauses it (SIGSTOP, then
+// SIGCONT) or kills and restarts it.
+func (l *launcher) injectFaults(kind string, interval, duration time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		n := l.nodes[rand.Intn(len(l.nodes))]
+		fault := kind
+		if fault == "mixed" {
+			fault = []string{"pause", "kill"}[rand.Intn(2)]
+		}
+
+		cmd, exited := n.process()
+		if cmd == nil {
+			continue
+		}
+
+		l.mutex.Lock()
+		if l.stopped {
+			l.mutex.Unlock()
+			return
+		}
+		n.faults++
+		l.mutex.Unlock()
+
+		switch fault {
+		case "pause":
+			log.Printf("Fault: pausing %s for %s", n.name, duration)
+			cmd.Process.Signal(syscall.SIGSTOP)
+			time.Sleep(duration)
+			cmd.Process.Signal(syscall.SIGCONT)
+			log.Printf("Fault: resumed %s", n.name)
+		case "kill":
+			log.Printf("Fault: killing %s for %s", n.name, duration)
+			cmd.Process.Kill()
+			<-exited
+			time.Sleep(duration)
+
+			l.mutex.Lock()
+			stopped := l.stopped
+			l.mutex.Unlock()
+			if stopped {
+				return
+			}
+
+			if err := l.start(n); err != nil {
+				log.Printf("Fault: could not restart %s: %s", n.name, err)
+				continue
+			}
+			l.mutex.Lock()
+			n.restarts++
+			l.mutex.Unlock()
+			log.Printf("Fault: restarted %s", n.name)
+		}
+	}
+}
+
+// Stops every node, giving each a moment to exit cleanly before killing it,
+// and removes the node directories unless asked to keep them.
+func (l *launcher) teardown(dir string, keep bool) {
+	l.mutex.Lock()
+	l.stopped = true
+	l.mutex.Unlock()
+
+	log.Println("Tearing down cluster")
+
+	for _, n := range l.nodes {
+		cmd, exited := n.process()
+		if cmd == nil {
+			continue
+		}
+
+		cmd.Process.Signal(syscall.SIGCONT)
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(2 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+
+		log.Printf("  %s: %d faults injected, %d restarts", n.name, n.faults, n.restarts)
+		n.logFile.Close()
+	}
+
+	if keep {
+		log.Printf("Kept node directories and logs in %s", dir)
+		return
+	}
+
+	for _, n := range l.nodes {
+		os.RemoveAll(n.dir)
+		if filepath.IsAbs(n.listen) {
+			os.Remove(n.listen)
+		}
+	}
+}
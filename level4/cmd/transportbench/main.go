@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/transport/benchmarks"
+	"log"
+	"os"
+	"regexp"
+)
+
+func main() {
+	var run, save, baseline string
+	var tolerance float64
+
+	flag.StringVar(&run, "run", "", "Run only the cases whose names match this regexp")
+	flag.StringVar(&save, "save", "", "Write the results to this file, as a baseline for later runs")
+	flag.StringVar(&baseline, "baseline", "", "Compare the results against a baseline written with -save")
+	flag.Float64Var(&tolerance, "tolerance", 0.1, "Fraction by which ns/op and B/op may exceed the baseline")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [options]
+
+Benchmark the Raft transport: encoding, decoding and handling AppendEntries,
+and round trips between two transporters over loopback TCP and Unix sockets,
+across entry counts and payload sizes.  With -baseline, exits non-zero if any
+case got slower or allocates more than it did in the baseline.
+
+OPTIONS:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 0 || tolerance < 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	cases := benchmarks.DefaultCases()
+	if run != "" {
+		re, err := regexp.Compile(run)
+		if err != nil {
+			log.Fatalf("Invalid -run pattern: %s", err)
+		}
+		var matched []benchmarks.Case
+		for _, c := range cases {
+			if re.MatchString(c.String()) {
+				matched = append(matched, c)
+			}
+		}
+		cases = matched
+	}
+
+	var base []benchmarks.Result
+	if baseline != "" {
+		f, err := os.Open(baseline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		base, err = benchmarks.ReadResults(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Error while reading baseline: %s", err)
+		}
+	}
+
+	results, err := benchmarks.Run(cases)
+	for _, r := range results {
+		fmt.Println(r)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if save != "" {
+		f, err := os.Create(save)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := benchmarks.WriteResults(f, results); err != nil {
+			log.Fatalf("Error while writing results: %s", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if baseline != "" {
+		regressions := benchmarks.Compare(base, results, tolerance)
+		for _, r := range regressions {
+			fmt.Fprintln(os.Stderr, "REGRESSION:", r)
+		}
+		if len(regressions) > 0 {
+			os.Exit(1)
+		}
+	}
+}
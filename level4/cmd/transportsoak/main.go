@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/transport"
+	"github.com/metcalf/ctf3/level4/transport/transporttest"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	var mode, network string
+	var seed int64
+	var runs, nodes, steps, writers int
+	var duration, delay, jitter time.Duration
+	var drop float64
+
+	flag.StringVar(&mode, "mode", "simulate", "What to run: simulate (seeded fault schedule) or soak (timed workload)")
+	flag.Int64Var(&seed, "seed", 1, "Seed of the first run; later runs use the following seeds")
+	flag.IntVar(&runs, "runs", 1, "Number of runs")
+	flag.IntVar(&nodes, "n", 5, "Number of servers")
+	flag.IntVar(&steps, "steps", 200, "Steps per simulation")
+	flag.Float64Var(&drop, "drop", 0.05, "Chance a simulated link drops a request or response")
+	flag.DurationVar(&delay, "delay", time.Millisecond, "Delay of each simulated RPC")
+	flag.DurationVar(&jitter, "jitter", 2*time.Millisecond, "Extra random delay of each simulated RPC")
+	flag.StringVar(&network, "network", "tcp", "Network for soak runs: tcp, unix or memory")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "Length of each soak run")
+	flag.IntVar(&writers, "writers", 4, "Concurrent writers in soak runs")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [options]
+
+Run clusters of Raft servers over the transport and check the Raft
+invariants: one leader per term, no acknowledged write lost, and no two
+servers applying different entries at the same index.  Each run prints its
+report; exits non-zero if any run violated an invariant.  A failing
+simulation can be replayed with its -seed.
+
+OPTIONS:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 0 || runs < 1 || nodes < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	failed := 0
+	for i := 0; i < runs; i++ {
+		s := seed + int64(i)
+
+		var report *transporttest.Report
+		var err error
+		switch mode {
+		case "simulate":
+			sim := transporttest.DefaultSimulation
+			sim.Seed = s
+			sim.Nodes = nodes
+			sim.Steps = steps
+			sim.Faults = transport.MemoryFaults{
+				DropRate: drop,
+				Delay:    delay,
+				Jitter:   jitter,
+			}
+			report, err = transporttest.Simulate(sim)
+		case "soak":
+			report, err = soak(s, nodes, network, transporttest.Workload{
+				Duration:         duration,
+				Writers:          writers,
+				WriteInterval:    10 * time.Millisecond,
+				ElectionInterval: duration / 4,
+				Downtime:         time.Second,
+				SnapshotInterval: duration / 3,
+			})
+		default:
+			log.Fatalf("Unknown mode %s", mode)
+		}
+
+		if report != nil {
+			fmt.Printf("seed %d: %+v\n", s, *report)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL: seed %d: %s\n", s, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d runs failed\n", failed, runs)
+		os.Exit(1)
+	}
+}
+
+// Starts a cluster and drives a workload through it.
+func soak(seed int64, nodes int, network string, w transporttest.Workload) (*transporttest.Report, error) {
+	c, err := transporttest.Start(transporttest.Config{
+		Nodes:   nodes,
+		Network: network,
+		Seed:    seed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Run(w)
+}
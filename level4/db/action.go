@@ -1,13 +1,25 @@
 package db
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"github.com/metcalf/ctf3/level4/debuglog"
 	"github.com/metcalf/raft"
 	"io"
 )
 
+// Actions are encoded with a leading version byte.  Actions written before
+// dedup tokens existed have no version byte and start with the row ID, whose
+// first big-endian byte is always zero since row IDs are below rowCount;
+// those decode with a zero token.
+const (
+	legacyActionVersion uint8 = 0
+	actionVersion       uint8 = 1
+)
+
 type Action struct {
+	token        uint64
 	rowId        uint32
 	inc          uint8
 	favoriteWord string
@@ -15,12 +27,29 @@ type Action struct {
 
 func NewAction(rowId uint32, inc uint8, favoriteWord string) *Action {
 	return &Action{
+		token:        newToken(),
 		rowId:        rowId,
 		inc:          inc,
 		favoriteWord: favoriteWord,
 	}
 }
 
+// Generates a random token identifying a single client write.  Tokens let the
+// DB recognize an action that was proposed more than once (e.g. re-proposed
+// after a leadership change) and apply it only the first time.
+func newToken() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Retrieves the dedup token of the action.  A zero token disables dedup.
+func (a *Action) DedupToken() uint64 {
+	return a.token
+}
+
 func (a *Action) DebugLog(description string) {
 	debuglog.Debugf(
 		"%s action to increment row %d by %d "+
@@ -42,6 +71,12 @@ func (a *Action) Apply(context raft.Context) (interface{}, error) {
 func (action *Action) Encode(w io.Writer) error {
 	strLen := uint8(len(action.favoriteWord))
 
+	if err := binary.Write(w, binary.BigEndian, actionVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, action.token); err != nil {
+		return err
+	}
 	if err := binary.Write(w, binary.BigEndian, action.rowId); err != nil {
 		return err
 	}
@@ -60,12 +95,32 @@ func (action *Action) Encode(w io.Writer) error {
 
 func (action *Action) Decode(r io.Reader) error {
 	var inc uint8
+	var token uint64
 	var rowId uint32
 	var strLen uint8
+	var version uint8
 
-	if err := binary.Read(r, binary.BigEndian, &rowId); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
 		return err
 	}
+	switch version {
+	case legacyActionVersion:
+		// The version byte was the top byte of the row ID.
+		var rest [3]byte
+		if _, err := io.ReadFull(r, rest[:]); err != nil {
+			return err
+		}
+		rowId = uint32(rest[0])<<16 | uint32(rest[1])<<8 | uint32(rest[2])
+	case actionVersion:
+		if err := binary.Read(r, binary.BigEndian, &token); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &rowId); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown action version %d", version)
+	}
 	if err := binary.Read(r, binary.BigEndian, &inc); err != nil {
 		return err
 	}
@@ -79,6 +134,7 @@ func (action *Action) Decode(r io.Reader) error {
 		return err
 	}
 
+	action.token = token
 	action.rowId = rowId
 	action.inc = inc
 	action.favoriteWord = string(wordData)
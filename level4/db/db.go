@@ -8,6 +8,11 @@ import (
 
 const rowCount = 5
 
+// Number of recent action tokens remembered for dedup.  Re-proposals happen
+// within a few election timeouts of the original, so this only needs to
+// cover the writes that can land in that window.
+const dedupWindow = 4096
+
 type DBContext interface {
 	DB() *DB
 }
@@ -18,15 +23,21 @@ type AsyncResponse struct {
 }
 
 type DB struct {
-	actions  []*Action
+	engine   Engine
 	rowNames [rowCount]string
 	mutex    sync.RWMutex
 	onAppend *sync.Cond
+	applied  map[uint64]int
+	tokens   []uint64
 }
 
 func New() *DB {
+	engine, _ := NewEngine(DefaultEngine)
+
 	db := &DB{
+		engine:   engine,
 		rowNames: [rowCount]string{"siddarth", "gdb", "christian", "andy", "carl"},
+		applied:  make(map[uint64]int),
 	}
 
 	db.onAppend = sync.NewCond(&db.mutex)
@@ -53,35 +64,7 @@ func (db *DB) Get(index int) []*Row {
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
-	var responseData [rowCount]*Row
-	var actions []*Action
-
-	if index >= 0 {
-		actions = db.actions[:index]
-	} else {
-		actions = db.actions
-	}
-
-	for i, name := range db.rowNames {
-		responseData[i] = &Row{
-			name:         name,
-			friendCount:  0,
-			requestCount: 0,
-			favoriteWord: "",
-		}
-	}
-
-	for _, action := range actions {
-		row := responseData[action.rowId]
-
-		row.friendCount += uint32(action.inc)
-		if action.inc > 0 {
-			row.requestCount += 1
-		}
-		row.favoriteWord = action.favoriteWord
-	}
-
-	return responseData[:]
+	return db.engine.Rows(db.rowNames[:], index)
 }
 
 func (db *DB) GetWhenReady(index int) chan *AsyncResponse {
@@ -90,8 +73,8 @@ func (db *DB) GetWhenReady(index int) chan *AsyncResponse {
 	go func() {
 		db.mutex.Lock()
 		for {
-			debuglog.Debugf("Waiting for %d to be >= %d", len(db.actions), index)
-			if len(db.actions) >= index {
+			debuglog.Debugf("Waiting for %d to be >= %d", db.engine.Len(), index)
+			if db.engine.Len() >= index {
 				db.mutex.Unlock()
 				debuglog.Debugln("DB ready, getting")
 				ch <- &AsyncResponse{
@@ -112,12 +95,79 @@ func (db *DB) Put(action *Action) int {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	if index, ok := db.applied[action.token]; ok && action.token != 0 {
+		action.DebugLog("Skipping duplicate")
+		return index
+	}
+
 	action.DebugLog("Storing")
 
-	db.actions = append(db.actions, action)
+	db.engine.Append(action)
 	db.onAppend.Broadcast()
 
-	return len(db.actions)
+	db.remember(action.token, db.engine.Len())
+
+	return db.engine.Len()
+}
+
+// Replaces the storage engine with the named one, carrying over all applied
+// actions.  Holding the write lock for the duration fences off concurrent
+// applies and reads, so they observe either the old engine or the fully
+// initialized new one.
+func (db *DB) SwapEngine(name string) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.engine.Name() == name {
+		return db.engine.Len(), nil
+	}
+
+	engine, err := NewEngine(name)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := db.engine.Save()
+	if err != nil {
+		return 0, fmt.Errorf("Could not snapshot engine %s: %s", db.engine.Name(), err)
+	}
+	if err := engine.Recover(data); err != nil {
+		return 0, fmt.Errorf("Could not initialize engine %s: %s", name, err)
+	}
+	if engine.Len() != db.engine.Len() {
+		return 0, fmt.Errorf("Engine %s recovered %d actions but expected %d",
+			name, engine.Len(), db.engine.Len())
+	}
+
+	debuglog.Debugf("Swapped engine %s for %s at index %d",
+		db.engine.Name(), name, engine.Len())
+	db.engine = engine
+
+	return engine.Len(), nil
+}
+
+// Retrieves the name of the current storage engine.
+func (db *DB) EngineName() string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.engine.Name()
+}
+
+// Records the index an action token was applied at, evicting the oldest
+// token once the dedup window is full.
+func (db *DB) remember(token uint64, index int) {
+	if token == 0 {
+		return
+	}
+
+	if len(db.tokens) >= dedupWindow {
+		delete(db.applied, db.tokens[0])
+		db.tokens = db.tokens[1:]
+	}
+
+	db.tokens = append(db.tokens, token)
+	db.applied[token] = index
 }
 
 func (db *DB) RowNames() []string {
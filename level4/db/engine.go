@@ -0,0 +1,213 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// An Engine stores the actions applied to the DB and answers reads against
+// them.  Engines are interchangeable: each can save its contents as a stream
+// of encoded actions and recover from a stream saved by any other engine,
+// which is what lets a running cluster migrate between them.
+type Engine interface {
+	Name() string
+	Append(action *Action)
+	Len() int
+	// Returns the rows as of the given index (or the latest if negative).
+	Rows(names []string, index int) []*Row
+	Save() ([]byte, error)
+	Recover(data []byte) error
+}
+
+const DefaultEngine = "actionlog"
+
+var engines = struct {
+	sync.RWMutex
+	factories map[string]func() Engine
+}{factories: map[string]func() Engine{
+	"actionlog": func() Engine { return &actionLog{} },
+	"rowpages":  func() Engine { return &rowPages{} },
+}}
+
+// Makes an engine available to SwapEngine commands under the given name.
+// Every node in a cluster must register the same engines.
+func RegisterEngine(name string, factory func() Engine) {
+	engines.Lock()
+	defer engines.Unlock()
+	engines.factories[name] = factory
+}
+
+// Retrieves the names of the registered engines.
+func Engines() []string {
+	engines.RLock()
+	defer engines.RUnlock()
+
+	var names []string
+	for name := range engines.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewEngine(name string) (Engine, error) {
+	engines.RLock()
+	factory, ok := engines.factories[name]
+	engines.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown engine %s (have %v)", name, Engines())
+	}
+	return factory(), nil
+}
+
+func saveActions(actions []*Action) ([]byte, error) {
+	var b bytes.Buffer
+	for _, action := range actions {
+		if err := action.Encode(&b); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func recoverActions(data []byte, apply func(*Action)) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		action := &Action{}
+		if err := action.Decode(r); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		apply(action)
+	}
+	return nil
+}
+
+func clampIndex(index, length int) int {
+	if index < 0 || index > length {
+		return length
+	}
+	return index
+}
+
+//------------------------------------------------------------------------------
+//
+// Action log engine
+//
+//------------------------------------------------------------------------------
+
+// The actionLog engine keeps only the list of actions and replays them on
+// every read.  Writes are cheap; reads are linear in the number of actions.
+type actionLog struct {
+	actions []*Action
+}
+
+func (e *actionLog) Name() string {
+	return "actionlog"
+}
+
+func (e *actionLog) Append(action *Action) {
+	e.actions = append(e.actions, action)
+}
+
+func (e *actionLog) Len() int {
+	return len(e.actions)
+}
+
+func (e *actionLog) Rows(names []string, index int) []*Row {
+	rows := make([]*Row, len(names))
+	for i, name := range names {
+		rows[i] = &Row{name: name}
+	}
+
+	for _, action := range e.actions[:clampIndex(index, len(e.actions))] {
+		row := rows[action.rowId]
+
+		row.friendCount += uint32(action.inc)
+		if action.inc > 0 {
+			row.requestCount += 1
+		}
+		row.favoriteWord = action.favoriteWord
+	}
+
+	return rows
+}
+
+func (e *actionLog) Save() ([]byte, error) {
+	return saveActions(e.actions)
+}
+
+func (e *actionLog) Recover(data []byte) error {
+	e.actions = nil
+	return recoverActions(data, e.Append)
+}
+
+//------------------------------------------------------------------------------
+//
+// Row pages engine
+//
+//------------------------------------------------------------------------------
+
+// The rowPages engine materializes a page holding every row's state after
+// each action.  Reads at any index are constant time at the cost of memory
+// proportional to actions times rows.
+type rowPages struct {
+	actions []*Action
+	pages   [][rowCount]Row
+}
+
+func (e *rowPages) Name() string {
+	return "rowpages"
+}
+
+func (e *rowPages) Append(action *Action) {
+	var page [rowCount]Row
+	if len(e.pages) > 0 {
+		page = e.pages[len(e.pages)-1]
+	}
+
+	row := &page[action.rowId]
+	row.friendCount += uint32(action.inc)
+	if action.inc > 0 {
+		row.requestCount += 1
+	}
+	row.favoriteWord = action.favoriteWord
+
+	e.actions = append(e.actions, action)
+	e.pages = append(e.pages, page)
+}
+
+func (e *rowPages) Len() int {
+	return len(e.actions)
+}
+
+func (e *rowPages) Rows(names []string, index int) []*Row {
+	var page [rowCount]Row
+	if index = clampIndex(index, len(e.pages)); index > 0 {
+		page = e.pages[index-1]
+	}
+
+	rows := make([]*Row, len(names))
+	for i, name := range names {
+		row := page[i]
+		row.name = name
+		rows[i] = &row
+	}
+
+	return rows
+}
+
+func (e *rowPages) Save() ([]byte, error) {
+	return saveActions(e.actions)
+}
+
+func (e *rowPages) Recover(data []byte) error {
+	e.actions = nil
+	e.pages = nil
+	return recoverActions(data, e.Append)
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"encoding/binary"
+	"github.com/metcalf/raft"
+	"io"
+)
+
+// A SwapEngine command migrates the DB to a different storage engine.  Since
+// it travels through the Raft log, every node swaps at the same index.
+type SwapEngine struct {
+	engine string
+}
+
+func NewSwapEngine(engine string) *SwapEngine {
+	return &SwapEngine{
+		engine: engine,
+	}
+}
+
+func (s *SwapEngine) CommandName() string {
+	return "swapEngine"
+}
+
+func (s *SwapEngine) Apply(context raft.Context) (interface{}, error) {
+	return context.Server().Context().(DBContext).DB().SwapEngine(s.engine)
+}
+
+func (s *SwapEngine) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, uint8(len(s.engine))); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(s.engine)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SwapEngine) Decode(r io.Reader) error {
+	var strLen uint8
+
+	if err := binary.Read(r, binary.BigEndian, &strLen); err != nil {
+		return err
+	}
+
+	engine := make([]byte, strLen, strLen)
+	if _, err := io.ReadFull(r, engine); err != nil {
+		return err
+	}
+
+	s.engine = string(engine)
+	return nil
+}
@@ -1,24 +1,81 @@
 package debuglog
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
 )
 
+// A Logger writes debug lines to a set of sinks.  A sink is any io.Writer;
+// each line is written to it with a single Write call.
 type Logger struct {
 	*log.Logger
 	verbose bool
+	sampler *sampler
+	ring    *Ring
 }
 
 func New() *Logger {
 	return &Logger{
 		log.New(os.Stderr, "", log.LstdFlags),
 		false,
+		newSampler(),
+		nil,
 	}
 }
 
 var std = New()
 
+// Sets where the logger writes.  With no sinks, lines are discarded.
+func (l *Logger) SetSinks(sinks ...io.Writer) {
+	l.ring = nil
+	for _, sink := range sinks {
+		if ring, ok := sink.(*Ring); ok {
+			l.ring = ring
+			break
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		l.SetOutput(io.Discard)
+	case 1:
+		l.SetOutput(sinks[0])
+	default:
+		l.SetOutput(multiSink(sinks))
+	}
+}
+
+// Returns the first Ring among the logger's sinks, or nil if it has none.
+func (l *Logger) Ring() *Ring {
+	return l.ring
+}
+
+// Limits each kind of debug line to perSecond lines a second, dropping the
+// rest and noting how many were dropped.  A line's kind is its format string
+// for Debugf, its tag for DebugTagln and its first argument for Debugln, so
+// Debugln lines should lead with a constant such as a debug key; lines that
+// lead with a variable, such as a server name, use DebugTagln.  Zero disables
+// sampling.
+func (l *Logger) SetSampling(perSecond int) {
+	l.sampler.setRate(perSecond)
+}
+
+// A multiSink writes each line to every sink, carrying on past failures so
+// one broken sink doesn't silence the others.
+type multiSink []io.Writer
+
+func (m multiSink) Write(p []byte) (int, error) {
+	var err error
+	for _, sink := range m {
+		if _, e := sink.Write(p); e != nil && err == nil {
+			err = e
+		}
+	}
+	return len(p), err
+}
+
 // debug logging methods:
 
 func Verbose() bool {
@@ -29,14 +86,52 @@ func SetVerbose(verbose bool) {
 	std.verbose = verbose
 }
 
+func SetSinks(sinks ...io.Writer) {
+	std.SetSinks(sinks...)
+}
+
+func Recent() *Ring {
+	return std.Ring()
+}
+
+func SetSampling(perSecond int) {
+	std.SetSampling(perSecond)
+}
+
 func Debugln(v ...interface{}) {
-	if std.verbose {
+	if std.verbose && std.sample(lineKind(v)) {
 		std.Println(v...)
 	}
 }
 
 func Debugf(format string, v ...interface{}) {
-	if std.verbose {
+	if std.verbose && std.sample(format) {
 		std.Printf(format, v...)
 	}
 }
+
+// Like Debugln, but sampled as lines of the given kind.  The tag isn't
+// written.
+func DebugTagln(tag string, v ...interface{}) {
+	if std.verbose && std.sample(tag) {
+		std.Println(v...)
+	}
+}
+
+func lineKind(v []interface{}) string {
+	if len(v) == 0 {
+		return ""
+	}
+	if s, ok := v[0].(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%T", v[0])
+}
+
+func (l *Logger) sample(kind string) bool {
+	ok, dropped := l.sampler.allow(kind)
+	if dropped > 0 {
+		l.Printf("debuglog: dropped %d %q lines", dropped, kind)
+	}
+	return ok
+}
@@ -0,0 +1,92 @@
+package debuglog
+
+import (
+	"sync"
+	"time"
+)
+
+// Most kinds of line a sampler tracks at once.  Once that many have been seen
+// within a window, lines of new kinds share a single overflow window, so a
+// caller logging an unbounded set of kinds can't grow the map without limit.
+const maxSampleKinds = 1024
+
+const overflowKind = "debuglog.overflow"
+
+// A sampler counts lines of each kind in one-second windows, allowing at most
+// rate of them a window.
+type sampler struct {
+	mutex sync.Mutex
+	rate  int
+	kinds map[string]*sampleWindow
+	now   func() time.Time
+}
+
+type sampleWindow struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+func newSampler() *sampler {
+	return &sampler{
+		kinds: make(map[string]*sampleWindow),
+		now:   time.Now,
+	}
+}
+
+func (s *sampler) setRate(rate int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rate = rate
+	s.kinds = make(map[string]*sampleWindow)
+}
+
+// Reports whether a line of the given kind should be written, and how many
+// lines of that kind were dropped in the window that has just ended.
+func (s *sampler) allow(kind string) (bool, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.rate <= 0 {
+		return true, 0
+	}
+
+	now := s.now()
+	w := s.kinds[kind]
+	if w == nil {
+		if len(s.kinds) >= maxSampleKinds {
+			s.expire(now)
+		}
+		if len(s.kinds) >= maxSampleKinds {
+			kind = overflowKind
+			w = s.kinds[kind]
+		}
+	}
+	if w == nil {
+		w = &sampleWindow{start: now}
+		s.kinds[kind] = w
+	}
+
+	dropped := 0
+	if now.Sub(w.start) >= time.Second {
+		dropped = w.dropped
+		*w = sampleWindow{start: now}
+	}
+
+	if w.count >= s.rate {
+		w.dropped++
+		return false, dropped
+	}
+	w.count++
+	return true, dropped
+}
+
+// Forgets the kinds whose windows have ended without dropping anything.  Must
+// be called with the mutex held.
+func (s *sampler) expire(now time.Time) {
+	for kind, w := range s.kinds {
+		if now.Sub(w.start) >= time.Second && w.dropped == 0 {
+			delete(s.kinds, kind)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package debuglog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// A RotatingFile is a sink that appends to a file, renaming it to path.1 once
+// it would grow past a size limit.  Older files shift up to path.2 and so on,
+// and the oldest past the kept count is removed.
+type RotatingFile struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// A Ring is a sink that keeps the most recent lines in memory, for dumping
+// after something has gone wrong.
+type Ring struct {
+	mutex sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+// Returns a sink that writes to standard error.
+func Stderr() io.Writer {
+	return os.Stderr
+}
+
+// Opens path for appending, rotating it at maxSize bytes and keeping maxFiles
+// rotated files besides the current one.
+func NewRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Invalid maximum log size %d", maxSize)
+	}
+
+	f := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if f.maxFiles > 0 {
+		os.Remove(f.rotated(f.maxFiles))
+		for i := f.maxFiles - 1; i > 0; i-- {
+			os.Rename(f.rotated(i), f.rotated(i+1))
+		}
+		if err := os.Rename(f.path, f.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *RotatingFile) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// Creates a ring that keeps the last size lines.
+func NewRing(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+	return &Ring{lines: make([][]byte, size)}
+}
+
+func (r *Ring) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lines[r.next] = append(r.lines[r.next][:0], p...)
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+	return len(p), nil
+}
+
+// Writes the kept lines, oldest first.
+func (r *Ring) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	lines := make([][]byte, 0, len(r.lines))
+	if r.full {
+		for _, line := range r.lines[r.next:] {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	for _, line := range r.lines[:r.next] {
+		lines = append(lines, append([]byte(nil), line...))
+	}
+	r.mutex.Unlock()
+
+	var total int64
+	for _, line := range lines {
+		n, err := w.Write(line)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
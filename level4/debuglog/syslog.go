@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package debuglog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// Returns a sink that sends lines to the local syslog daemon at debug
+// priority under the given tag.
+func NewSyslog(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_DEBUG|syslog.LOG_DAEMON, tag)
+}
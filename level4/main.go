@@ -1,28 +1,75 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"github.com/metcalf/ctf3/level4/cluster"
 	"github.com/metcalf/ctf3/level4/db"
 	"github.com/metcalf/ctf3/level4/debuglog"
 	"github.com/metcalf/ctf3/level4/server"
+	"github.com/metcalf/ctf3/level4/transport"
 	"github.com/metcalf/raft"
+	"github.com/nats-io/nats.go"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
-	var verbose int
-	var listen, join, directory string
+	var verbose, retries int
+	var admin bool
+	var listen, join, directory, record string
+	var socketDir, socketMode, socketOwner, socketGroup string
+	var logFile string
+	var logSize int64
+	var logFiles, logRing, logSample int
+	var logSyslog bool
+	var http2 bool
+	var advertise, bulkWindows, clusterID, natsURL, peersFile string
+	var tlsCert, tlsKey, tlsCA, encryptionKeys string
+	var maxIdleConns int
+	var idleTimeout, keepAlive time.Duration
 
 	flag.IntVar(&verbose, "v", 3, "Enable debug output")
 	flag.StringVar(&listen, "l", "127.0.0.1:4000", "Socket to listen on (Unix or TCP)")
 	flag.StringVar(&join, "join", "", "Cluster to join")
+	flag.StringVar(&advertise, "advertise", "", "Comma-separated addresses peers can reach this node at, in order of preference (defaults to -l)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate to talk to peers over TLS with, reloaded on SIGHUP or when it changes")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM key for -tls-cert")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM CA bundle to verify peers against, requiring them to present certificates")
+	flag.StringVar(&encryptionKeys, "encryption-keys", "", "Comma-separated id:hex keys to encrypt RPC bodies with, sealing with the first")
+	flag.StringVar(&peersFile, "peers-file", "", "JSON file mapping peer names to connection strings, reread when it changes")
+	flag.StringVar(&natsURL, "nats", "", "Carry Raft RPCs over the NATS server at this URL")
+	flag.StringVar(&clusterID, "cluster-id", "", "Only talk to peers started with the same cluster ID")
+	flag.StringVar(&bulkWindows, "bulk-windows", "", "Comma-separated HH:MM-HH:MM local times to confine snapshot transfers to")
 	flag.StringVar(&directory, "d", "/tmp/sqlcluster", "Storage directory")
+	flag.StringVar(&record, "record", "", "Append every Raft RPC to this trace file")
+	flag.BoolVar(&admin, "admin", false, "Serve read-only cluster state and live traffic dumps under /raft/admin")
+	flag.StringVar(&socketDir, "socket-dir", "", "Directory relative Unix socket paths are created in")
+	flag.StringVar(&socketMode, "socket-mode", "", "Permissions for the Unix socket, in octal")
+	flag.StringVar(&socketOwner, "socket-owner", "", "User to give ownership of the Unix socket")
+	flag.StringVar(&socketGroup, "socket-group", "", "Group to give ownership of the Unix socket")
+	flag.StringVar(&logFile, "log-file", "", "Also write debug output to this file")
+	flag.Int64Var(&logSize, "log-size", 64<<20, "Bytes at which to rotate the debug log file")
+	flag.IntVar(&logFiles, "log-files", 3, "Rotated debug log files to keep")
+	flag.IntVar(&logRing, "log-ring", 0, "Keep this many recent debug lines in memory, served under /raft/admin/log")
+	flag.BoolVar(&logSyslog, "syslog", false, "Also send debug output to syslog")
+	flag.IntVar(&logSample, "log-sample", 0, "Limit each kind of debug line to this many a second (0 disables)")
+	flag.BoolVar(&http2, "http2", false, "Speak HTTP/2 to peers (h2c without TLS; every peer must enable it)")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", transport.DefaultMaxIdleConnsPerHost, "Idle connections to keep per peer")
+	flag.DurationVar(&idleTimeout, "idle-timeout", transport.DefaultIdleConnTimeout, "How long to keep idle peer connections")
+	flag.DurationVar(&keepAlive, "keepalive", 0, "Interval between TCP keep-alive probes to peers (0 uses the OS default)")
+	flag.IntVar(&retries, "retries", cluster.DefaultRetryPolicy.Attempts, "Times to re-propose a pending write across leadership changes (0 disables)")
 
 	dir := filepath.Dir(os.Args[0])
 	base := "./" + filepath.Base(os.Args[0])
@@ -33,7 +80,9 @@ Run a highly-available SQLite.
 
 By default, SQLCluster will listen on a TCP port. However, if you
 specify a listen address that begins with a / or ., that will be
-interpeted as Unix path for SQLCluster to listen on.
+interpeted as Unix path for SQLCluster to listen on. An address that
+begins with @ is bound in the Linux abstract socket namespace. IPv6
+addresses are written in brackets, as in [::1]:4000.
 
 So for example, you could run:
 
@@ -64,6 +113,26 @@ OPTIONS:
 	}
 
 	debuglog.SetVerbose(verbose > 0)
+	debuglog.SetSampling(logSample)
+	sinks := []io.Writer{debuglog.Stderr()}
+	if logFile != "" {
+		f, err := debuglog.NewRotatingFile(logFile, logSize, logFiles)
+		if err != nil {
+			log.Fatalf("Error opening debug log: %s\n", err)
+		}
+		sinks = append(sinks, f)
+	}
+	if logRing > 0 {
+		sinks = append(sinks, debuglog.NewRing(logRing))
+	}
+	if logSyslog {
+		w, err := debuglog.NewSyslog("sqlcluster")
+		if err != nil {
+			log.Fatalf("Error connecting to syslog: %s\n", err)
+		}
+		sinks = append(sinks, w)
+	}
+	debuglog.SetSinks(sinks...)
 	raft.SetLogLevel(verbose - 1)
 
 	if err := os.MkdirAll(directory, os.ModeDir|0755); err != nil {
@@ -77,6 +146,17 @@ OPTIONS:
 
 	// Setup commands.
 	raft.RegisterCommand(&db.Action{})
+	raft.RegisterCommand(&db.SwapEngine{})
+	transport.RegisterCommand(&db.Action{})
+	transport.RegisterCommand(&db.SwapEngine{})
+
+	var recorder *transport.Recorder
+	if record != "" {
+		var err error
+		if recorder, err = transport.NewRecorder(record); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	go func() {
 		s, err := server.New()
@@ -89,6 +169,95 @@ OPTIONS:
 			log.Fatal(err)
 		}
 
+		policy := cluster.DefaultRetryPolicy
+		policy.Attempts = retries
+		c.SetRetryPolicy(policy)
+
+		if admin {
+			c.EnableAdmin()
+		}
+
+		opts := transport.DefaultUnixSocketOptions
+		opts.Dir = socketDir
+		opts.User = socketOwner
+		opts.Group = socketGroup
+		if socketMode != "" {
+			mode, err := strconv.ParseUint(socketMode, 8, 32)
+			if err != nil {
+				log.Fatalf("Invalid socket mode %s: %s", socketMode, err)
+			}
+			opts.Mode = os.FileMode(mode)
+		}
+		c.SetUnixSocketOptions(opts)
+		if advertise != "" {
+			c.SetAdvertise(transport.Addresses(advertise)...)
+		}
+
+		options := []transport.Option{
+			transport.WithMaxIdleConnsPerHost(maxIdleConns),
+			transport.WithIdleConnTimeout(idleTimeout),
+		}
+		if keepAlive > 0 {
+			options = append(options, transport.WithTCPKeepAlive(net.KeepAliveConfig{
+				Enable:   true,
+				Idle:     keepAlive,
+				Interval: keepAlive,
+				Count:    -1,
+			}))
+		}
+		if http2 {
+			options = append(options, transport.WithHTTP2())
+		}
+		if peersFile != "" {
+			discovery, err := transport.NewFileDiscovery(peersFile, 5*time.Second)
+			if err != nil {
+				log.Fatalf("Unable to read peers from %s: %s", peersFile, err)
+			}
+			options = append(options, transport.WithDiscovery(discovery))
+		}
+		c.SetTransportOptions(options...)
+
+		cfg := transport.Config{ClusterID: clusterID}
+		if tlsCert != "" {
+			cfg.TLS, err = loadTLS(tlsCert, tlsKey, tlsCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if encryptionKeys != "" {
+			for _, s := range strings.Split(encryptionKeys, ",") {
+				key, err := transport.ParseEncryptionKey(s)
+				if err != nil {
+					log.Fatal(err)
+				}
+				cfg.EncryptionKeys = append(cfg.EncryptionKeys, key)
+			}
+		}
+		if bulkWindows != "" {
+			for _, s := range strings.Split(bulkWindows, ",") {
+				w, err := transport.ParseTimeWindow(s)
+				if err != nil {
+					log.Fatal(err)
+				}
+				cfg.BulkWindows = append(cfg.BulkWindows, w)
+			}
+		}
+		if err := c.UpdateTransportConfig(cfg); err != nil {
+			log.Fatal(err)
+		}
+
+		if natsURL != "" {
+			nc, err := nats.Connect(natsURL)
+			if err != nil {
+				log.Fatalf("Unable to connect to NATS at %s: %s", natsURL, err)
+			}
+			c.SetNATS(transport.NewNATSTransporter(nc, "raft"))
+		}
+
+		if recorder != nil {
+			c.SetRecorder(recorder)
+		}
+
 		if err := c.ListenAndServe(join); err != nil {
 			log.Fatal(err)
 		}
@@ -98,4 +267,36 @@ OPTIONS:
 	sigchan := make(chan os.Signal)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigchan
+
+	// Write out the end of the trace.
+	if recorder != nil {
+		recorder.Close()
+	}
+}
+
+// Builds a TLS config presenting a certificate that is reloaded on SIGHUP or
+// when its files change, and verifying peers against ca if set.
+func loadTLS(cert, key, ca string) (*tls.Config, error) {
+	reloader, err := transport.NewCertReloader(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	reloader.Watch(10 * time.Second)
+	reloader.ReloadOnSignal(syscall.SIGHUP)
+
+	base := &tls.Config{}
+	if ca != "" {
+		b, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates in %s", ca)
+		}
+		base.RootCAs = pool
+		base.ClientCAs = pool
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return reloader.TLSConfig(base), nil
 }
@@ -31,6 +31,7 @@ func New() (*Server, error) {
 func (s *Server) ListenAndServe(do cluster.CommandHandler, mux *mux.Router) error {
 	s.do = do
 	mux.HandleFunc("/sql", s.sqlHandler).Methods("POST")
+	mux.HandleFunc("/engine", s.engineHandler).Methods("GET", "POST")
 
 	return nil
 }
@@ -76,6 +77,39 @@ func (s *Server) sqlHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Reports the current storage engine on GET, or migrates the cluster to the
+// engine named in the body on POST.
+func (s *Server) engineHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		fmt.Fprintf(w, "Engine: %s\nAvailable: %s\n",
+			s.db.EngineName(), strings.Join(db.Engines(), ", "))
+		return
+	}
+
+	nameBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf("Couldn't read body: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(string(nameBytes))
+	if _, err := db.NewEngine(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Requesting engine swap to %s", name)
+	index, err := s.do(db.NewSwapEngine(name))
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Engine: %s\nActions: %d\n", name, index)
+}
+
 func (s *Server) insertHandler(w http.ResponseWriter, names []string) {
 	if err := s.db.SetNames(names); err != nil {
 		log.Fatal(err)
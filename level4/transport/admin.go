@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"encoding/json"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The admin status of the local server.
+type AdminStatus struct {
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	Term         uint64 `json:"term"`
+	Leader       string `json:"leader"`
+	CommitIndex  uint64 `json:"commitIndex"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+// A peer as seen by the local server.
+type AdminPeer struct {
+	Name             string     `json:"name"`
+	ConnectionString string     `json:"connectionString"`
+	LastContact      *time.Time `json:"lastContact,omitempty"`
+	Transport        *PeerStats `json:"transport,omitempty"`
+	Info             *PeerInfo  `json:"info,omitempty"`
+}
+
+// Servers that expose their log can report log indices beyond the commit
+// index in the admin status.
+type logServer interface {
+	LogEntries() []*raft.LogEntry
+}
+
+// Retrieves the admin status path.
+func (t *HTTPTransporter) AdminStatusPath() string {
+	return joinPath(t.adminPath, "/status")
+}
+
+// Retrieves the admin peers path.
+func (t *HTTPTransporter) AdminPeersPath() string {
+	return joinPath(t.adminPath, "/peers")
+}
+
+// Retrieves the admin stats path.
+func (t *HTTPTransporter) AdminStatsPath() string {
+	return joinPath(t.adminPath, "/stats")
+}
+
+// Retrieves the admin timings path.
+func (t *HTTPTransporter) AdminTimingsPath() string {
+	return joinPath(t.adminPath, "/timings")
+}
+
+// Retrieves the admin Prometheus metrics path.
+func (t *HTTPTransporter) AdminMetricsPath() string {
+	return joinPath(t.adminPath, "/metrics")
+}
+
+// Retrieves the admin dump path, where a dump.Dumper streams decoded traffic
+// if one is mounted.
+func (t *HTTPTransporter) AdminDumpPath() string {
+	return joinPath(t.adminPath, "/dump")
+}
+
+// Retrieves the admin in-flight path.
+func (t *HTTPTransporter) AdminInFlightPath() string {
+	return joinPath(t.adminPath, "/inflight")
+}
+
+// Retrieves the admin log path.
+func (t *HTTPTransporter) AdminLogPath() string {
+	return joinPath(t.adminPath, "/log")
+}
+
+// Retrieves the per-RPC counters for this transporter, keyed by RPC.
+func (t *HTTPTransporter) Stats() map[string]RPCStats {
+	return t.stats.snapshot()
+}
+
+// Applies read-only admin endpoints to an http.ServeMux.  These are kept
+// separate from Install so that operators can choose whether to expose them.
+func (t *HTTPTransporter) InstallAdmin(server raft.Server, mux HTTPMuxer) {
+	mux.HandleFunc(t.AdminStatusPath(), adminHandler(func() interface{} {
+		return adminStatus(server)
+	}))
+	mux.HandleFunc(t.AdminPeersPath(), adminHandler(func() interface{} {
+		return t.adminPeers(server)
+	}))
+	mux.HandleFunc(t.AdminStatsPath(), adminHandler(func() interface{} {
+		return t.Stats()
+	}))
+	mux.HandleFunc(t.AdminTimingsPath(), adminHandler(func() interface{} {
+		return t.PhaseStats()
+	}))
+	mux.HandleFunc(t.AdminInFlightPath(), adminHandler(func() interface{} {
+		return t.InFlightRPCs()
+	}))
+	mux.HandleFunc(t.AdminMetricsPath(), t.adminMetricsHandler)
+	mux.HandleFunc(t.AdminLogPath(), adminLogHandler)
+}
+
+func adminStatus(server raft.Server) *AdminStatus {
+	status := &AdminStatus{
+		Name:        server.Name(),
+		State:       server.State(),
+		Term:        server.Term(),
+		Leader:      server.Leader(),
+		CommitIndex: server.CommitIndex(),
+	}
+
+	if ls, ok := server.(logServer); ok {
+		if entries := ls.LogEntries(); len(entries) > 0 {
+			last := entries[len(entries)-1]
+			status.LastLogIndex = last.Index
+			status.LastLogTerm = last.Term
+		}
+	}
+
+	return status
+}
+
+func (t *HTTPTransporter) adminPeers(server raft.Server) []AdminPeer {
+	peers := make([]AdminPeer, 0, len(server.Peers()))
+	for _, peer := range server.Peers() {
+		p := AdminPeer{
+			Name:             peer.Name,
+			ConnectionString: peer.ConnectionString,
+		}
+		if last := peer.LastActivity(); !last.IsZero() {
+			p.LastContact = &last
+		}
+		if stats, ok := t.PeerStats(peer.Name); ok {
+			p.Transport = &stats
+		}
+		if info, ok := t.PeerInfo(peer.Name); ok {
+			p.Info = &info
+		}
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+
+	return peers
+}
+
+func adminHandler(get func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(get()); err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	}
+}
+
+// Dumps the debug lines kept in memory, if the debug log has a ring sink.
+func adminLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ring := debuglog.Recent()
+	if ring == nil {
+		http.Error(w, "Debug log is not kept in memory", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ring.WriteTo(w)
+}
+
+// Serves the transporter's metrics for Prometheus to scrape.
+func (t *HTTPTransporter) adminMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	t.WritePrometheus(w)
+}
@@ -0,0 +1,546 @@
+// Package benchmarks measures the transporter's hot path: encoding and
+// decoding AppendEntries, handling them in a server transporter without a
+// network, and whole round trips through a client and server transporter over
+// loopback TCP and Unix sockets, across entry counts and payload sizes.
+// Results can be saved as a baseline and later runs compared against it, and
+// cases can carry allocation budgets, so that changes made for performance,
+// such as buffer pooling, can be validated and regressions caught.
+//
+// Run drives the benchmarks with testing.Benchmark, so they can be run from a
+// command such as transportbench.  Under go test -bench, each case runs as a
+// sub-benchmark through Case.Benchmark instead, since testing.Benchmark can't
+// be called from within a running benchmark.
+package benchmarks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/transport"
+	"github.com/metcalf/raft"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A single benchmark.
+type Case struct {
+	// Defaults to one built from the other fields, such as
+	// "roundtrip/unix/entries=64/payload=4096".
+	Name string
+
+	// "encode" or "decode" an AppendEntries, "handle" one in a server
+	// transporter, or send one on a "roundtrip" and decode its response.
+	Kind string
+
+	// "tcp" or "unix", for round trips.
+	Network string
+
+	// The entries in each AppendEntries, and the bytes of each entry's
+	// command.
+	Entries     int
+	PayloadSize int
+
+	// The configuration and options of both transporters in a round trip.
+	Config  transport.Config
+	Options []transport.Option
+
+	// If positive, the case fails if it allocates more than this per
+	// operation.
+	MaxAllocs int64
+}
+
+// The measurements of a case.
+type Result struct {
+	Name        string  `json:"name"`
+	N           int     `json:"n"`
+	NsPerOp     int64   `json:"nsPerOp"`
+	AllocsPerOp int64   `json:"allocsPerOp"`
+	BytesPerOp  int64   `json:"bytesPerOp"`
+	MBPerSec    float64 `json:"mbPerSec"`
+}
+
+// A measurement that got worse than its baseline by more than the tolerance.
+type Regression struct {
+	Name     string
+	Metric   string
+	Baseline float64
+	Current  float64
+}
+
+// Reports cases that allocated more than their budgets.
+type AllocError struct {
+	Results []Result
+	Budgets []int64
+}
+
+// Serves AppendEntries for round trips, answering each with success.  The
+// transporter only calls the methods implemented here.
+type benchServer struct {
+	raft.Server
+	name string
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Returns the standard suite: encoding, decoding and handling, and round trips
+// over both networks, of heartbeats and of AppendEntries with 1 and 64
+// entries of small and large commands.
+func DefaultCases() []Case {
+	var cases []Case
+	shapes := []struct{ entries, payload int }{
+		{0, 0},
+		{1, 64},
+		{1, 4096},
+		{64, 64},
+		{64, 4096},
+	}
+	for _, kind := range []string{"encode", "decode", "handle"} {
+		for _, s := range shapes {
+			cases = append(cases, Case{Kind: kind, Entries: s.entries, PayloadSize: s.payload})
+		}
+	}
+	for _, network := range []string{"tcp", "unix"} {
+		for _, s := range shapes {
+			cases = append(cases, Case{Kind: "roundtrip", Network: network, Entries: s.entries, PayloadSize: s.payload})
+		}
+	}
+	return cases
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the case's name.
+func (c Case) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	name := c.Kind
+	if c.Network != "" {
+		name += "/" + c.Network
+	}
+	return fmt.Sprintf("%s/entries=%d/payload=%d", name, c.Entries, c.PayloadSize)
+}
+
+// Runs each case in turn.  The error is an *AllocError if any case
+// allocated more than its budget, in which case all results are still
+// returned.
+func Run(cases []Case) ([]Result, error) {
+	results := make([]Result, 0, len(cases))
+	allocErr := &AllocError{}
+	for _, c := range cases {
+		r, err := runCase(c)
+		if err != nil {
+			return results, fmt.Errorf("%s: %s", c.String(), err)
+		}
+		results = append(results, r)
+		if c.MaxAllocs > 0 && r.AllocsPerOp > c.MaxAllocs {
+			allocErr.Results = append(allocErr.Results, r)
+			allocErr.Budgets = append(allocErr.Budgets, c.MaxAllocs)
+		}
+	}
+	if len(allocErr.Results) > 0 {
+		return results, allocErr
+	}
+	return results, nil
+}
+
+// Runs the case within a benchmark of the caller's, such as a sub-benchmark
+// under go test -bench.  Allocation budgets are only checked by Run.
+func (c Case) Benchmark(b *testing.B) {
+	bench, cleanup, err := c.benchmark()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup()
+
+	b.ReportAllocs()
+	bench(b)
+}
+
+// Builds the benchmark function of a case, and a function to release what it
+// set up.
+func (c Case) benchmark() (func(*testing.B), func(), error) {
+	switch c.Kind {
+	case "encode":
+		return encodeBenchmark(c), func() {}, nil
+	case "decode":
+		return decodeBenchmark(c), func() {}, nil
+	case "handle":
+		return handleBenchmark(c)
+	case "roundtrip":
+		return roundTripBenchmark(c)
+	}
+	return nil, nil, fmt.Errorf("Unknown benchmark kind %q", c.Kind)
+}
+
+func runCase(c Case) (Result, error) {
+	bench, cleanup, err := c.benchmark()
+	if err != nil {
+		return Result{}, err
+	}
+	defer cleanup()
+
+	var failure error
+	r := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		defer func() {
+			if e := recover(); e != nil {
+				failure = fmt.Errorf("%v", e)
+			}
+		}()
+		bench(b)
+	})
+	if failure != nil {
+		return Result{}, failure
+	}
+	if r.N == 0 {
+		return Result{}, fmt.Errorf("Benchmark did not run")
+	}
+
+	result := Result{
+		Name:        c.String(),
+		N:           r.N,
+		NsPerOp:     r.NsPerOp(),
+		AllocsPerOp: r.AllocsPerOp(),
+		BytesPerOp:  r.AllocedBytesPerOp(),
+	}
+	if r.Bytes > 0 && r.T > 0 {
+		result.MBPerSec = float64(r.Bytes) * float64(r.N) / 1e6 / r.T.Seconds()
+	}
+	return result, nil
+}
+
+// Builds the AppendEntries a case sends.
+func (c Case) request() *raft.AppendEntriesRequest {
+	req := &raft.AppendEntriesRequest{
+		Term:         1,
+		PrevLogIndex: 1000,
+		PrevLogTerm:  1,
+		CommitIndex:  1000,
+		LeaderName:   "leader",
+	}
+	payload := bytes.Repeat([]byte{'x'}, c.PayloadSize)
+	for i := 0; i < c.Entries; i++ {
+		req.Entries = append(req.Entries, &raft.LogEntry{
+			Index:       uint64(1001 + i),
+			Term:        1,
+			CommandName: "write",
+			Command:     payload,
+		})
+	}
+	return req
+}
+
+//--------------------------------------
+// Micro-benchmarks
+//--------------------------------------
+
+func encodeBenchmark(c Case) func(*testing.B) {
+	return func(b *testing.B) {
+		req := c.request()
+		var buf bytes.Buffer
+		if _, err := req.Encode(&buf); err != nil {
+			panic(err)
+		}
+		b.SetBytes(int64(buf.Len()))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			req.Encode(&buf)
+		}
+	}
+}
+
+func decodeBenchmark(c Case) func(*testing.B) {
+	return func(b *testing.B) {
+		var buf bytes.Buffer
+		if _, err := c.request().Encode(&buf); err != nil {
+			panic(err)
+		}
+		encoded := buf.Bytes()
+		b.SetBytes(int64(len(encoded)))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			req := &raft.AppendEntriesRequest{}
+			if _, err := req.Decode(bytes.NewReader(encoded)); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+//--------------------------------------
+// Handling
+//--------------------------------------
+
+// Returns a benchmark feeding AppendEntries straight to a server
+// transporter's handler, so the allocations of the receiving side, where
+// requests are pooled, are measured without a client or network, and a
+// function that stops the transporter.
+func handleBenchmark(c Case) (func(*testing.B), func(), error) {
+	t := transport.NewHTTPTransporter("/raft", c.Options...)
+	if err := t.UpdateConfig(c.Config); err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	t.Install(&benchServer{name: "server"}, mux)
+
+	bench := func(b *testing.B) {
+		var buf bytes.Buffer
+		if _, err := c.request().Encode(&buf); err != nil {
+			panic(err)
+		}
+		encoded := buf.Bytes()
+		body := bytes.NewReader(encoded)
+		req, err := http.NewRequest("POST", t.AppendEntriesPath(), nil)
+		if err != nil {
+			panic(err)
+		}
+		w := &discardWriter{header: make(http.Header)}
+		b.SetBytes(int64(len(encoded)))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			// The handler wraps the body, so each request needs a new one.
+			body.Reset(encoded)
+			req.Body = ioutil.NopCloser(body)
+			w.reset()
+			mux.ServeHTTP(w, req)
+			if w.status != http.StatusOK {
+				panic(fmt.Sprintf("AppendEntries %d answered with %d", i, w.status))
+			}
+		}
+	}
+	return bench, func() { t.Close() }, nil
+}
+
+// A ResponseWriter that keeps only the status.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+func (w *discardWriter) reset() {
+	for k := range w.header {
+		delete(w.header, k)
+	}
+	w.status = 0
+}
+
+//--------------------------------------
+// Round trips
+//--------------------------------------
+
+// Starts a server transporter on the case's network and returns a benchmark
+// sending to it from a client transporter, and a function that stops the
+// server.
+func roundTripBenchmark(c Case) (func(*testing.B), func(), error) {
+	dir, err := ioutil.TempDir("", "transportbench")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr := "127.0.0.1:0"
+	if c.Network == "unix" {
+		addr = filepath.Join(dir, "server.sock")
+	} else if c.Network != "tcp" {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("Unknown network %q", c.Network)
+	}
+
+	server := transport.NewHTTPTransporter("/raft", c.Options...)
+	client := transport.NewHTTPTransporter("/raft", c.Options...)
+	for _, t := range []*transport.HTTPTransporter{server, client} {
+		if err := t.UpdateConfig(c.Config); err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+	}
+	mux := http.NewServeMux()
+	server.Install(&benchServer{name: "server"}, mux)
+
+	l, err := transport.Listen(addr)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	connectionString, err := transport.Encode(l.Addr().String())
+	if err != nil {
+		l.Close()
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	srv := &http.Server{Handler: mux}
+	server.ConfigureServer(srv)
+	go srv.Serve(l)
+	cleanup := func() {
+		srv.Close()
+		server.Close()
+		client.Close()
+		os.RemoveAll(dir)
+	}
+
+	peer := &raft.Peer{Name: "server", ConnectionString: connectionString}
+	sender := &benchServer{name: "client"}
+	bench := func(b *testing.B) {
+		req := c.request()
+		var buf bytes.Buffer
+		req.Encode(&buf)
+		b.SetBytes(int64(buf.Len()))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			// A fresh request each time, since the transporter resends a
+			// request object it has just sent under the same ID and the
+			// server would answer from its cache of processed requests.
+			r := *req
+			if resp := client.SendAppendEntriesRequest(sender, peer, &r); resp == nil {
+				panic(fmt.Sprintf("AppendEntries %d failed", i))
+			}
+		}
+	}
+	return bench, cleanup, nil
+}
+
+func (s *benchServer) Name() string {
+	return s.name
+}
+
+func (s *benchServer) Path() string {
+	return os.TempDir()
+}
+
+func (s *benchServer) State() string {
+	return "follower"
+}
+
+func (s *benchServer) Term() uint64 {
+	return 1
+}
+
+func (s *benchServer) CommitIndex() uint64 {
+	return 1000
+}
+
+func (s *benchServer) Leader() string {
+	return "leader"
+}
+
+func (s *benchServer) ElectionTimeout() time.Duration {
+	return time.Second
+}
+
+func (s *benchServer) AppendEntries(req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	index := req.PrevLogIndex + uint64(len(req.Entries))
+	return &raft.AppendEntriesResponse{Term: req.Term, Index: index, CommitIndex: req.CommitIndex, Success: true}
+}
+
+//--------------------------------------
+// Baselines
+//--------------------------------------
+
+// Writes results as JSON, for use as a baseline.
+func WriteResults(w io.Writer, results []Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// Reads results written by WriteResults.
+func ReadResults(r io.Reader) ([]Result, error) {
+	var results []Result
+	if err := json.NewDecoder(r).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Compares results against a baseline, returning the measurements that got
+// worse by more than tolerance, a fraction: 0.1 allows 10%.  Round trips
+// allocate a few more or less from run to run, as connections are reused or
+// not, so allocations get the same tolerance.  Cases missing from either side
+// are skipped.
+func Compare(baseline, current []Result, tolerance float64) []Regression {
+	base := make(map[string]Result, len(baseline))
+	for _, r := range baseline {
+		base[r.Name] = r
+	}
+
+	var regressions []Regression
+	for _, r := range current {
+		b, ok := base[r.Name]
+		if !ok {
+			continue
+		}
+		if float64(r.NsPerOp) > float64(b.NsPerOp)*(1+tolerance) {
+			regressions = append(regressions, Regression{r.Name, "ns/op", float64(b.NsPerOp), float64(r.NsPerOp)})
+		}
+		if float64(r.AllocsPerOp) > float64(b.AllocsPerOp)*(1+tolerance) {
+			regressions = append(regressions, Regression{r.Name, "allocs/op", float64(b.AllocsPerOp), float64(r.AllocsPerOp)})
+		}
+		if float64(r.BytesPerOp) > float64(b.BytesPerOp)*(1+tolerance) {
+			regressions = append(regressions, Regression{r.Name, "B/op", float64(b.BytesPerOp), float64(r.BytesPerOp)})
+		}
+	}
+	sort.SliceStable(regressions, func(i, j int) bool { return regressions[i].Name < regressions[j].Name })
+	return regressions
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s: %s went from %.0f to %.0f (%+.1f%%)", r.Name, r.Metric, r.Baseline, r.Current, 100*(r.Current-r.Baseline)/r.Baseline)
+}
+
+func (e *AllocError) Error() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d cases over their allocation budgets:", len(e.Results))
+	for i, r := range e.Results {
+		fmt.Fprintf(&b, " %s (%d allocs/op, budget %d)", r.Name, r.AllocsPerOp, e.Budgets[i])
+	}
+	return b.String()
+}
+
+// Formats a result like a line of go test -bench output.
+func (r Result) String() string {
+	s := fmt.Sprintf("%-45s %10d %12d ns/op", r.Name, r.N, r.NsPerOp)
+	if r.MBPerSec > 0 {
+		s += fmt.Sprintf(" %10.2f MB/s", r.MBPerSec)
+	}
+	return s + fmt.Sprintf(" %10d B/op %6d allocs/op", r.BytesPerOp, r.AllocsPerOp)
+}
@@ -0,0 +1,12 @@
+package benchmarks
+
+import (
+	"testing"
+)
+
+// Runs each of the default cases as a sub-benchmark.
+func BenchmarkDefaultCases(b *testing.B) {
+	for _, c := range DefaultCases() {
+		b.Run(c.String(), c.Benchmark)
+	}
+}
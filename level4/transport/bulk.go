@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot transfers, which travel on the bulk lane, can be confined to
+// daily windows with Config.BulkWindows, and paused and resumed on demand, so
+// heavy catch-up traffic can be put off to quiet hours.  A transfer attempted
+// outside every window or while paused fails at once with ErrBulkPaused
+// rather than waiting, so the peer's heartbeats aren't held up behind it;
+// Raft tries the snapshot again with a later heartbeat.  A chunked transfer
+// cut off by a pause resumes from the chunks the peer already has.
+
+// Matches ErrThrottled.
+var ErrBulkPaused error = &kindError{"Bulk transfers are paused", []error{ErrThrottled}}
+
+// A daily window of time, from Start to End after midnight in Location.  A
+// window whose End is before its Start runs past midnight.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+
+	// Nil uses local time.
+	Location *time.Location
+}
+
+// Parses a window given as HH:MM-HH:MM in local time.
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	var w TimeWindow
+	var startH, startM, endH, endM int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &startH, &startM, &endH, &endM); err != nil {
+		return w, fmt.Errorf("Time window %q must be HH:MM-HH:MM", s)
+	}
+	w.Start = time.Duration(startH)*time.Hour + time.Duration(startM)*time.Minute
+	w.End = time.Duration(endH)*time.Hour + time.Duration(endM)*time.Minute
+	if err := w.validate(); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+func (w TimeWindow) validate() error {
+	if w.Start < 0 || w.Start >= 24*time.Hour || w.End < 0 || w.End > 24*time.Hour {
+		return fmt.Errorf("Time window %s-%s must fall within a day", w.Start, w.End)
+	}
+	return nil
+}
+
+// Reports whether the window contains a time.
+func (w TimeWindow) Contains(t time.Time) bool {
+	if w.Location != nil {
+		t = t.In(w.Location)
+	}
+	y, m, d := t.Date()
+	offset := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+
+	if w.End < w.Start {
+		return offset >= w.Start || offset < w.End
+	}
+	return offset >= w.Start && offset < w.End
+}
+
+// Holds snapshot transfers until ResumeBulkTransfers is called.
+func (t *HTTPTransporter) PauseBulkTransfers() {
+	atomic.StoreInt32(&t.bulkPaused, 1)
+}
+
+// Lets snapshot transfers proceed again, within the configured windows.
+func (t *HTTPTransporter) ResumeBulkTransfers() {
+	atomic.StoreInt32(&t.bulkPaused, 0)
+}
+
+// Reports whether snapshot transfers may start now: they aren't paused and,
+// if windows are configured, the time falls within one.
+func (t *HTTPTransporter) BulkTransfersAllowed() bool {
+	if atomic.LoadInt32(&t.bulkPaused) != 0 {
+		return false
+	}
+
+	windows := t.config().BulkWindows
+	if len(windows) == 0 {
+		return true
+	}
+	now := time.Now()
+	for _, w := range windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Controls the capture of RPC payloads that fail to decode.  Captures are
+// written as hex dumps to Dir and are capped both in size and in rate so a
+// peer sending garbage can't fill the disk.
+type CaptureConfig struct {
+	// Directory to write captures to.  Capture is disabled if empty.
+	Dir string
+	// Bytes of each payload to keep.
+	MaxBytes int
+	// Total payload bytes to capture over the life of the transporter.
+	Budget int64
+	// Minimum time between two captures.
+	Interval time.Duration
+}
+
+var DefaultCaptureConfig = CaptureConfig{
+	MaxBytes: 4096,
+	Budget:   1 << 20,
+	Interval: time.Second,
+}
+
+type payloadCapture struct {
+	mutex  sync.Mutex
+	config CaptureConfig
+	spent  int64
+	last   time.Time
+}
+
+func (c *payloadCapture) enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.config.Dir != "" && c.spent < c.config.Budget
+}
+
+func (c *payloadCapture) configure(config CaptureConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.config = config
+	c.spent = 0
+}
+
+// Returns a writer to tee a payload into, or nil if capture is disabled.
+func (c *payloadCapture) buffer() *cappedBuffer {
+	if !c.enabled() {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return &cappedBuffer{max: c.config.MaxBytes}
+}
+
+// Writes a captured payload to the capture directory if the rate and size
+// budgets allow.  direction is "request" or "response".
+func (c *payloadCapture) record(rpc, direction, peer string, payload *cappedBuffer, cause error) {
+	if payload == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	now := time.Now()
+	if c.config.Dir == "" || c.spent >= c.config.Budget || now.Sub(c.last) < c.config.Interval {
+		c.mutex.Unlock()
+		return
+	}
+	data := payload.buf
+	if remaining := c.config.Budget - c.spent; int64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+	c.spent += int64(len(data))
+	c.last = now
+	dir := c.config.Dir
+	c.mutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		debuglog.Debugln("transporter.capture.error:", err)
+		return
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("%d-%s-%s.hex", now.UnixNano(), rpc, direction))
+	contents := fmt.Sprintf("rpc: %s\ndirection: %s\npeer: %s\nerror: %v\nbytes: %d of %d (truncated: %t)\n\n%s",
+		rpc, direction, peer, cause, len(data), payload.total, payload.total > len(data),
+		hex.Dump(data))
+
+	if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+		debuglog.Debugln("transporter.capture.error:", err)
+		return
+	}
+	debuglog.Debugln("transporter.capture:", name)
+}
+
+// A cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	buf   []byte
+	max   int
+	total int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	if room := b.max - len(b.buf); room > 0 {
+		if len(p) > room {
+			b.buf = append(b.buf, p[:room]...)
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,173 @@
+package transport
+
+import (
+	"crypto/tls"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// A CertReloader serves a certificate and key from disk, rereading them when
+// asked, when the files change or on a signal.  Connections already
+// established keep the certificate they were made with; new connections, in
+// both directions, use the latest one that loaded successfully.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modified [2]time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Loads a certificate and key from PEM files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the current certificate, for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// Retrieves the current certificate, for tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// Returns a copy of base that presents the current certificate as both a
+// server and a client.  Pass it as Config.TLS, or to WithQUIC.
+func (r *CertReloader) TLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.Certificates = nil
+	cfg.GetCertificate = r.GetCertificate
+	cfg.GetClientCertificate = r.GetClientCertificate
+	return cfg
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Rereads the certificate and key.  If either can't be loaded, the previous
+// certificate stays in use.
+func (r *CertReloader) Reload() error {
+	modified, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modified = modified
+	r.mutex.Unlock()
+
+	debuglog.Debugln("Loaded TLS certificate from", r.certFile)
+	return nil
+}
+
+// Reloads whenever either file's modification time changes, checking every
+// interval until Close is called.
+func (r *CertReloader) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				modified, err := r.modTimes()
+				r.mutex.RLock()
+				changed := err == nil && modified != r.modified
+				r.mutex.RUnlock()
+				if changed {
+					r.reload()
+				}
+			}
+		}
+	}()
+}
+
+// Reloads on each of the given signals, typically SIGHUP, until Close is
+// called.
+func (r *CertReloader) ReloadOnSignal(sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		defer signal.Stop(ch)
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ch:
+				r.reload()
+			}
+		}
+	}()
+}
+
+// Stops watching for changes and signals.
+func (r *CertReloader) Close() error {
+	r.once.Do(func() { close(r.stop) })
+	return nil
+}
+
+func (r *CertReloader) reload() {
+	if err := r.Reload(); err != nil {
+		debuglog.Debugln("transporter.tls.reload.error:", err)
+	}
+}
+
+func (r *CertReloader) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
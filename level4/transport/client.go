@@ -5,34 +5,56 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 )
 
 type Client struct {
-	client *http.Client
+	client    *http.Client
+	srv       *srvResolver
+	addresses *addressBook
 }
 
 type RequestError struct {
 	StatusCode int
 	Message    []byte
+	kind       error
 }
 
 func (r *RequestError) Error() string {
 	return fmt.Sprintf("Status code %d: %s", r.StatusCode, r.Message)
 }
 
+// Retrieves the kind of rejection the peer reported, such as ErrThrottled, so
+// errors.Is sees through the RequestError to it.
+func (r *RequestError) Unwrap() error {
+	return r.kind
+}
+
 func NewClient() *Client {
+	addresses := newAddressBook()
+	transport := &http.Transport{
+		Dial: func(network, encoded string) (net.Conn, error) {
+			return addresses.dial(encoded, func(encoded string) (net.Conn, error) {
+				return UnixDialer(network, encoded)
+			})
+		},
+	}
 	return &Client{
 		client: &http.Client{
-			Transport: &http.Transport{
-				Dial: UnixDialer,
-			},
+			Transport: transport,
 		},
+		srv:       newSRVResolver(transport.CloseIdleConnections),
+		addresses: addresses,
 	}
 }
 
 func (s *Client) SafePost(connectionString, path string, reqB io.Reader) (io.Reader, error) {
-	url := connectionString + path
+	base, err := s.addresses.resolve(connectionString, s.srv)
+	if err != nil {
+		return nil, err
+	}
+	url := base + path
 	resp, err := s.client.Post(url, "application/octet-stream", reqB)
 	if err != nil {
 		return nil, err
@@ -41,7 +63,11 @@ func (s *Client) SafePost(connectionString, path string, reqB io.Reader) (io.Rea
 }
 
 func (s *Client) SafeGet(connectionString, path string) (io.Reader, error) {
-	url := connectionString + path
+	base, err := s.addresses.resolve(connectionString, s.srv)
+	if err != nil {
+		return nil, err
+	}
+	url := base + path
 	resp, err := s.client.Get(url)
 	if err != nil {
 		return nil, err
@@ -60,6 +86,7 @@ func handleResp(resp *http.Response) (io.Reader, error) {
 		return nil, &RequestError{
 			StatusCode: resp.StatusCode,
 			Message:    body,
+			kind:       responseKind(resp),
 		}
 	}
 
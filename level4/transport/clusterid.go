@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The header carrying the sender's cluster ID on requests and the handler's on
+// responses.
+const clusterIDHeader = "X-Raft-Cluster-Id"
+
+// A ClusterMismatchError is returned for an RPC to a peer in a different
+// cluster, or one with no cluster ID configured.
+type ClusterMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ClusterMismatchError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("Cluster ID mismatch: expected %q, peer sent none", e.Expected)
+	}
+	return fmt.Sprintf("Cluster ID mismatch: expected %q, peer is in %q", e.Expected, e.Actual)
+}
+
+// Checks a peer's cluster ID against ours.  Nothing is checked if we have no
+// cluster ID.
+func (t *HTTPTransporter) checkClusterID(h http.Header) error {
+	expected := t.config().ClusterID
+	if expected == "" {
+		return nil
+	}
+	if actual := h.Get(clusterIDHeader); actual != expected {
+		return &ClusterMismatchError{Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+func (t *HTTPTransporter) stampClusterID(h http.Header) {
+	if id := t.config().ClusterID; id != "" {
+		h.Set(clusterIDHeader, id)
+	}
+}
+
+// A clusterMuxer installs handlers that reject requests from other clusters.
+type clusterMuxer struct {
+	t   *HTTPTransporter
+	mux HTTPMuxer
+}
+
+func (m *clusterMuxer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		m.t.stampClusterID(w.Header())
+		if err := m.t.checkClusterID(r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// A clusterRoundTripper stamps requests with our cluster ID and fails those
+// answered by a peer from another cluster.
+type clusterRoundTripper struct {
+	t    *HTTPTransporter
+	next http.RoundTripper
+}
+
+func (c *clusterRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.t.config().ClusterID != "" {
+		req = req.Clone(req.Context())
+		c.t.stampClusterID(req.Header)
+	}
+
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.t.checkClusterID(resp.Header); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
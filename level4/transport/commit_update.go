@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"encoding/binary"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+)
+
+// An AppendEntries with no entries only carries the leader's term, its commit
+// index and the log position it expects the follower to hold, yet leaders
+// send thousands a second and each pays for protobuf encoding.  With
+// WithCommitUpdates, they are sent to the commit update route instead, as
+// fixed-size bodies of big-endian integers encoded without allocating a
+// message, and answered the same way.  The leader's name travels in the
+// X-Raft-Name header every request carries.  The follower hands the
+// reassembled AppendEntries to its server as usual.
+//
+// Every peer serves the route; a peer that answers 404 Not Found, as older
+// versions do, is sent ordinary AppendEntries from then on.
+
+const (
+	commitUpdateRequestSize  = 4 * 8
+	commitUpdateResponseSize = 3*8 + 1
+)
+
+// An AppendEntries request without entries, encoded as a commit update.
+type commitUpdateRequest raft.AppendEntriesRequest
+
+// An AppendEntries response, encoded as the answer to a commit update.
+type commitUpdateResponse raft.AppendEntriesResponse
+
+// Sends AppendEntries without entries as commit updates.
+func WithCommitUpdates() Option {
+	return func(t *HTTPTransporter) {
+		t.commitUpdates = true
+	}
+}
+
+func (req *commitUpdateRequest) Encode(w io.Writer) (int, error) {
+	var b [commitUpdateRequestSize]byte
+	binary.BigEndian.PutUint64(b[0:], req.Term)
+	binary.BigEndian.PutUint64(b[8:], req.PrevLogIndex)
+	binary.BigEndian.PutUint64(b[16:], req.PrevLogTerm)
+	binary.BigEndian.PutUint64(b[24:], req.CommitIndex)
+	return w.Write(b[:])
+}
+
+func (req *commitUpdateRequest) Decode(r io.Reader) (int, error) {
+	var b [commitUpdateRequestSize]byte
+	n, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return n, err
+	}
+	req.Term = binary.BigEndian.Uint64(b[0:])
+	req.PrevLogIndex = binary.BigEndian.Uint64(b[8:])
+	req.PrevLogTerm = binary.BigEndian.Uint64(b[16:])
+	req.CommitIndex = binary.BigEndian.Uint64(b[24:])
+	return n, nil
+}
+
+func (req *commitUpdateRequest) readHeader(h http.Header) {
+	req.LeaderName = h.Get(nameHeader)
+}
+
+func (resp *commitUpdateResponse) Encode(w io.Writer) (int, error) {
+	var b [commitUpdateResponseSize]byte
+	binary.BigEndian.PutUint64(b[0:], resp.Term)
+	binary.BigEndian.PutUint64(b[8:], resp.Index)
+	binary.BigEndian.PutUint64(b[16:], resp.CommitIndex)
+	if resp.Success {
+		b[24] = 1
+	}
+	return w.Write(b[:])
+}
+
+func (resp *commitUpdateResponse) Decode(r io.Reader) (int, error) {
+	var b [commitUpdateResponseSize]byte
+	n, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return n, err
+	}
+	resp.Term = binary.BigEndian.Uint64(b[0:])
+	resp.Index = binary.BigEndian.Uint64(b[8:])
+	resp.CommitIndex = binary.BigEndian.Uint64(b[16:])
+	resp.Success = b[24] != 0
+	return n, nil
+}
+
+// Retrieves the CommitUpdate path.
+func (t *HTTPTransporter) CommitUpdatePath() string {
+	return t.commitUpdatePath
+}
+
+// Sends an AppendEntries without entries to a peer as a commit update.  The
+// second result is false if the peer doesn't serve commit updates, and an
+// ordinary AppendEntries should be sent instead.
+func (t *HTTPTransporter) sendCommitUpdate(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) (*raft.AppendEntriesResponse, bool) {
+	resp := &raft.AppendEntriesResponse{}
+	err := t.send(server, peer, "cu", latencyLane, t.CommitUpdatePath(), (*commitUpdateRequest)(req), (*commitUpdateResponse)(resp))
+	if err == nil {
+		return resp, true
+	}
+	if rerr, ok := err.(*RequestError); !ok || rerr.StatusCode != http.StatusNotFound {
+		return nil, true
+	}
+	debuglog.Debugf("%s does not accept commit updates, sending AppendEntries", peer.Name)
+	t.refuseCommitUpdates(peer)
+	return nil, false
+}
+
+// Reports whether a peer is known not to serve the commit update route.
+func (t *HTTPTransporter) commitUpdatesRefused(peer *raft.Peer) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.noCommitUpdates[peer.Name]
+}
+
+func (t *HTTPTransporter) refuseCommitUpdates(peer *raft.Peer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.noCommitUpdates[peer.Name] = true
+}
+
+// Handles incoming commit updates.
+func (t *HTTPTransporter) commitUpdateHandler(server raft.Server) http.HandlerFunc {
+	return t.handle(server, "cu", "/commitUpdate",
+		func() decoder { return &commitUpdateRequest{} },
+		func(req decoder) encoder {
+			resp := server.AppendEntries((*raft.AppendEntriesRequest)(req.(*commitUpdateRequest)))
+			if resp == nil {
+				return nil
+			}
+			return (*commitUpdateResponse)(resp)
+		})
+}
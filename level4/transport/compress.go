@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// With Config.AdaptiveCompression, the ratio of compressed to raw size is
+// sampled for each RPC type, requests and responses separately.  A type whose
+// ratio rises above adaptiveMaxRatio, such as snapshots of data that is
+// already compressed, is sent uncompressed, except for one body in
+// adaptiveResample, which keeps the ratio current should the data change.
+// Heartbeats and other small bodies are usually below
+// Config.CompressionThreshold and never compressed at all.
+const (
+	adaptiveMaxRatio       = 0.9
+	adaptiveResample       = 64
+	compressionRatioWeight = 0.2
+)
+
+type compressionRatios struct {
+	mutex sync.Mutex
+	rpcs  map[string]*compressionRatio
+}
+
+type compressionRatio struct {
+	ratio   float64
+	skipped uint64
+}
+
+// A byteCounter counts the bytes written through it.
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+// Returns the gzip level to compress with.
+func (c *Config) compressionLevel() int {
+	if c.CompressionLevel == 0 {
+		return gzip.DefaultCompression
+	}
+	return c.CompressionLevel
+}
+
+func newCompressionRatios() *compressionRatios {
+	return &compressionRatios{rpcs: make(map[string]*compressionRatio)}
+}
+
+// Reports whether to compress a body of the given RPC type and size, which is
+// negative if not yet known.
+func (c *compressionRatios) compress(rpc string, size int, cfg *Config) bool {
+	if !cfg.Compress {
+		return false
+	}
+	if size >= 0 && size < cfg.CompressionThreshold {
+		return false
+	}
+	if !cfg.AdaptiveCompression {
+		return true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r, ok := c.rpcs[rpc]
+	if !ok || r.ratio <= adaptiveMaxRatio {
+		return true
+	}
+	r.skipped++
+	return r.skipped%adaptiveResample == 0
+}
+
+// Records the sizes of a body of the given RPC type before and after
+// compression.
+func (c *compressionRatios) observe(rpc string, raw, compressed int64, cfg *Config) {
+	if !cfg.AdaptiveCompression || raw <= 0 {
+		return
+	}
+	ratio := float64(compressed) / float64(raw)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r, ok := c.rpcs[rpc]
+	if !ok {
+		r = &compressionRatio{ratio: ratio}
+		c.rpcs[rpc] = r
+	}
+	r.ratio += compressionRatioWeight * (ratio - r.ratio)
+}
+
+// Retrieves the sampled ratio of compressed to raw size of each RPC type, with
+// responses under the RPC's name suffixed ".response".  Empty unless
+// Config.AdaptiveCompression is set.
+func (t *HTTPTransporter) CompressionRatios() map[string]float64 {
+	t.compression.mutex.Lock()
+	defer t.compression.mutex.Unlock()
+
+	ratios := make(map[string]float64, len(t.compression.rpcs))
+	for rpc, r := range t.compression.rpcs {
+		ratios[rpc] = r.ratio
+	}
+	return ratios
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Compresses a buffer into a new pooled buffer.
+func gzipBuffer(b *bytes.Buffer, level int) (*bytes.Buffer, error) {
+	z := getBuffer()
+	w, err := gzip.NewWriterLevel(z, level)
+	if err == nil {
+		_, err = w.Write(b.Bytes())
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		putBuffer(z)
+		return nil, err
+	}
+	return z, nil
+}
+
+// Returns a request's body, decrypted if encryption is configured and
+// decompressed if the peer compressed it.  A decompressed body is held to
+// the same limit as the body on the wire.
+func (t *HTTPTransporter) requestBody(r *http.Request, limited *limitedBody) (io.Reader, error) {
+	if err := t.config().openRequest(r); err != nil {
+		return nil, err
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return r.Body, nil
+	}
+	z, err := gzipReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return limited.decompressed(z), nil
+}
+
+func gzipReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// Reports whether a response to r should be compressed.
+func acceptsGzip(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+}
@@ -0,0 +1,333 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A Config holds the settings of an HTTPTransporter that can be changed while
+// it runs.  The zero Config is the default.
+type Config struct {
+	// How long to wait for a peer to answer an AppendEntries, RequestVote or
+	// other latency-lane RPC, from sending the request to reading the
+	// response.  Zero uses the server's election timeout.  Snapshots on the
+	// bulk lane are not bounded.
+	ResponseTimeout time.Duration
+
+	// How long to wait for a connection to a peer.  Zero waits as long as
+	// the operating system does.
+	DialTimeout time.Duration
+
+	// If non-zero, peers whose hostnames resolve to several addresses are
+	// dialed happy-eyeballs style, racing the addresses with attempts
+	// started this far apart.  The address that connects first is tried
+	// first on the next dial to that host.  Zero dials the addresses one at
+	// a time.
+	DualStackDelay time.Duration
+
+	// If set, peers are dialed over TLS and ServerTLSConfig serves with it.
+	// The same certificates identify this server as a client and as a server.
+	TLS *tls.Config
+
+	// Overrides of how TLS peers are verified, keyed by peer name.
+	PeerTLS map[string]PeerTLS
+
+	// Gzip request bodies, and response bodies for peers that accept it, at
+	// CompressionLevel.  A zero level uses gzip.DefaultCompression.
+	Compress         bool
+	CompressionLevel int
+
+	// Bodies smaller than this many bytes, encoded, are sent uncompressed.
+	// Streamed request bodies, whose size isn't known in advance, are
+	// compressed whatever their size.
+	CompressionThreshold int
+
+	// Stop compressing bodies of RPC types that don't compress well, as
+	// sampled by CompressionRatios.
+	AdaptiveCompression bool
+
+	// Rate limits, as set by SetGlobalLimit and SetPeerLimit.
+	GlobalLimit Limit
+	PeerLimits  map[string]Limit
+
+	// If positive, each candidacy's RequestVotes are held back by a random
+	// delay up to this, to break up split votes.  Capped at a quarter of the
+	// election timeout.
+	VoteJitter time.Duration
+
+	// If positive, outgoing RPCs and incoming requests running longer than
+	// this are cancelled.  See InFlightRPCs.
+	RPCCeiling time.Duration
+
+	// If positive, once a peer can't be dialed, sends to it fail immediately
+	// for this long while it is probed in the background.
+	UnreachableTTL time.Duration
+
+	// Bounds on the sends outstanding to each peer.
+	Queue QueueConfig
+
+	// How AppendEntries to peers with slow responses are spaced out.
+	SlowPeers SlowPeerPolicy
+
+	// Caps on the snapshot bytes exchanged with each peer.
+	SnapshotQuota SnapshotQuota
+
+	// If set, snapshots are only sent to peers within one of these windows.
+	BulkWindows []TimeWindow
+
+	// A shadow server incoming traffic is mirrored to.
+	Mirror MirrorConfig
+
+	// Refuse responses from peers in a lower term than they have answered in
+	// before.  See ResetTermFence.
+	TermFencing bool
+
+	// If positive, incoming RPC bodies larger than this many bytes, either
+	// as sent on the wire or once decompressed, are refused with
+	// ErrRequestTooLarge.
+	MaxRequestSize int64
+
+	// If positive, snapshot deltas that would rebuild a snapshot larger than
+	// this many bytes are refused with ErrRequestTooLarge.  A delta is sent
+	// in chunks, so this is independent of MaxRequestSize.
+	MaxSnapshotSize int64
+
+	// Bounds on incoming requests handled at once, keyed by RPC type: ae,
+	// cu, rv, ss, ssr, ssr.manifest, ssr.chunk, ssr.commit, tn, pv, ri,
+	// forward, join, leave or the name of a custom RPC.
+	HandlerLimits map[string]HandlerLimit
+
+	// If set, RPC bodies are sealed with the first key and opened with any
+	// of them, and unsealed bodies are refused.
+	EncryptionKeys []EncryptionKey
+
+	// Called, if set, with the error of each outgoing RPC that fails, which
+	// errors.Is can match against ErrPeerUnreachable, ErrThrottled and the
+	// other kinds of failure.
+	OnSendError func(peer, rpc string, err error)
+
+	// Describe this server in the headers of RPC responses, for peers to
+	// read with PeerInfo.  Version, if set, is reported as its version.
+	ResponseMetadata bool
+	Version          string
+
+	// Called, if set, with the metadata of each RPC response that has any,
+	// before the Send* call that received it returns.
+	OnPeerInfo func(peer string, info PeerInfo)
+
+	// If set, RPCs are only exchanged with peers configured with the same
+	// cluster ID, so a server can't join or disrupt the wrong cluster.
+	ClusterID string
+}
+
+var errNoTLS = errors.New("TLS is not configured")
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the current configuration.
+func (t *HTTPTransporter) Config() Config {
+	return *t.config()
+}
+
+func (t *HTTPTransporter) config() *Config {
+	return t.cfg.Load().(*Config)
+}
+
+// Returns a TLS config for serving the transporter's routes.  It follows the
+// TLS material of the current configuration, so certificates swapped in with
+// UpdateConfig apply to new connections without restarting the listener.
+func (t *HTTPTransporter) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if cfg := t.config().TLS; cfg != nil {
+				if t.http2 && len(cfg.NextProtos) == 0 {
+					cfg = cfg.Clone()
+					cfg.NextProtos = []string{"h2", "http/1.1"}
+				}
+				return cfg, nil
+			}
+			return nil, errNoTLS
+		},
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Swaps in a new configuration.  Connections already established to peers are
+// kept; new timeouts and compression settings apply to the next RPC and new
+// TLS material to the next connection.
+func (t *HTTPTransporter) UpdateConfig(cfg Config) error {
+	if cfg.ResponseTimeout < 0 || cfg.DialTimeout < 0 || cfg.DualStackDelay < 0 || cfg.UnreachableTTL < 0 || cfg.RPCCeiling < 0 || cfg.VoteJitter < 0 {
+		return fmt.Errorf("Timeouts must not be negative")
+	}
+	if cfg.CompressionLevel < -2 || cfg.CompressionLevel > 9 {
+		return fmt.Errorf("Invalid compression level %d", cfg.CompressionLevel)
+	}
+	if cfg.CompressionThreshold < 0 {
+		return fmt.Errorf("Compression threshold must not be negative")
+	}
+	if cfg.Queue.MaxInFlight < 0 || cfg.Queue.Depth < 0 {
+		return fmt.Errorf("Queue bounds must not be negative")
+	}
+	if cfg.MaxRequestSize < 0 || cfg.MaxSnapshotSize < 0 {
+		return fmt.Errorf("Maximum request and snapshot sizes must not be negative")
+	}
+	if cfg.SlowPeers.Threshold < 0 || cfg.SlowPeers.Interval < 0 {
+		return fmt.Errorf("Slow peer policy must not be negative")
+	}
+	if cfg.Mirror.Depth < 0 {
+		return fmt.Errorf("Mirror depth must not be negative")
+	}
+	if q := cfg.SnapshotQuota; q.Window < 0 || q.MaxSent < 0 || q.MaxReceived < 0 || q.WarnFraction < 0 {
+		return fmt.Errorf("Snapshot quotas must not be negative")
+	}
+
+	cfg.TLS = cfg.TLS.Clone()
+	peerTLS := make(map[string]PeerTLS, len(cfg.PeerTLS))
+	for name, p := range cfg.PeerTLS {
+		peerTLS[name] = p
+	}
+	cfg.PeerTLS = peerTLS
+	limits := make(map[string]Limit, len(cfg.PeerLimits))
+	for name, limit := range cfg.PeerLimits {
+		limits[name] = limit
+	}
+	cfg.PeerLimits = limits
+	handlerLimits := make(map[string]HandlerLimit, len(cfg.HandlerLimits))
+	for rpc, limit := range cfg.HandlerLimits {
+		if limit.MaxConcurrent < 0 || limit.MaxQueued < 0 || limit.QueueTimeout < 0 {
+			return fmt.Errorf("Invalid handler limit for %s", rpc)
+		}
+		handlerLimits[rpc] = limit
+	}
+	cfg.HandlerLimits = handlerLimits
+	ids := make(map[string]bool, len(cfg.EncryptionKeys))
+	for _, key := range cfg.EncryptionKeys {
+		if key.ID == "" || ids[key.ID] {
+			return fmt.Errorf("Encryption keys need distinct, non-empty IDs")
+		}
+		ids[key.ID] = true
+	}
+	cfg.EncryptionKeys = append([]EncryptionKey(nil), cfg.EncryptionKeys...)
+	for _, w := range cfg.BulkWindows {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	cfg.BulkWindows = append([]TimeWindow(nil), cfg.BulkWindows...)
+
+	t.cfgMutex.Lock()
+	defer t.cfgMutex.Unlock()
+
+	old := t.config()
+	t.cfg.Store(&cfg)
+
+	t.SetGlobalLimit(cfg.GlobalLimit)
+	for name := range old.PeerLimits {
+		if _, ok := cfg.PeerLimits[name]; !ok {
+			t.SetPeerLimit(name, Limit{})
+		}
+	}
+	for name, limit := range cfg.PeerLimits {
+		t.SetPeerLimit(name, limit)
+	}
+	t.queues.configure(cfg.Queue)
+	t.quotas.configure(cfg.SnapshotQuota)
+
+	return nil
+}
+
+// Returns how long to wait for a latency-lane RPC.
+func (c *Config) responseTimeout(electionTimeout time.Duration) time.Duration {
+	if c.ResponseTimeout > 0 {
+		return c.ResponseTimeout
+	}
+	return electionTimeout
+}
+
+// Dials an encoded address with the current dial timeout, failing over to the
+// peer's other addresses if it has any.
+func (t *HTTPTransporter) dial(_, encoded string) (net.Conn, error) {
+	return t.addresses.dial(encoded, t.dialAddress)
+}
+
+func (t *HTTPTransporter) dialAddress(encoded string) (net.Conn, error) {
+	cfg := t.config()
+	dialer := &net.Dialer{
+		Timeout:         cfg.DialTimeout,
+		KeepAliveConfig: t.keepAlive,
+	}
+	if cfg.DualStackDelay > 0 {
+		if decoded := Decode(encoded); Network(decoded) == "tcp" {
+			debuglog.Debugf("Dialing %s", encoded)
+			return t.dualStack.dial(decoded, cfg.DualStackDelay, dialer)
+		}
+	}
+	return dialEncoded(encoded, dialer)
+}
+
+// Dials an encoded address and performs a TLS handshake with the current TLS
+// material and the settings of the peer named in ctx, if any.
+func (t *HTTPTransporter) dialTLS(ctx context.Context, network, encoded string) (net.Conn, error) {
+	current := t.config()
+	cfg := current.TLS
+	if cfg == nil {
+		return nil, errNoTLS
+	}
+
+	conn, err := t.dial(network, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	config := cfg.Clone()
+	if t.http2 && len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(encoded)
+		if err != nil {
+			host = encoded
+		}
+		config.ServerName = host
+	}
+	if p, ok := current.PeerTLS[peerNameFrom(ctx)]; ok {
+		p.apply(config)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Connection strings are http:// URLs; once TLS is configured they're
+// requested as https:// so the transport dials with dialTLS.
+type tlsUpgrader struct {
+	t    *HTTPTransporter
+	next http.RoundTripper
+}
+
+func (u *tlsUpgrader) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && u.t.config().TLS != nil {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "https"
+	}
+	return u.next.RoundTrip(req)
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Applications built on the transporter can carry RPCs of their own over it
+// with RegisterRPC and SendRPC, sharing its connections, compression,
+// encryption, cluster ID checks, handler limits, stats and watchdog rather
+// than running an HTTP client of their own.  A custom RPC is named by its
+// path without the leading slash, as in Stats and Config.HandlerLimits.
+
+// A Message is the request or response of a custom RPC.  Its encoding is up
+// to the application; the raft messages, which encode as protobufs, are
+// Messages too.
+type Message interface {
+	Encode(w io.Writer) (int, error)
+	Decode(r io.Reader) (int, error)
+}
+
+type customRPC struct {
+	path   string
+	newReq func() Message
+	handle func(server raft.Server, req Message) Message
+}
+
+// Registers a custom RPC served at path below the prefix.  newReq returns a
+// request to decode into, and handle answers it; a nil response fails the
+// RPC.  Routes are applied by Install, so RPCs must be registered before it
+// is called.  Registering a path twice panics.
+func (t *HTTPTransporter) RegisterRPC(path string, newReq func() Message, handle func(server raft.Server, req Message) Message) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, rpc := range t.customRPCs {
+		if rpc.path == path {
+			panic(fmt.Sprintf("transport: Duplicate registration: %s", path))
+		}
+	}
+	t.customRPCs = append(t.customRPCs, customRPC{path, newReq, handle})
+}
+
+// Sends a custom RPC to a peer, decoding the answer into resp.
+func (t *HTTPTransporter) SendRPC(server raft.Server, peer *raft.Peer, path string, req, resp Message) error {
+	return t.send(server, peer, customRPCName(path), latencyLane, joinPath(t.prefix, path), req, resp)
+}
+
+// Sends a custom RPC to the group on a peer.
+func (g *Group) SendRPC(server raft.Server, peer *raft.Peer, path string, req, resp Message) error {
+	return g.t.SendRPC(g.server(server), peer, path, req, resp)
+}
+
+func customRPCName(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+func (t *HTTPTransporter) registeredRPCs() []customRPC {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]customRPC(nil), t.customRPCs...)
+}
+
+// Handles incoming requests of a custom RPC.
+func (t *HTTPTransporter) customRPCHandler(server raft.Server, rpc customRPC) http.HandlerFunc {
+	return t.handle(server, customRPCName(rpc.path), rpc.path,
+		func() decoder { return rpc.newReq() },
+		func(req decoder) encoder {
+			resp := rpc.handle(server, req.(Message))
+			if resp == nil {
+				return nil
+			}
+			return resp
+		})
+}
@@ -0,0 +1,379 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A delta rebuilds a target from a base the receiver already holds, in the
+// style of rsync: the target is scanned with a rolling checksum for blocks
+// that also appear in the base, which are sent as copies, and everything else
+// is sent as literal inserts.  A delta is encoded as the target's size and
+// SHA-256 followed by a list of ops:
+//
+//   deltaCopy   offset (uint64) length (uint64)   bytes from the base
+//   deltaInsert data (bytes)                      bytes carried in the delta
+//   deltaEnd                                      end of the delta
+//
+// Bases, targets and deltas are files, read a window at a time, so diffing a
+// snapshot takes memory in proportion to its number of blocks, not its size.
+
+const deltaBlockSize = 4096
+
+// Targets are read, and inserts cut, in pieces of this size.
+const deltaWindowSize = 1 << 20
+
+const (
+	deltaEnd    uint64 = 0
+	deltaCopy   uint64 = 1
+	deltaInsert uint64 = 2
+)
+
+// How many recent snapshot recovery payloads a leader keeps to diff against.
+const maxSnapshotBases = 2
+
+var errDeltaMismatch = errors.New("Snapshot delta does not reproduce its target")
+
+// The leader keeps the payloads of its most recent snapshot recoveries on disk
+// so it can diff a new one against whichever a follower reports holding.
+type snapshotBases struct {
+	mu      sync.Mutex
+	entries []snapshotBase
+}
+
+type snapshotBase struct {
+	hash []byte
+	path string
+	size int64
+}
+
+// A window onto part of a file, moved along as reads pass it.
+type deltaWindow struct {
+	r     io.ReaderAt
+	size  int64
+	start int64
+	buf   []byte
+}
+
+// An Adler-32 style checksum over a window that can be slid one byte at a
+// time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+//------------------------------------------------------------------------------
+//
+// Diffing
+//
+//------------------------------------------------------------------------------
+
+// Writes a delta that rebuilds target, of targetSize bytes hashing to
+// targetHash, from base.
+func makeDelta(base io.ReaderAt, baseSize int64, target io.ReaderAt, targetSize int64, targetHash []byte, w io.Writer) error {
+	block := make([]byte, deltaBlockSize)
+	index := make(map[uint32][]int64)
+	for off := int64(0); off+deltaBlockSize <= baseSize; off += deltaBlockSize {
+		if _, err := base.ReadAt(block, off); err != nil && err != io.EOF {
+			return err
+		}
+		sum := newRollingSum(block).sum()
+		index[sum] = append(index[sum], off)
+	}
+
+	m := &messageWriter{w: w}
+	m.uint64(uint64(targetSize))
+	m.bytes(targetHash)
+
+	var copyOff, copyLen int64
+	flushCopy := func() {
+		if copyLen > 0 {
+			m.uint64(deltaCopy)
+			m.uint64(uint64(copyOff))
+			m.uint64(uint64(copyLen))
+			copyLen = 0
+		}
+	}
+
+	win := &deltaWindow{r: target, size: targetSize}
+	var literal, i int64
+	insert := func(end int64) error {
+		for literal < end {
+			n := end - literal
+			if n > deltaWindowSize {
+				n = deltaWindowSize
+			}
+			b, err := win.slice(literal, n)
+			if err != nil {
+				return err
+			}
+			flushCopy()
+			m.uint64(deltaInsert)
+			m.bytes(b)
+			literal += n
+		}
+		return nil
+	}
+
+	var r *rollingSum
+	if targetSize >= deltaBlockSize {
+		b, err := win.slice(0, deltaBlockSize)
+		if err != nil {
+			return err
+		}
+		r = newRollingSum(b)
+	}
+	for i+deltaBlockSize <= targetSize {
+		b, err := win.slice(i, deltaBlockSize)
+		if err != nil {
+			return err
+		}
+		off, ok, err := findBlock(index, r.sum(), base, b, block)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := insert(i); err != nil {
+				return err
+			}
+			if copyLen == 0 || copyOff+copyLen != off {
+				flushCopy()
+				copyOff = off
+			}
+			copyLen += deltaBlockSize
+
+			i += deltaBlockSize
+			literal = i
+			if i+deltaBlockSize <= targetSize {
+				if b, err = win.slice(i, deltaBlockSize); err != nil {
+					return err
+				}
+				r = newRollingSum(b)
+			}
+			continue
+		}
+
+		if i+deltaBlockSize < targetSize {
+			if b, err = win.slice(i, deltaBlockSize+1); err != nil {
+				return err
+			}
+			r.roll(b[0], b[deltaBlockSize])
+		}
+		i++
+	}
+
+	if err := insert(targetSize); err != nil {
+		return err
+	}
+	flushCopy()
+	m.uint64(deltaEnd)
+
+	_, err := m.result()
+	return err
+}
+
+// Rebuilds a target from base and a delta, writing it to w and checking it
+// against the target's size and hash.  If max is positive, a delta for a
+// target larger than max bytes is refused before anything is written, and
+// any delta is stopped as soon as it writes past the size it claimed.
+func applyDelta(base io.ReaderAt, baseSize int64, delta io.Reader, w io.Writer, max int64) error {
+	m := &messageReader{r: bufio.NewReader(delta)}
+	size := m.uint64()
+	hash := m.bytes()
+	if _, err := m.result(); err != nil {
+		return err
+	}
+	if max > 0 && size > uint64(max) {
+		return withKind(fmt.Errorf("Snapshot delta target of %d bytes exceeds %d", size, max), ErrRequestTooLarge)
+	}
+
+	h := sha256.New()
+	out := io.MultiWriter(w, h)
+	var written uint64
+	for {
+		switch op := m.uint64(); op {
+		case deltaEnd:
+			if _, err := m.result(); err != nil {
+				return err
+			}
+			if written != size || !bytes.Equal(h.Sum(nil), hash) {
+				return errDeltaMismatch
+			}
+			return nil
+		case deltaCopy:
+			off, length := m.uint64(), m.uint64()
+			if _, err := m.result(); err != nil {
+				return err
+			}
+			if off+length > uint64(baseSize) || off+length < off {
+				return fmt.Errorf("Snapshot delta copies past the end of its base")
+			}
+			if written+length > size || written+length < written {
+				return errDeltaMismatch
+			}
+			n, err := io.Copy(out, io.NewSectionReader(base, int64(off), int64(length)))
+			written += uint64(n)
+			if err != nil {
+				return err
+			}
+		case deltaInsert:
+			b := m.bytes()
+			if _, err := m.result(); err != nil {
+				return err
+			}
+			if written+uint64(len(b)) > size {
+				return errDeltaMismatch
+			}
+			if _, err := out.Write(b); err != nil {
+				return err
+			}
+			written += uint64(len(b))
+		default:
+			if _, err := m.result(); err != nil {
+				return err
+			}
+			return fmt.Errorf("Unknown snapshot delta op %d", op)
+		}
+	}
+}
+
+// Finds a block of the base matching want, reading candidates into buf.
+func findBlock(index map[uint32][]int64, sum uint32, base io.ReaderAt, want, buf []byte) (int64, bool, error) {
+	for _, off := range index[sum] {
+		if _, err := base.ReadAt(buf, off); err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		if bytes.Equal(buf, want) {
+			return off, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Returns n bytes of the file from off, which must lie within it.  The slice
+// is only valid until the next call.
+func (w *deltaWindow) slice(off, n int64) ([]byte, error) {
+	if off < w.start || off+n > w.start+int64(len(w.buf)) {
+		length := int64(deltaWindowSize)
+		if n > length {
+			length = n
+		}
+		if off+length > w.size {
+			length = w.size - off
+		}
+		if int64(cap(w.buf)) < length {
+			w.buf = make([]byte, length)
+		}
+		w.buf = w.buf[:length]
+		if _, err := w.r.ReadAt(w.buf, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		w.start = off
+	}
+	i := off - w.start
+	return w.buf[i : i+n], nil
+}
+
+func newRollingSum(window []byte) *rollingSum {
+	r := &rollingSum{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+// Slides the window one byte, dropping out and taking in.
+func (r *rollingSum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+//------------------------------------------------------------------------------
+//
+// Bases
+//
+//------------------------------------------------------------------------------
+
+// Opens the payload with the given hash, returning nil if it isn't kept.
+func (s *snapshotBases) open(hash []byte) (*os.File, int64) {
+	if len(hash) == 0 {
+		return nil, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if bytes.Equal(e.hash, hash) {
+			f, err := os.Open(e.path)
+			if err != nil {
+				return nil, 0
+			}
+			return f, e.size
+		}
+	}
+	return nil, 0
+}
+
+// Keeps the payload in the file at path, moving it into dir and evicting the
+// oldest beyond maxSnapshotBases.  Files in dir that aren't kept, as from an
+// earlier run, are removed.
+func (s *snapshotBases) add(hash []byte, path string, size int64, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if bytes.Equal(e.hash, hash) {
+			os.Remove(path)
+			return
+		}
+	}
+
+	kept := filepath.Join(dir, hex.EncodeToString(hash))
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = os.Rename(path, kept)
+	}
+	if err != nil {
+		debuglog.Debugln("transporter.ssr.base.error:", err)
+		os.Remove(path)
+		return
+	}
+
+	entries := []snapshotBase{{hash, kept, size}}
+	for _, e := range s.entries {
+		if len(entries) < maxSnapshotBases {
+			entries = append(entries, e)
+		} else {
+			os.Remove(e.path)
+		}
+	}
+	s.entries = entries
+
+	names, _ := ioutil.ReadDir(dir)
+	for _, info := range names {
+		name := filepath.Join(dir, info.Name())
+		held := false
+		for _, e := range entries {
+			held = held || e.path == name
+		}
+		if !held {
+			os.Remove(name)
+		}
+	}
+}
@@ -8,16 +8,20 @@ import (
 	"strings"
 )
 
-var unix *regexp.Regexp = regexp.MustCompile("^[/a-zA-Z0-9\\.]*$")
+var unix *regexp.Regexp = regexp.MustCompile("^[/a-zA-Z0-9\\._-]*$")
 
 func UnixDialer(_, encoded string) (net.Conn, error) {
+	return dialEncoded(encoded, &net.Dialer{})
+}
+
+func dialEncoded(encoded string, dialer *net.Dialer) (net.Conn, error) {
 	debuglog.Debugf("Dialing %s", encoded)
 	decoded := Decode(encoded)
-	return net.Dial(Network(decoded), decoded)
+	return dialer.Dial(Network(decoded), decoded)
 }
 
 func Network(addr string) string {
-	if addr[0] == '/' || addr[0] == '.' {
+	if addr[0] == '/' || addr[0] == '.' || addr[0] == '@' {
 		return "unix"
 	} else {
 		return "tcp"
@@ -25,33 +29,95 @@ func Network(addr string) string {
 }
 
 func Encode(addr string) (string, error) {
+	if isSRV(addr) {
+		return addr, nil
+	}
+
 	switch Network(addr) {
 	case "unix":
+		if isAbstract(addr) {
+			// Abstract socket names are encoded with a leading _ since an @
+			// would be taken as URL userinfo.
+			if !unix.MatchString(addr[1:]) {
+				return "", errors.New("Invalid abstract socket name " + addr + " (must contain only dots, slashes, dashes, underscores and alphanumeric characters)")
+			}
+			return "http://_" + escapeUnix(addr[1:]), nil
+		}
 		if !unix.MatchString(addr) {
-			return "", errors.New("Invalid address path " + addr + " (must contain only dots, slashes, and alphanumeric characters, due to the way we're hacking HTTP-over-Unix-sockets into Go)")
+			return "", errors.New("Invalid address path " + addr + " (must contain only dots, slashes, dashes, underscores and alphanumeric characters, due to the way we're hacking HTTP-over-Unix-sockets into Go)")
 		}
-		addr = strings.Replace(addr, "/", "-", -1)
+		addr = escapeUnix(addr)
 	case "tcp":
 		if addr[0] == '-' {
 			return "", errors.New("Invalid address " + addr + " (cannot begin with a -, due to the way we're hacking HTTP-over-Unix-sockets into Go)")
 		}
+		if strings.Count(addr, ":") > 1 {
+			// IPv6 literals must be bracketed to tell the port apart, and
+			// a zone's % escaped to be valid in a URL.
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || !isIPv6(host) {
+				return "", errors.New("Invalid address " + addr + " (IPv6 addresses must be written as [host]:port)")
+			}
+			addr = "[" + strings.Replace(host, "%", "%25", 1) + "]:" + port
+		}
 	}
 
 	return "http://" + addr, nil
 }
 
+// Turns a socket path into a hostname.  Slashes become dashes, so the dashes
+// and underscores in the path itself are escaped with an underscore.
+func escapeUnix(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		switch c {
+		case '/':
+			b.WriteByte('-')
+		case '-', '_':
+			b.WriteByte('_')
+			b.WriteRune(c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeUnix(host string) string {
+	var b strings.Builder
+	for i := 0; i < len(host); i++ {
+		switch {
+		case host[i] == '_' && i+1 < len(host):
+			i++
+			b.WriteByte(host[i])
+		case host[i] == '-':
+			b.WriteByte('/')
+		default:
+			b.WriteByte(host[i])
+		}
+	}
+	return b.String()
+}
+
 func Decode(addr string) string {
 	// Nuke the http:// if needed (may be removed by the HTTP
 	// library)
 	addr = strings.TrimPrefix(addr, "http://")
 
-	if addr[0] == '-' || addr[0] == '.' {
+	if addr[0] == '-' || addr[0] == '.' || addr[0] == '_' {
 		// Unix address
 		// Remove a port, if it's been added by the HTTP library
 		addr = strings.SplitN(addr, ":", 2)[0]
 
 		// Actually decode
-		addr = strings.Replace(addr, "-", "/", -1)
+		if addr[0] == '_' {
+			addr = "@" + unescapeUnix(addr[1:])
+		} else {
+			addr = unescapeUnix(addr)
+		}
+	} else if addr[0] == '[' {
+		// IPv6 literal, which may still have its zone escaped
+		addr = strings.Replace(addr, "%25", "%", 1)
 	}
 
 	return addr
@@ -0,0 +1,290 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Discovery maps peer names to connection strings, so that a peer keeps its
+// identity in the Raft configuration while the address it is reached at
+// changes.  The transporter asks it for the connection string of each peer
+// before every RPC and falls back to the one in the Raft configuration if it
+// doesn't know the peer or fails.
+type Discovery interface {
+	// Returns the connection string of the named peer, or "" if unknown.
+	Resolve(name string) (string, error)
+
+	// Registers fn to be called with the name of each peer whose connection
+	// string changes.
+	Watch(fn func(name string))
+}
+
+// Resolves peer names through d.  Connections to a peer whose address changes
+// are closed so the next RPC dials the new one.
+func WithDiscovery(d Discovery) Option {
+	return func(t *HTTPTransporter) {
+		t.discovery = d
+		d.Watch(t.peerMoved)
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Peer table
+//
+//------------------------------------------------------------------------------
+
+// A peerTable holds the names and connection strings a Discovery knows,
+// notifying watchers of changes.
+type peerTable struct {
+	mutex    sync.RWMutex
+	peers    map[string]string
+	watchers []func(string)
+}
+
+func (p *peerTable) Resolve(name string) (string, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.peers[name], nil
+}
+
+func (p *peerTable) Watch(fn func(name string)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.watchers = append(p.watchers, fn)
+}
+
+// Replaces the table, notifying watchers of every peer that changed.
+func (p *peerTable) update(peers map[string]string) {
+	p.mutex.Lock()
+	var changed []string
+	for name, cs := range peers {
+		if p.peers[name] != cs {
+			changed = append(changed, name)
+		}
+	}
+	for name := range p.peers {
+		if _, ok := peers[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	p.peers = peers
+	watchers := p.watchers
+	p.mutex.Unlock()
+
+	for _, name := range changed {
+		debuglog.Debugf("Discovered %s at %q", name, peers[name])
+		for _, fn := range watchers {
+			fn(name)
+		}
+	}
+}
+
+func (p *peerTable) copy() map[string]string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	peers := make(map[string]string, len(p.peers))
+	for name, cs := range p.peers {
+		peers[name] = cs
+	}
+	return peers
+}
+
+//------------------------------------------------------------------------------
+//
+// Static
+//
+//------------------------------------------------------------------------------
+
+// A StaticDiscovery serves a fixed table of peers, which can be replaced with
+// Set.
+type StaticDiscovery struct {
+	peerTable
+}
+
+func NewStaticDiscovery(peers map[string]string) *StaticDiscovery {
+	d := &StaticDiscovery{}
+	d.Set(peers)
+	return d
+}
+
+// Replaces the table of peers.
+func (d *StaticDiscovery) Set(peers map[string]string) {
+	copied := make(map[string]string, len(peers))
+	for name, cs := range peers {
+		copied[name] = cs
+	}
+	d.update(copied)
+}
+
+//------------------------------------------------------------------------------
+//
+// Polling
+//
+//------------------------------------------------------------------------------
+
+// A PollingDiscovery refreshes its table of peers from a source at an
+// interval.  NewFileDiscovery, NewMetadataDiscovery and NewDNSDiscovery
+// create them.
+type PollingDiscovery struct {
+	peerTable
+	fetch func(current map[string]string) (map[string]string, error)
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newPollingDiscovery(interval time.Duration, fetch func(map[string]string) (map[string]string, error)) (*PollingDiscovery, error) {
+	d := &PollingDiscovery{fetch: fetch, stop: make(chan struct{})}
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	go d.poll(interval)
+	return d, nil
+}
+
+// Fetches the table of peers now.  If the fetch fails the current table is
+// kept.
+func (d *PollingDiscovery) Refresh() error {
+	peers, err := d.fetch(d.copy())
+	if err != nil {
+		return err
+	}
+	d.update(peers)
+	return nil
+}
+
+// Stops refreshing.
+func (d *PollingDiscovery) Close() error {
+	d.once.Do(func() { close(d.stop) })
+	return nil
+}
+
+func (d *PollingDiscovery) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if err := d.Refresh(); err != nil {
+				debuglog.Debugln("discovery.refresh.error:", err)
+			}
+		}
+	}
+}
+
+// Reads peers from a JSON file mapping names to connection strings, rereading
+// it whenever its modification time changes.
+func NewFileDiscovery(path string, interval time.Duration) (*PollingDiscovery, error) {
+	var modified time.Time
+	return newPollingDiscovery(interval, func(current map[string]string) (map[string]string, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.ModTime().Equal(modified) {
+			return current, nil
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		peers := make(map[string]string)
+		if err := json.Unmarshal(b, &peers); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", path, err)
+		}
+		modified = info.ModTime()
+		return peers, nil
+	})
+}
+
+// Fetches peers from an HTTP endpoint returning a JSON object mapping names
+// to connection strings, such as a cloud provider's instance metadata or
+// tag service fronted by a small proxy, or a service registry.
+func NewMetadataDiscovery(url string, interval time.Duration) (*PollingDiscovery, error) {
+	client := &http.Client{Timeout: interval}
+	return newPollingDiscovery(interval, func(map[string]string) (map[string]string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if err := checkStatus(resp); err != nil {
+			return nil, err
+		}
+
+		peers := make(map[string]string)
+		if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+			return nil, fmt.Errorf("Could not parse peers from %s: %s", url, err)
+		}
+		return peers, nil
+	})
+}
+
+// Resolves each of the named peers by looking up <name>.<domain> and
+// connecting to the first address on port.  Lookups are repeated every
+// interval; a peer whose lookup fails keeps its last address.
+func NewDNSDiscovery(names []string, domain string, port int, interval time.Duration) (*PollingDiscovery, error) {
+	return newPollingDiscovery(interval, func(current map[string]string) (map[string]string, error) {
+		peers := make(map[string]string, len(names))
+		for _, name := range names {
+			addrs, err := net.LookupHost(name + "." + domain)
+			if err != nil || len(addrs) == 0 {
+				debuglog.Debugln("discovery.dns.error:", name, err)
+				if cs, ok := current[name]; ok {
+					peers[name] = cs
+				}
+				continue
+			}
+			peers[name] = "http://" + net.JoinHostPort(addrs[0], strconv.Itoa(port))
+		}
+		return peers, nil
+	})
+}
+
+//------------------------------------------------------------------------------
+//
+// Transporter
+//
+//------------------------------------------------------------------------------
+
+// Returns the connection string to reach a peer at.
+func (t *HTTPTransporter) connectionString(name, fallback string) string {
+	if t.discovery == nil {
+		return fallback
+	}
+	cs, err := t.discovery.Resolve(name)
+	if err != nil {
+		debuglog.Debugln("transporter.discovery.error:", name, err)
+	}
+	if cs == "" {
+		return fallback
+	}
+	return cs
+}
+
+// Drops connections that may lead to a peer's old address.
+func (t *HTTPTransporter) peerMoved(name string) {
+	t.closeIdleConnections()
+
+	t.ws.mu.Lock()
+	s := t.ws.sessions[name]
+	t.ws.mu.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"context"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A dualStackDialer dials hostnames that resolve to several addresses
+// happy-eyeballs style (RFC 8305): addresses are raced, alternating between
+// IPv6 and IPv4, with each attempt started a delay after the last unless it
+// has already failed.  The address that wins for a host is tried first on its
+// next dial, so a peer settles on whichever family reaches it fastest.
+type dualStackDialer struct {
+	mutex     sync.Mutex
+	preferred map[string]string
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dualStackResult struct {
+	conn net.Conn
+	ip   string
+	err  error
+}
+
+func newDualStackDialer() *dualStackDialer {
+	return &dualStackDialer{
+		preferred: make(map[string]string),
+		lookup:    net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+// Dials a host:port address, racing the host's addresses if it has several.
+func (d *dualStackDialer) dial(addr string, delay time.Duration, dialer *net.Dialer) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || isIPLiteral(host) {
+		return dialer.Dial("tcp", addr)
+	}
+
+	ctx := context.Background()
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := d.order(host, addrs)
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ips[0], port))
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	results := make(chan dualStackResult, len(ips))
+	attempt := func(ip string) {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		results <- dualStackResult{conn, ip, err}
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+
+	started, failed := 0, 0
+	var firstErr error
+	for {
+		select {
+		case <-next.C:
+			go attempt(ips[started])
+			started++
+			if started < len(ips) {
+				next.Reset(delay)
+			}
+		case r := <-results:
+			if r.err == nil {
+				debuglog.Debugf("Dialed %s at %s", addr, r.ip)
+				d.prefer(host, r.ip)
+				closeDualStackLosers(results, started-failed-1)
+				return r.conn, nil
+			}
+
+			failed++
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if failed == len(ips) {
+				return nil, firstErr
+			}
+			// Nothing is in flight, so don't wait out the delay.
+			if failed == started {
+				if !next.Stop() {
+					select {
+					case <-next.C:
+					default:
+					}
+				}
+				next.Reset(0)
+			}
+		}
+	}
+}
+
+// Orders a host's addresses for racing: the last winner first, then
+// alternating between families starting with the resolver's first choice.
+func (d *dualStackDialer) order(host string, addrs []net.IPAddr) []string {
+	var first, second []string
+	for _, addr := range addrs {
+		ip := addr.String()
+		if len(first) == 0 || isIPv6(ip) == isIPv6(first[0]) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+
+	d.mutex.Lock()
+	preferred := d.preferred[host]
+	d.mutex.Unlock()
+
+	for i, ip := range ips {
+		if ip == preferred {
+			copy(ips[1:i+1], ips[:i])
+			ips[0] = ip
+			break
+		}
+	}
+	return ips
+}
+
+func (d *dualStackDialer) prefer(host, ip string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.preferred[host] = ip
+}
+
+// Closes the connections of attempts still in flight when another won.
+func closeDualStackLosers(results chan dualStackResult, n int) {
+	go func() {
+		for i := 0; i < n; i++ {
+			if r := <-results; r.conn != nil {
+				r.conn.Close()
+			}
+		}
+	}()
+}
+
+func isIPLiteral(host string) bool {
+	return net.ParseIP(stripZone(host)) != nil
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(stripZone(ip))
+	return parsed != nil && parsed.To4() == nil
+}
+
+func stripZone(host string) string {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
@@ -0,0 +1,401 @@
+// Package dump decodes and pretty-prints the Raft messages passing through a
+// node's transport, for debugging a live cluster.  A Dumper wraps the node's
+// HTTP handler and its transporter's client; it costs nothing until a writer
+// is attached, and writers can come and go while the node runs.
+package dump
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/transport"
+	"github.com/metcalf/raft"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many formatted messages are buffered for each writer.  A writer that
+// falls further behind misses messages rather than holding up RPCs.
+const sinkBuffer = 256
+
+// How much of a message's JSON is printed.  Entries and snapshots can run to
+// megabytes.
+const maxMessageBytes = 4096
+
+// A Filter selects messages by RPC type (ae, rv, ss, ssr, tn, pv, ri,
+// ssr.manifest, ssr.chunk or ssr.commit) and by peer, matched as a substring
+// of the sender's name (from its X-Raft-Name header) on RPCs received and of
+// the peer's address on RPCs sent.  An empty list matches everything.
+type Filter struct {
+	RPCs  []string
+	Peers []string
+}
+
+// A Dumper fans decoded messages out to attached writers.
+type Dumper struct {
+	mutex sync.RWMutex
+	sinks map[*sink]bool
+}
+
+type sink struct {
+	filter  Filter
+	lines   chan []byte
+	dropped uint64
+}
+
+type decoder interface {
+	Decode(io.Reader) (int, error)
+}
+
+// The messages of an RPC, keyed by the end of its path.
+type message struct {
+	rpc  string
+	req  func() decoder
+	resp func() decoder
+}
+
+var messages = map[string]message{
+	"appendEntries": {"ae",
+		func() decoder { return &raft.AppendEntriesRequest{} },
+		func() decoder { return &raft.AppendEntriesResponse{} }},
+	"requestVote": {"rv",
+		func() decoder { return &raft.RequestVoteRequest{} },
+		func() decoder { return &raft.RequestVoteResponse{} }},
+	"snapshot": {"ss",
+		func() decoder { return &raft.SnapshotRequest{} },
+		func() decoder { return &raft.SnapshotResponse{} }},
+	"snapshotRecovery": {"ssr",
+		func() decoder { return &raft.SnapshotRecoveryRequest{} },
+		func() decoder { return &raft.SnapshotRecoveryResponse{} }},
+	"timeoutNow": {"tn",
+		func() decoder { return &transport.TimeoutNowRequest{} },
+		func() decoder { return &transport.TimeoutNowResponse{} }},
+	"preVote": {"pv",
+		func() decoder { return &transport.PreVoteRequest{} },
+		func() decoder { return &transport.PreVoteResponse{} }},
+	"readIndex": {"ri",
+		func() decoder { return &transport.ReadIndexRequest{} },
+		func() decoder { return &transport.ReadIndexResponse{} }},
+	"snapshotChunks/manifest": {"ssr.manifest",
+		func() decoder { return &transport.SnapshotManifest{} },
+		func() decoder { return &transport.SnapshotManifestResponse{} }},
+	"snapshotChunks/chunk": {"ssr.chunk",
+		func() decoder { return &transport.SnapshotChunk{} },
+		func() decoder { return &transport.SnapshotChunkResponse{} }},
+	"snapshotChunks/commit": {"ssr.commit",
+		func() decoder { return &transport.SnapshotManifest{} },
+		func() decoder { return &raft.SnapshotRecoveryResponse{} }},
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+func New() *Dumper {
+	return &Dumper{sinks: make(map[*sink]bool)}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Writes messages selected by filter to w until the returned function is
+// called.  Writes happen on their own goroutine.
+func (d *Dumper) Attach(w io.Writer, filter Filter) (detach func()) {
+	s := &sink{filter: filter, lines: make(chan []byte, sinkBuffer)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range s.lines {
+			w.Write(line)
+		}
+		if n := atomic.LoadUint64(&s.dropped); n > 0 {
+			fmt.Fprintf(w, "(%d messages dropped)\n", n)
+		}
+	}()
+
+	d.mutex.Lock()
+	d.sinks[s] = true
+	d.mutex.Unlock()
+
+	return func() {
+		d.mutex.Lock()
+		delete(d.sinks, s)
+		d.mutex.Unlock()
+		close(s.lines)
+		<-done
+	}
+}
+
+// Streams messages to an HTTP client until it disconnects.  The rpc and peer
+// query parameters, comma-separated, set the filter.
+func (d *Dumper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := Filter{
+		RPCs:  splitParam(r.URL.Query().Get("rpc")),
+		Peers: splitParam(r.URL.Query().Get("peer")),
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fw := &flushWriter{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		fw.f = f
+		f.Flush()
+	}
+
+	detach := d.Attach(fw, filter)
+	<-r.Context().Done()
+	detach()
+}
+
+// Wraps a node's handler to dump the requests it receives and the responses
+// it sends.
+func (d *Dumper) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, ok := lookup(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		peer := r.Header.Get("X-Raft-Name")
+		if peer == "" {
+			peer = r.RemoteAddr
+		}
+		if !d.wants(m.rpc, peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		d.emit(m, "request from", peer, r.Header, body, err, m.req)
+
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 || rec.status == http.StatusOK {
+			d.emit(m, "response to", peer, rec.Header(), rec.body.Bytes(), nil, m.resp)
+		} else {
+			d.emitStatus(m, "response to", peer, rec.status, rec.body.Bytes())
+		}
+	})
+}
+
+// Wraps a transporter's client to dump the requests it sends and the
+// responses it receives.
+func (d *Dumper) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		m, ok := lookup(req.URL.Path)
+		if !ok || !d.wants(m.rpc, req.URL.Host) {
+			return next.RoundTrip(req)
+		}
+
+		if req.Body != nil {
+			body, err := ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			// Reading the body to the end fills in a streamed request's
+			// trailer, so it is sent along unchanged.
+			req = req.Clone(req.Context())
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			d.emit(m, "request to", req.URL.Host, req.Header, body, nil, m.req)
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if resp.StatusCode == http.StatusOK {
+			d.emit(m, "response from", req.URL.Host, resp.Header, body, err, m.resp)
+		} else {
+			d.emitStatus(m, "response from", req.URL.Host, resp.StatusCode, body)
+		}
+		return resp, nil
+	})
+}
+
+// Reports whether any writer wants messages of an RPC to or from a peer.
+func (d *Dumper) wants(rpc, peer string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	for s := range d.sinks {
+		if s.filter.match(rpc, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dumper) emit(m message, direction, peer string, header http.Header, body []byte, err error, newMsg func() decoder) {
+	var text string
+	if err == nil {
+		text, err = decode(newMsg(), header, body)
+	}
+	if err != nil {
+		text = fmt.Sprintf("undecodable (%s): %q", err, truncate(body))
+	}
+	who := peer
+	if id := header.Get("X-Raft-Request-Id"); id != "" {
+		who += " " + id
+	}
+	d.write(m.rpc, peer, fmt.Sprintf("%s %s %s %s\n%s\n",
+		time.Now().Format(time.RFC3339Nano), m.rpc, direction, who, text))
+}
+
+func (d *Dumper) emitStatus(m message, direction, peer string, status int, body []byte) {
+	d.write(m.rpc, peer, fmt.Sprintf("%s %s %s %s\nstatus %d: %s\n",
+		time.Now().Format(time.RFC3339Nano), m.rpc, direction, peer,
+		status, strings.TrimSpace(string(truncate(body)))))
+}
+
+func (d *Dumper) write(rpc, peer, text string) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	line := []byte(text)
+	for s := range d.sinks {
+		if !s.filter.match(rpc, peer) {
+			continue
+		}
+		select {
+		case s.lines <- line:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+func (f *Filter) match(rpc, peer string) bool {
+	if len(f.RPCs) > 0 {
+		found := false
+		for _, r := range f.RPCs {
+			if r == rpc {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Peers) == 0 {
+		return true
+	}
+	for _, p := range f.Peers {
+		if strings.Contains(peer, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func lookup(path string) (message, bool) {
+	for suffix, m := range messages {
+		if strings.HasSuffix(path, "/"+suffix) {
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+// Decodes a body, gunzipping it first if need be, and formats the message as
+// indented JSON.
+func decode(msg decoder, header http.Header, body []byte) (string, error) {
+	var r io.Reader = bytes.NewReader(body)
+	if header.Get("Content-Encoding") == "gzip" {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		r = z
+	}
+
+	if _, err := msg.Decode(r); err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(truncate(b)), nil
+}
+
+func truncate(b []byte) []byte {
+	if len(b) <= maxMessageBytes {
+		return b
+	}
+	return []byte(fmt.Sprintf("%s... (%d more bytes)", b[:maxMessageBytes], len(b)-maxMessageBytes))
+}
+
+func splitParam(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// A recorder keeps a copy of the response a handler writes.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Retrieves the wrapped writer, so an http.ResponseController can reach its
+// deadlines and flushing.
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if w.f != nil {
+		w.f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// With Config.EncryptionKeys set, the bodies of Raft RPCs are sealed with
+// NaCl secretbox under a key shared by the cluster, so they stay confidential
+// and tamper-evident across TLS-terminating proxies and other hops outside
+// the transporter's control.  Each body is sealed with a fresh random nonce,
+// which is prepended to it, and names its key in the X-Raft-Key-Id header.
+// Bodies are compressed before sealing; since proxies mustn't try to
+// decompress ciphertext, the compression is named in X-Raft-Sealed-Encoding
+// instead of Content-Encoding.  The sealed plaintext starts with the
+// direction, the request's path and that encoding, all checked on opening, so
+// a captured body can't be replayed to another route, as a response, or with
+// its encoding header changed.  Proxies must therefore pass paths through
+// unchanged.
+//
+// Requests are sealed with the first key and may be opened with any of them,
+// and responses are sealed with the key of their request.  A key is rotated
+// by adding it second on every server, then moving it first on every server,
+// then removing the old key.  While keys are set, unsealed requests and
+// responses are refused, WebSocket upgrades and frames are refused, and RPCs
+// aren't sent over WebSocket sessions or streamed.  Join and leave requests
+// and forwarded commands are sealed too, as are forwarded commands' results.
+
+const (
+	keyIDHeader          = "X-Raft-Key-Id"
+	sealedEncodingHeader = "X-Raft-Sealed-Encoding"
+
+	nonceSize = 24
+)
+
+// A key used to seal RPC bodies, named by ID in each sealed body.
+type EncryptionKey struct {
+	ID  string
+	Key [32]byte
+}
+
+var ErrNotEncrypted = errors.New("Body is not encrypted")
+
+// Returned when a body was sealed for another route, direction or encoding.
+var ErrSealedContext = errors.New("Encrypted body was sealed for another request")
+
+// Returned when a body names a key that isn't configured.
+type UnknownKeyError struct {
+	ID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("Unknown encryption key %q", e.ID)
+}
+
+// Parses a key given as id:hex, where hex encodes 32 bytes.
+func ParseEncryptionKey(s string) (EncryptionKey, error) {
+	var key EncryptionKey
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return key, fmt.Errorf("Encryption key must be id:hex")
+	}
+	b, err := hex.DecodeString(s[i+1:])
+	if err != nil || len(b) != len(key.Key) {
+		return key, fmt.Errorf("Encryption key %s must be %d hex-encoded bytes", s[:i], len(key.Key))
+	}
+	key.ID = s[:i]
+	copy(key.Key[:], b)
+	return key, nil
+}
+
+// Returns the key to seal with, or nil if encryption is off.
+func (c *Config) sealKey() *EncryptionKey {
+	if len(c.EncryptionKeys) == 0 {
+		return nil
+	}
+	return &c.EncryptionKeys[0]
+}
+
+// Returns the key to seal the response to r with: the one r was sealed with,
+// if it is still configured.
+func (c *Config) responseKey(r *http.Request) *EncryptionKey {
+	if key := c.openKey(r.Header.Get(keyIDHeader)); key != nil {
+		return key
+	}
+	return c.sealKey()
+}
+
+func (c *Config) openKey(id string) *EncryptionKey {
+	for i := range c.EncryptionKeys {
+		if c.EncryptionKeys[i].ID == id {
+			return &c.EncryptionKeys[i]
+		}
+	}
+	return nil
+}
+
+// Describes what a sealed body is for: a request or response, the path of the
+// request, and the encoding named in X-Raft-Sealed-Encoding.
+func sealContext(direction, path, encoding string) string {
+	return direction + " " + path + " " + encoding
+}
+
+// Returns the path of a URL, or the whole string if it doesn't parse.
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Path
+}
+
+// Seals a buffer into a new pooled buffer, binding it to the given context.
+func sealBuffer(key *EncryptionKey, context string, b *bytes.Buffer) (*bytes.Buffer, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	plain := getBuffer()
+	defer putBuffer(plain)
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(context)))
+	plain.Write(n[:])
+	plain.WriteString(context)
+	plain.Write(b.Bytes())
+
+	sealed := getBuffer()
+	sealed.Write(nonce[:])
+	sealed.Write(secretbox.Seal(nil, plain.Bytes(), &nonce, &key.Key))
+	return sealed, nil
+}
+
+// Seals the body of a request outside the RPC path, such as a forwarded
+// command, in place.  Does nothing if encryption is off.
+func (c *Config) sealRequest(httpReq *http.Request, body []byte) error {
+	key := c.sealKey()
+	if key == nil {
+		return nil
+	}
+	sealed, err := sealBuffer(key, sealContext("request", httpReq.URL.Path, ""), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Body = newPooledBody(sealed)
+	httpReq.ContentLength = int64(sealed.Len())
+	httpReq.GetBody = nil
+	httpReq.Header.Set(keyIDHeader, key.ID)
+	return nil
+}
+
+// Opens a body sealed with the key named in header, checking it was sealed
+// for the given context.
+func (c *Config) open(header http.Header, body io.Reader, context string) ([]byte, error) {
+	id := header.Get(keyIDHeader)
+	if id == "" {
+		return nil, ErrNotEncrypted
+	}
+	key := c.openKey(id)
+	if key == nil {
+		return nil, &UnknownKeyError{id}
+	}
+
+	sealed, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("Encrypted body of %d bytes is too short", len(sealed))
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	plain, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, &key.Key)
+	if !ok {
+		return nil, fmt.Errorf("Could not decrypt body with key %q", id)
+	}
+	if len(plain) < 2 {
+		return nil, ErrSealedContext
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	if len(plain) < 2+n || string(plain[2:2+n]) != context {
+		return nil, ErrSealedContext
+	}
+	return plain[2+n:], nil
+}
+
+// Replaces a sealed request body with the plaintext, so it can be read as if
+// it had been sent in the clear.
+func (c *Config) openRequest(r *http.Request) error {
+	if c.sealKey() == nil {
+		return nil
+	}
+	context := sealContext("request", r.URL.Path, r.Header.Get(sealedEncodingHeader))
+	plain, err := c.open(r.Header, r.Body, context)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(plain))
+	r.Header.Set("Content-Encoding", r.Header.Get(sealedEncodingHeader))
+	return nil
+}
+
+// Replaces a sealed response body with the plaintext.
+func (c *Config) openResponse(httpResp *http.Response) error {
+	if c.sealKey() == nil {
+		return nil
+	}
+	context := sealContext("response", httpResp.Request.URL.Path, httpResp.Header.Get(sealedEncodingHeader))
+	plain, err := c.open(httpResp.Header, httpResp.Body, context)
+	httpResp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	body := io.Reader(bytes.NewReader(plain))
+	httpResp.ContentLength = int64(len(plain))
+	if httpResp.Header.Get(sealedEncodingHeader) == "gzip" {
+		if body, err = gzipReader(body); err != nil {
+			return err
+		}
+		httpResp.ContentLength = -1
+	}
+	httpResp.Body = ioutil.NopCloser(body)
+	return nil
+}
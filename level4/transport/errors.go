@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Failures of outgoing RPCs, and the rejections of incoming ones peers report
+// back, fall into a few kinds, each with a sentinel to test for with
+// errors.Is.  The errors actually returned carry details of their own (a
+// *RequestError, a *DecodeError, the *net.OpError of a failed dial, ...) and
+// can still be unpacked with errors.As.
+//
+//   - ErrPeerUnreachable: the peer couldn't be dialed, or recently couldn't
+//     and sends to it are failing fast.
+//   - ErrDecodeFailure: a request or response couldn't be decoded, or arrived
+//     corrupted or truncated.
+//   - ErrRequestTooLarge: the peer refused a request over its
+//     Config.MaxRequestSize, or a snapshot delta over its
+//     Config.MaxSnapshotSize.
+//   - ErrTermMismatch: the RPC's term no longer matches the server's.
+//   - ErrThrottled: the RPC was refused to limit load, by a send queue, a
+//     snapshot quota or a peer's handler limits.  It may succeed later.
+//
+// Peers name the kind of a rejection in the X-Raft-Error header, so it
+// survives the trip back as a *RequestError.
+
+const errorKindHeader = "X-Raft-Error"
+
+var (
+	ErrPeerUnreachable = errors.New("Peer unreachable")
+	ErrDecodeFailure   = errors.New("Could not decode message")
+	ErrRequestTooLarge = errors.New("Request too large")
+	ErrTermMismatch    = errors.New("Term mismatch")
+	ErrThrottled       = errors.New("Throttled")
+)
+
+// The names kinds travel under in the X-Raft-Error header.
+var errorKinds = []struct {
+	name string
+	err  error
+}{
+	{"unreachable", ErrPeerUnreachable},
+	{"decode", ErrDecodeFailure},
+	{"too-large", ErrRequestTooLarge},
+	{"term", ErrTermMismatch},
+	{"throttled", ErrThrottled},
+}
+
+// An error of one or more kinds, with its own message.
+type kindError struct {
+	msg   string
+	kinds []error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() []error {
+	return e.kinds
+}
+
+// Marks err as being of a kind, keeping its message and leaving it
+// unpackable with errors.As.
+func withKind(err error, kind error) error {
+	return &kindError{err.Error(), []error{kind, err}}
+}
+
+// Reports a message that couldn't be decoded.  It matches ErrDecodeFailure.
+type DecodeError struct {
+	RPC       string
+	Direction string // "request" or "response"
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Could not decode %s %s: %s", e.RPC, e.Direction, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecodeFailure
+}
+
+// Returns the name of err's kind, or "" if it is of none.
+func errorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.name
+		}
+	}
+	return ""
+}
+
+// Replies to a request with an error, naming its kind for the peer.
+func httpError(w http.ResponseWriter, err error, code int) {
+	if kind := errorKind(err); kind != "" {
+		w.Header().Set(errorKindHeader, kind)
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// Rejects a request whose body couldn't be read or decoded, with 413 if it
+// was cut off for exceeding Config.MaxRequestSize.
+func rejectRequest(w http.ResponseWriter, rpc string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, withKind(err, ErrRequestTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	httpError(w, &DecodeError{RPC: rpc, Direction: "request", Err: err}, http.StatusBadRequest)
+}
+
+// Returns the kind of an error response, from the header naming it or
+// failing that its status code.
+func responseKind(httpResp *http.Response) error {
+	name := httpResp.Header.Get(errorKindHeader)
+	for _, kind := range errorKinds {
+		if kind.name == name {
+			return kind.err
+		}
+	}
+	switch httpResp.StatusCode {
+	case http.StatusRequestEntityTooLarge:
+		return ErrRequestTooLarge
+	case http.StatusTooManyRequests:
+		return ErrThrottled
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Servers send their term in this header with every response.  With
+// Config.TermFencing, the transporter remembers the highest term each peer
+// has answered with and refuses responses carrying a lower one, which can
+// only come from a confused peer or traffic replayed after a network flap.
+// Such a response is logged, counted in RPCStats.Fenced and returned to the
+// server as a failed RPC, never as a response.  Peers that don't send the
+// header are never fenced.
+//
+// A peer whose storage is wiped legitimately restarts at a lower term, and
+// stays fenced until ResetTermFence is called for it.
+const termHeader = "X-Raft-Term"
+
+// Returned in place of a response whose term regressed.  It matches
+// ErrTermMismatch.
+var errTermRegressed error = &kindError{"Response term regressed", []error{ErrTermMismatch}}
+
+type termFences struct {
+	mutex sync.Mutex
+
+	// The highest term answered with by each peer, by group.
+	peers map[string]map[string]uint64
+}
+
+func newTermFences() *termFences {
+	return &termFences{peers: make(map[string]map[string]uint64)}
+}
+
+// Forgets the terms the named peer has answered with, so that responses from
+// it are accepted whatever their term.
+func (t *HTTPTransporter) ResetTermFence(name string) {
+	t.fences.mutex.Lock()
+	defer t.fences.mutex.Unlock()
+
+	delete(t.fences.peers, name)
+}
+
+// Checks the term of a response from a peer against the highest it has
+// answered with before, raising that if the response's is higher.  Groups are
+// separate Raft servers, each with its own term, so are fenced separately.  A
+// batch of heartbeats carries many groups' terms, so its responses are fenced
+// one by one as they are handed back instead.
+func (t *HTTPTransporter) checkTerm(server raft.Server, peer, rpc string, httpResp *http.Response) error {
+	if rpc == "hb" {
+		return nil
+	}
+	term, err := strconv.ParseUint(httpResp.Header.Get(termHeader), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return t.fenceTerm(groupOf(server), peer, rpc, term)
+}
+
+// Checks a term a peer answered a group's RPC in against the highest it has
+// answered the group with before.
+func (t *HTTPTransporter) fenceTerm(group, peer, rpc string, term uint64) error {
+	if !t.config().TermFencing {
+		return nil
+	}
+
+	t.fences.mutex.Lock()
+	terms, ok := t.fences.peers[peer]
+	if !ok {
+		terms = make(map[string]uint64)
+		t.fences.peers[peer] = terms
+	}
+	highest := terms[group]
+	if term >= highest {
+		terms[group] = term
+	}
+	t.fences.mutex.Unlock()
+
+	if term >= highest {
+		return nil
+	}
+	log.Printf("Refusing %s response from %s in term %d after term %d", rpc, peer, term, highest)
+	t.stats.fenced(rpc)
+	return errTermRegressed
+}
+
+// Records the term a response is sent in.
+func setTerm(header http.Header, term uint64) {
+	header.Set(termHeader, strconv.FormatUint(term, 10))
+}
@@ -0,0 +1,250 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	commandHeader = "X-Raft-Command"
+	leaderHeader  = "X-Raft-Leader"
+)
+
+// How long a Forwarder waits between attempts while leadership is unsettled.
+const forwardRetryInterval = 20 * time.Millisecond
+
+var forwardCommands = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+}{types: make(map[string]reflect.Type)}
+
+// Makes a command type available to the forward route.  Like
+// raft.RegisterCommand, it must be called on every node for each command that
+// may be forwarded.
+func RegisterCommand(cmd raft.Command) {
+	forwardCommands.Lock()
+	defer forwardCommands.Unlock()
+
+	forwardCommands.types[cmd.CommandName()] = reflect.TypeOf(cmd).Elem()
+}
+
+func newCommand(name string, r io.Reader) (raft.Command, error) {
+	forwardCommands.RLock()
+	typ, ok := forwardCommands.types[name]
+	forwardCommands.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unregistered command %s", name)
+	}
+
+	cmd := reflect.New(typ).Interface().(raft.Command)
+	if encoder, ok := cmd.(raft.CommandEncoder); ok {
+		if err := encoder.Decode(r); err != nil {
+			return nil, err
+		}
+	} else if err := json.NewDecoder(r).Decode(cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+func encodeCommand(cmd raft.Command, w io.Writer) error {
+	if encoder, ok := cmd.(raft.CommandEncoder); ok {
+		return encoder.Encode(w)
+	}
+	return json.NewEncoder(w).Encode(cmd)
+}
+
+// Returned by the forward route when the receiving server isn't the leader.
+type notLeaderError struct {
+	leader string
+}
+
+func (e *notLeaderError) Error() string {
+	if e.leader == "" {
+		return "Not the leader and no leader known"
+	}
+	return fmt.Sprintf("Not the leader; try %s", e.leader)
+}
+
+var errNoLeader = errors.New("No leader elected")
+
+// A Forwarder executes commands on the leader on behalf of a server that may
+// not be the leader itself.
+type Forwarder struct {
+	transporter *HTTPTransporter
+	server      raft.Server
+	group       string
+}
+
+func NewForwarder(t *HTTPTransporter, server raft.Server) *Forwarder {
+	return &Forwarder{transporter: t, server: server}
+}
+
+// Retrieves the Forward path.
+func (t *HTTPTransporter) ForwardPath() string {
+	return t.forwardPath
+}
+
+// Executes a command on the current leader and returns its result.  Commands
+// run locally if this server is the leader and are POSTed to the leader's
+// forward route otherwise.  If there is no leader yet, or the command reaches
+// a server that is no longer the leader, or the leader can't be dialed, the
+// leader is looked up again and the command resent until ctx expires.  Other
+// failures may have reached the leader, so they are returned rather than
+// risking applying the command twice.
+//
+// Results of forwarded commands are sent back as JSON, so they arrive as the
+// values encoding/json decodes into an interface{}, with numbers as
+// json.Number.
+func (f *Forwarder) ForwardToLeader(ctx context.Context, cmd raft.Command) (interface{}, error) {
+	for {
+		result, err := f.forwardOnce(ctx, cmd)
+		if !retryableForward(err) {
+			return result, err
+		}
+
+		debuglog.Debugf("Re-resolving leader to forward %s: %s", cmd.CommandName(), err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Could not forward %s: %w (last error: %s)",
+				cmd.CommandName(), ctx.Err(), err)
+		case <-time.After(forwardRetryInterval):
+		}
+	}
+}
+
+func (f *Forwarder) forwardOnce(ctx context.Context, cmd raft.Command) (interface{}, error) {
+	if f.server.State() == raft.Leader {
+		return f.server.Do(cmd)
+	}
+
+	name := f.server.Leader()
+	if name == "" {
+		return nil, errNoLeader
+	}
+	leader := f.server.Peers()[name]
+	if leader == nil {
+		return nil, &notLeaderError{leader: name}
+	}
+
+	var b bytes.Buffer
+	if err := encodeCommand(cmd, &b); err != nil {
+		return nil, err
+	}
+
+	url, err := f.transporter.peerURL(leader, f.transporter.groupPath(f.group, f.transporter.ForwardPath()))
+	if err != nil {
+		return nil, err
+	}
+	debugAction(f.server, leader, "POST", url)
+
+	httpReq, err := http.NewRequestWithContext(withPeerName(ctx, leader.Name), "POST", url, &b)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set(commandHeader, cmd.CommandName())
+	f.transporter.stampGroup(f.group, httpReq.Header)
+	cfg := f.transporter.config()
+	if err := cfg.sealRequest(httpReq, b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	httpResp, err := f.transporter.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode == http.StatusServiceUnavailable {
+		return nil, &notLeaderError{leader: httpResp.Header.Get(leaderHeader)}
+	}
+	if err := checkStatus(httpResp); err != nil {
+		return nil, err
+	}
+	if err := cfg.openResponse(httpResp); err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	decoder := json.NewDecoder(httpResp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Reports whether a forwarding error shows the command cannot have been
+// applied, so it is safe to send again.
+func retryableForward(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errNoLeader {
+		return true
+	}
+	if _, ok := err.(*notLeaderError); ok {
+		return true
+	}
+	return isDialError(err)
+}
+
+// Handles incoming Forward requests.
+func (t *HTTPTransporter) forwardHandler(server raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(commandHeader)
+		debuglog.DebugTagln("transporter.forward.recv", server.Name(), "RECV /forward", name)
+
+		if server.State() != raft.Leader {
+			w.Header().Set(leaderHeader, server.Leader())
+			http.Error(w, (&notLeaderError{leader: server.Leader()}).Error(),
+				http.StatusServiceUnavailable)
+			return
+		}
+
+		if err := t.config().openRequest(r); err != nil {
+			rejectRequest(w, "forward", err)
+			return
+		}
+		cmd, err := newCommand(name, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := server.Do(cmd)
+		if err == raft.NotLeaderError {
+			// Lost leadership while the command was pending.
+			w.Header().Set(leaderHeader, server.Leader())
+			http.Error(w, (&notLeaderError{leader: server.Leader()}).Error(),
+				http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(result); err != nil {
+			debuglog.Debugln("transporter.forward.encoding.error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		header := http.Header{"Content-Type": []string{"application/json"}}
+		t.writeResponse(w, r, "forward", header, b.Bytes())
+	}
+}
@@ -0,0 +1,273 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Several raft.Servers, one per Raft group, can share one transporter, mux
+// and listener.  Each group is given its own view of the transporter with
+// Group, which is handed to raft.NewServer in place of the transporter and
+// used to install the group's routes.  Requests name the group they are for
+// either in their path or in a header, as set by WithGroupMode.
+
+// Carries the group of a request in header mode.
+const groupHeader = "X-Raft-Group"
+
+// How requests name their group.
+type GroupMode int
+
+const (
+	// Routes for group g are served under <prefix>/<g>, e.g.
+	// /raft/g/appendEntries.
+	GroupByPath GroupMode = iota
+
+	// Every group shares the transporter's routes and requests carry their
+	// group in an X-Raft-Group header.
+	GroupByHeader
+)
+
+// Sets how requests name their group.  Defaults to GroupByPath.
+func WithGroupMode(mode GroupMode) Option {
+	return func(t *HTTPTransporter) {
+		t.groups.mode = mode
+	}
+}
+
+// A Group is the view of a transporter used by the raft.Server of one Raft
+// group.  It sends the server's RPCs to the same group on peers.
+type Group struct {
+	t  *HTTPTransporter
+	id string
+}
+
+var _ Transporter = (*Group)(nil)
+
+// The groups installed on a transporter in header mode, so each route is
+// registered with the mux once and demultiplexed by header.
+type groupRoutes struct {
+	mode     GroupMode
+	mutex    sync.RWMutex
+	handlers map[string]map[string]http.HandlerFunc
+	servers  map[string]raft.Server
+}
+
+// Marks the server of an outgoing RPC with its group.
+type groupServer struct {
+	raft.Server
+	group string
+}
+
+// Registers a group's routes in header mode.
+type groupMuxer struct {
+	t     *HTTPTransporter
+	group string
+	mux   HTTPMuxer
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Returns the view of the transporter for a group.  The empty group is the
+// transporter itself.
+func (t *HTTPTransporter) Group(id string) *Group {
+	return &Group{t: t, id: id}
+}
+
+func newGroupRoutes() *groupRoutes {
+	return &groupRoutes{
+		handlers: make(map[string]map[string]http.HandlerFunc),
+		servers:  make(map[string]raft.Server),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the group ID.
+func (g *Group) ID() string {
+	return g.id
+}
+
+// Retrieves the transporter the group belongs to.
+func (g *Group) Transporter() *HTTPTransporter {
+	return g.t
+}
+
+// Retrieves the group an outgoing RPC's server belongs to.
+func groupOf(server raft.Server) string {
+	if s, ok := server.(*groupServer); ok {
+		return s.group
+	}
+	return ""
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Applies the group's Raft routes to an HTTP router.  Every group on the
+// transporter must be installed on the same mux, and in header mode nothing
+// else may be installed on the transporter's own routes.  The first group
+// installed also installs the route for batched heartbeats.
+func (g *Group) Install(server raft.Server, mux HTTPMuxer) {
+	if g.t.groups.addServer(g.id, server) {
+		(&clusterMuxer{g.t, mux}).HandleFunc(g.t.HeartbeatsPath(), g.t.heartbeatsHandler(server))
+	}
+	if g.id != "" || g.t.groups.mode == GroupByHeader {
+		mux = &groupMuxer{g.t, g.id, mux}
+	}
+	g.t.install(server, mux, g.id)
+}
+
+// Executes commands on the group's leader on behalf of server.
+func (g *Group) NewForwarder(server raft.Server) *Forwarder {
+	return &Forwarder{transporter: g.t, server: server, group: g.id}
+}
+
+// Asks the group's server at connectionString to add a server to the group.
+func (g *Group) SendJoinRequest(connectionString string, cmd *raft.DefaultJoinCommand) error {
+	return g.t.sendMembership(connectionString, g.id, g.t.JoinPath(), cmd)
+}
+
+// Asks the group's server at connectionString to remove a server from the
+// group.
+func (g *Group) SendLeaveRequest(connectionString string, cmd *raft.DefaultLeaveCommand) error {
+	return g.t.sendMembership(connectionString, g.id, g.t.LeavePath(), cmd)
+}
+
+// Sends a RequestVote RPC to the group on a peer.
+func (g *Group) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	return g.t.SendVoteRequest(g.server(server), peer, req)
+}
+
+// Sends an AppendEntries RPC to the group on a peer.  With heartbeat
+// batching enabled, heartbeats are sent together with those of other groups
+// to the same peer.
+func (g *Group) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	if g.t.heartbeats != nil && len(req.Entries) == 0 {
+		done, ok := g.t.admitAppendEntries(g.server(server), peer)
+		if !ok {
+			return nil
+		}
+		defer done()
+		return g.t.heartbeats.send(server, peer, g.id, req)
+	}
+	return g.t.SendAppendEntriesRequest(g.server(server), peer, req)
+}
+
+// Sends a SnapshotRequest RPC to the group on a peer.
+func (g *Group) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	return g.t.SendSnapshotRequest(g.server(server), peer, req)
+}
+
+// Sends a SnapshotRecoveryRequest RPC to the group on a peer.
+func (g *Group) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	return g.t.SendSnapshotRecoveryRequest(g.server(server), peer, req)
+}
+
+// Sends a TimeoutNow RPC to the group on a peer.
+func (g *Group) SendTimeoutNowRequest(server raft.Server, peer *raft.Peer, req *TimeoutNowRequest) *TimeoutNowResponse {
+	return g.t.SendTimeoutNowRequest(g.server(server), peer, req)
+}
+
+// Sends a PreVote RPC to the group on a peer.
+func (g *Group) SendPreVoteRequest(server raft.Server, peer *raft.Peer, req *PreVoteRequest) *PreVoteResponse {
+	return g.t.SendPreVoteRequest(g.server(server), peer, req)
+}
+
+// Sends a ReadIndex RPC to the group on a peer.
+func (g *Group) SendReadIndexRequest(server raft.Server, peer *raft.Peer, req *ReadIndexRequest) *ReadIndexResponse {
+	return g.t.SendReadIndexRequest(g.server(server), peer, req)
+}
+
+func (g *Group) server(server raft.Server) raft.Server {
+	if g.id == "" {
+		return server
+	}
+	return &groupServer{server, g.id}
+}
+
+// Rewrites a route path to the group's path in path mode.
+func (t *HTTPTransporter) groupPath(group, thePath string) string {
+	if group == "" || t.groups.mode != GroupByPath {
+		return thePath
+	}
+	return joinPath(joinPath(t.prefix, url.PathEscape(group)), strings.TrimPrefix(thePath, t.prefix))
+}
+
+// Names the group of an outgoing request in header mode.
+func (t *HTTPTransporter) stampGroup(group string, h http.Header) {
+	if group != "" && t.groups.mode == GroupByHeader {
+		h.Set(groupHeader, group)
+	}
+}
+
+func (m *groupMuxer) HandleFunc(thePath string, handler func(http.ResponseWriter, *http.Request)) {
+	if m.t.groups.mode == GroupByPath {
+		m.mux.HandleFunc(m.t.groupPath(m.group, thePath), handler)
+		return
+	}
+	if m.t.groups.add(thePath, m.group, handler) {
+		m.mux.HandleFunc(thePath, m.t.groups.dispatch(thePath))
+	}
+}
+
+// Records the server of a group, reporting whether it is the first.
+func (r *groupRoutes) addServer(group string, server raft.Server) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.servers[group] = server
+	return len(r.servers) == 1
+}
+
+// Retrieves the server installed for a group.
+func (r *groupRoutes) server(group string) raft.Server {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.servers[group]
+}
+
+// Adds a group's handler for a route, reporting whether it is the first
+// handler for the route and so the route still needs registering.
+func (r *groupRoutes) add(thePath, group string, handler http.HandlerFunc) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	handlers, ok := r.handlers[thePath]
+	if !ok {
+		handlers = make(map[string]http.HandlerFunc)
+		r.handlers[thePath] = handlers
+	}
+	handlers[group] = handler
+	return !ok
+}
+
+// Passes requests for a route to the handler of the group they name.
+func (r *groupRoutes) dispatch(thePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		group := req.Header.Get(groupHeader)
+
+		r.mutex.RLock()
+		handler, ok := r.handlers[thePath][group]
+		r.mutex.RUnlock()
+		if !ok {
+			http.Error(w, "Unknown Raft group "+group, http.StatusNotFound)
+			return
+		}
+		handler(w, req)
+	}
+}
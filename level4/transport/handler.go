@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"net/http"
+	"strings"
+)
+
+// A MuxerFunc adapts a route registration function to HTTPMuxer, for routers
+// whose HandleFunc doesn't match it, such as gorilla/mux's, which returns the
+// new route:
+//
+//	t.Install(server, transport.MuxerFunc(func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+//		router.HandleFunc(pattern, handler)
+//	}))
+type MuxerFunc func(pattern string, handler func(http.ResponseWriter, *http.Request))
+
+func (f MuxerFunc) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	f(pattern, handler)
+}
+
+// Registers routes on a ServeMux with method patterns, so that requests with
+// the wrong method are answered 405 Method Not Allowed.
+type methodMuxer struct {
+	t   *HTTPTransporter
+	mux *http.ServeMux
+}
+
+// Returns an http.Handler serving the Raft routes for a server at their full
+// paths.  It can be mounted under the transporter's prefix on any router, or
+// served on a listener of its own, apart from the application's routes:
+//
+//	mux.Handle(t.Prefix()+"/", t.Handler(server))                // net/http
+//	router.PathPrefix(t.Prefix()).Handler(t.Handler(server))     // gorilla/mux
+//	r.Mount(t.Prefix(), t.Handler(server))                       // chi
+//	go http.Serve(internalListener, t.Handler(server))
+func (t *HTTPTransporter) Handler(server raft.Server) http.Handler {
+	mux := http.NewServeMux()
+	t.Install(server, t.MethodMuxer(mux))
+	return mux
+}
+
+// Returns an http.Handler serving the admin endpoints for a server, to mount
+// or serve as Handler's routes are.
+func (t *HTTPTransporter) AdminHandler(server raft.Server) http.Handler {
+	mux := http.NewServeMux()
+	t.InstallAdmin(server, t.MethodMuxer(mux))
+	return mux
+}
+
+// Returns an HTTPMuxer that registers routes on mux with method patterns,
+// such as "POST /raft/appendEntries", for ServeMuxes that route by method.
+func (t *HTTPTransporter) MethodMuxer(mux *http.ServeMux) HTTPMuxer {
+	return &methodMuxer{t, mux}
+}
+
+func (m *methodMuxer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.mux.HandleFunc(m.t.routeMethod(pattern)+" "+pattern, handler)
+}
+
+// Returns the method a route is requested with.  Routes are matched by their
+// path below the prefix, so a group's copy of a route in path mode matches
+// too.
+func (t *HTTPTransporter) routeMethod(pattern string) string {
+	gets := []string{
+		t.PingPath(),
+		t.WebSocketPath(),
+		t.AdminStatusPath(),
+		t.AdminPeersPath(),
+		t.AdminStatsPath(),
+		t.AdminTimingsPath(),
+		t.AdminInFlightPath(),
+		t.AdminMetricsPath(),
+		t.AdminDumpPath(),
+		t.AdminLogPath(),
+	}
+	for _, get := range gets {
+		if strings.HasSuffix(pattern, strings.TrimPrefix(get, t.prefix)) {
+			return http.MethodGet
+		}
+	}
+	return http.MethodPost
+}
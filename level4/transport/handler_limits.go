@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A HandlerLimit bounds the incoming requests of one RPC type handled at
+// once.  Requests beyond MaxConcurrent wait, up to MaxQueued of them for at
+// most QueueTimeout; the rest are answered with 429 Too Many Requests.
+type HandlerLimit struct {
+	// Requests handled at once.  Zero is unlimited.
+	MaxConcurrent int
+
+	// Requests waiting for a slot.
+	MaxQueued int
+
+	// How long a request waits for a slot.  Zero waits until the peer gives
+	// up on the request.
+	QueueTimeout time.Duration
+}
+
+type handlerGates struct {
+	mutex sync.Mutex
+	gates map[string]*handlerGate
+}
+
+// A handlerGate is a semaphore whose waiters are served in arrival order.
+// When a slot is released to a waiter it passes directly to it, so active
+// counts the waiter as soon as it is woken.
+type handlerGate struct {
+	mutex   sync.Mutex
+	active  int
+	waiting []chan struct{}
+}
+
+func newHandlerGates() *handlerGates {
+	return &handlerGates{gates: make(map[string]*handlerGate)}
+}
+
+func (g *handlerGates) get(rpc string) *handlerGate {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	gate, ok := g.gates[rpc]
+	if !ok {
+		gate = &handlerGate{}
+		g.gates[rpc] = gate
+	}
+	return gate
+}
+
+// Waits for a slot to handle an incoming request of the given RPC type,
+// returning a function to release it, or nil if there is no slot.
+func (t *HTTPTransporter) admit(ctx context.Context, rpc string) func() {
+	limit := t.config().HandlerLimits[rpc]
+	if limit.MaxConcurrent <= 0 {
+		return func() {}
+	}
+
+	gate := t.gates.get(rpc)
+	if !gate.acquire(ctx, limit) {
+		return nil
+	}
+	return func() { gate.release(t.config().HandlerLimits[rpc]) }
+}
+
+func (g *handlerGate) acquire(ctx context.Context, limit HandlerLimit) bool {
+	g.mutex.Lock()
+	if g.active < limit.MaxConcurrent && len(g.waiting) == 0 {
+		g.active++
+		g.mutex.Unlock()
+		return true
+	}
+	if len(g.waiting) >= limit.MaxQueued {
+		g.mutex.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	g.waiting = append(g.waiting, ready)
+	g.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if limit.QueueTimeout > 0 {
+		timer := time.NewTimer(limit.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ready:
+		return true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	g.mutex.Lock()
+	for i, ch := range g.waiting {
+		if ch == ready {
+			g.waiting = append(g.waiting[:i], g.waiting[i+1:]...)
+			g.mutex.Unlock()
+			return false
+		}
+	}
+	g.mutex.Unlock()
+
+	// The slot was handed over as we gave up; pass it on.
+	g.release(limit)
+	return false
+}
+
+func (g *handlerGate) release(limit HandlerLimit) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// If the limit has been lowered, let the slot lapse instead.
+	if len(g.waiting) > 0 && (limit.MaxConcurrent <= 0 || g.active <= limit.MaxConcurrent) {
+		close(g.waiting[0])
+		g.waiting = g.waiting[1:]
+		return
+	}
+	g.active--
+}
+
+// A limitMuxer installs handlers that are subject to the handler limit of
+// their RPC type.
+type limitMuxer struct {
+	t    *HTTPTransporter
+	mux  HTTPMuxer
+	rpcs map[string]string
+}
+
+func (m *limitMuxer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	rpc, ok := m.rpcs[pattern]
+	if !ok {
+		m.mux.HandleFunc(pattern, handler)
+		return
+	}
+
+	m.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		release := m.t.admit(r.Context(), rpc)
+		if release == nil {
+			w.Header().Set("Retry-After", "1")
+			httpError(w, withKind(errors.New("Too many concurrent "+rpc+" requests"), ErrThrottled), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		handler(w, r)
+	})
+}
+
+// Maps the paths of the transporter's routes to the RPC types their limits
+// are configured under.
+func (t *HTTPTransporter) handlerRPCs() map[string]string {
+	rpcs := map[string]string{
+		t.AppendEntriesPath():    "ae",
+		t.CommitUpdatePath():     "cu",
+		t.RequestVotePath():      "rv",
+		t.SnapshotPath():         "ss",
+		t.SnapshotRecoveryPath(): "ssr",
+		t.SnapshotManifestPath(): "ssr.manifest",
+		t.SnapshotChunkPath():    "ssr.chunk",
+		t.SnapshotCommitPath():   "ssr.commit",
+		t.TimeoutNowPath():       "tn",
+		t.PreVotePath():          "pv",
+		t.ReadIndexPath():        "ri",
+		t.ForwardPath():          "forward",
+		t.JoinPath():             "join",
+		t.LeavePath():            "leave",
+	}
+	for _, rpc := range t.registeredRPCs() {
+		rpcs[joinPath(t.prefix, rpc.path)] = customRPCName(rpc.path)
+	}
+	return rpcs
+}
@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"bytes"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// With many Raft groups on each server, every leader heartbeats each of its
+// followers separately, so a pair of servers can exchange hundreds of
+// near-empty AppendEntries a heartbeat interval.  Heartbeat batching holds
+// each group's heartbeat for a short window and sends those bound for the
+// same peer together, as one request to the heartbeats route.
+//
+// The batch is only an envelope.  Its response isn't sequenced or fenced as a
+// whole; each group's response is checked as it is handed back, against that
+// group's own sequence of AppendEntries to the peer and its own term.
+
+// Batches the heartbeats groups send to the same peer, holding each for up to
+// window.  The window adds directly to heartbeat latency, so keep it a small
+// fraction of the heartbeat interval.  Every peer must be serving groups
+// installed with Group.Install, which handles the batches.
+func WithHeartbeatBatching(window time.Duration) Option {
+	return func(t *HTTPTransporter) {
+		t.heartbeats = &heartbeatBatcher{
+			t:       t,
+			window:  window,
+			pending: make(map[string]*heartbeatBatch),
+		}
+	}
+}
+
+type heartbeatBatcher struct {
+	t       *HTTPTransporter
+	window  time.Duration
+	mutex   sync.Mutex
+	pending map[string]*heartbeatBatch
+}
+
+// The heartbeats waiting to be sent to one peer.
+type heartbeatBatch struct {
+	server raft.Server
+	peer   *raft.Peer
+	groups []string
+	reqs   []*raft.AppendEntriesRequest
+	resps  []chan *raft.AppendEntriesResponse
+
+	// The server, sequence number and term of each group's heartbeat.
+	servers []raft.Server
+	seqs    []uint64
+	terms   []uint64
+}
+
+// The request and response bodies of the heartbeats route: a count followed
+// by each group and its encoded AppendEntries message.  Responses are flagged
+// as missing for groups the peer doesn't serve.
+type heartbeatRequest struct {
+	groups []string
+	reqs   []*raft.AppendEntriesRequest
+}
+
+type heartbeatResponse struct {
+	resps []*raft.AppendEntriesResponse
+}
+
+// Retrieves the Heartbeats path.
+func (t *HTTPTransporter) HeartbeatsPath() string {
+	return t.heartbeatsPath
+}
+
+// Adds a group's heartbeat to the batch for its peer and waits for the
+// batch's response.
+func (b *heartbeatBatcher) send(server raft.Server, peer *raft.Peer, group string, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	ch := make(chan *raft.AppendEntriesResponse, 1)
+	seq, term := b.t.sequences.start(group, peer.Name, "ae"), server.Term()
+
+	b.mutex.Lock()
+	batch, ok := b.pending[peer.ConnectionString]
+	if !ok {
+		batch = &heartbeatBatch{server: server, peer: peer}
+		b.pending[peer.ConnectionString] = batch
+		time.AfterFunc(b.window, func() { b.flush(peer.ConnectionString) })
+	}
+	batch.groups = append(batch.groups, group)
+	batch.reqs = append(batch.reqs, req)
+	batch.resps = append(batch.resps, ch)
+	batch.servers = append(batch.servers, server)
+	batch.seqs = append(batch.seqs, seq)
+	batch.terms = append(batch.terms, term)
+	b.mutex.Unlock()
+
+	return <-ch
+}
+
+// Sends the batch for a peer and hands each group its response.
+func (b *heartbeatBatcher) flush(key string) {
+	b.mutex.Lock()
+	batch := b.pending[key]
+	delete(b.pending, key)
+	b.mutex.Unlock()
+
+	req := &heartbeatRequest{batch.groups, batch.reqs}
+	resp := &heartbeatResponse{}
+	if err := b.t.send(batch.server, batch.peer, "hb", latencyLane, b.t.HeartbeatsPath(), req, resp); err != nil {
+		resp.resps = nil
+	}
+	for i, ch := range batch.resps {
+		if i < len(resp.resps) && b.check(batch, i, resp.resps[i]) {
+			ch <- resp.resps[i]
+		} else {
+			ch <- nil
+		}
+	}
+}
+
+// Checks a group's response from a batch as send would a separate
+// AppendEntries: that it is the latest of the group's to the peer, that the
+// group's term hasn't changed, and that the peer's term for the group hasn't
+// regressed.
+func (b *heartbeatBatcher) check(batch *heartbeatBatch, i int, resp *raft.AppendEntriesResponse) bool {
+	if resp == nil {
+		return false
+	}
+	group, peer := batch.groups[i], batch.peer.Name
+	if batch.servers[i].Term() != batch.terms[i] {
+		debuglog.Debugln("transporter.hb.stale.error:", peer, group)
+		b.t.stats.stale("hb")
+		return false
+	}
+	if !b.t.sequences.answer(group, peer, "ae", batch.seqs[i]) {
+		debuglog.Debugln("transporter.hb.stale.error:", peer, group)
+		b.t.stats.stale("hb")
+		return false
+	}
+	return b.t.fenceTerm(group, peer, "hb", resp.Term) == nil
+}
+
+// Handles incoming batches of heartbeats, passing each to its group's server
+// concurrently.
+func (t *HTTPTransporter) heartbeatsHandler(server raft.Server) http.HandlerFunc {
+	return t.handle(server, "hb", "/heartbeats",
+		func() decoder { return &heartbeatRequest{} },
+		func(req decoder) encoder {
+			r := req.(*heartbeatRequest)
+			resp := &heartbeatResponse{resps: make([]*raft.AppendEntriesResponse, len(r.reqs))}
+
+			var wg sync.WaitGroup
+			for i := range r.reqs {
+				s := t.groups.server(r.groups[i])
+				if s == nil {
+					debuglog.Debugln("transporter.hb.group.error:", r.groups[i])
+					continue
+				}
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					resp.resps[i] = s.AppendEntries(r.reqs[i])
+				}(i)
+			}
+			wg.Wait()
+
+			return resp
+		})
+}
+
+func (req *heartbeatRequest) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(uint64(len(req.reqs)))
+	for i, r := range req.reqs {
+		var b bytes.Buffer
+		if _, err := r.Encode(&b); err != nil {
+			return m.n, err
+		}
+		m.string(req.groups[i])
+		m.bytes(b.Bytes())
+	}
+	return m.result()
+}
+
+func (req *heartbeatRequest) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	n := m.count(8)
+	for i := uint64(0); i < n && m.err == nil; i++ {
+		group := m.string()
+		b := m.bytes()
+		if m.err != nil {
+			break
+		}
+		ae := &raft.AppendEntriesRequest{}
+		if _, err := ae.Decode(bytes.NewReader(b)); err != nil {
+			return m.n, err
+		}
+		req.groups = append(req.groups, group)
+		req.reqs = append(req.reqs, ae)
+	}
+	return m.result()
+}
+
+func (resp *heartbeatResponse) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(uint64(len(resp.resps)))
+	for _, r := range resp.resps {
+		var b bytes.Buffer
+		if r != nil {
+			if _, err := r.Encode(&b); err != nil {
+				return m.n, err
+			}
+		}
+		m.bool(r != nil)
+		m.bytes(b.Bytes())
+	}
+	return m.result()
+}
+
+func (resp *heartbeatResponse) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	n := m.count(5)
+	for i := uint64(0); i < n && m.err == nil; i++ {
+		ok := m.bool()
+		b := m.bytes()
+		if m.err != nil || !ok {
+			resp.resps = append(resp.resps, nil)
+			continue
+		}
+		ae := &raft.AppendEntriesResponse{}
+		if _, err := ae.Decode(bytes.NewReader(b)); err != nil {
+			return m.n, err
+		}
+		resp.resps = append(resp.resps, ae)
+	}
+	return m.result()
+}
@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"time"
+)
+
+// Sends a RequestVote, sending a duplicate on a fresh connection if the peer
+// is slow to answer.  Both carry the same request ID, so a peer that receives
+// both only votes once.
+func (t *HTTPTransporter) sendHedgedVote(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	results := make(chan *raft.RequestVoteResponse, 2)
+	attempt := func(l lane) {
+		resp := &raft.RequestVoteResponse{}
+		if err := t.send(server, peer, "rv", l, t.RequestVotePath(), req, resp); err != nil {
+			resp = nil
+		}
+		results <- resp
+	}
+
+	go attempt(latencyLane)
+
+	delay := time.Duration(float64(server.ElectionTimeout()) * t.VoteHedgeFraction)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case resp := <-results:
+		return resp
+	case <-timer.C:
+	}
+
+	debuglog.Debugf("No vote from %s after %s, hedging", peer.Name, delay)
+	go attempt(hedgeLane)
+
+	if resp := <-results; resp != nil {
+		return resp
+	}
+	return <-results
+}
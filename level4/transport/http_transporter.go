@@ -2,13 +2,21 @@ package transport
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"github.com/metcalf/ctf3/level4/debuglog"
 	"github.com/metcalf/raft"
+	"github.com/quic-go/quic-go/http3"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Parts from this transporter were heavily influenced by Peter Bougon's
@@ -26,17 +34,139 @@ type HTTPTransporter struct {
 	DisableKeepAlives    bool
 	prefix               string
 	appendEntriesPath    string
+	commitUpdatePath     string
 	requestVotePath      string
 	snapshotPath         string
 	snapshotRecoveryPath string
+	pingPath             string
+	timeoutNowPath       string
+	preVotePath          string
+	readIndexPath        string
+	forwardPath          string
+	memberJoinPath       string
+	memberLeavePath      string
+	adminPath            string
+	webSocketPath        string
+	heartbeatsPath       string
 	httpClient           http.Client
 	Transport            *http.Transport
+	bulkClient           http.Client
+	BulkTransport        *http.Transport
+	hedgeClient          http.Client
+	hedgeTransport       *http.Transport
+	throttle             *throttle
+	capture              *payloadCapture
+	srv                  *srvResolver
+	stats                *transportStats
+	ws                   *wsPool
+	quic                 *http3.Transport
+	snapshotChunksPath   string
+	mutex                sync.Mutex
+	noChunks             map[string]bool
+	noCommitUpdates      map[string]bool
+	customRPCs           []customRPC
+	commitUpdates        bool
+	bases                snapshotBases
+	requestIDs           *requestIDs
+	processed            *processedRequests
+	cfg                  atomic.Value
+	cfgMutex             sync.Mutex
+	dualStack            *dualStackDialer
+	queues               *sendQueues
+	addresses            *addressBook
+	gates                *handlerGates
+	middleware           []func(http.RoundTripper) http.RoundTripper
+	keepAlive            net.KeepAliveConfig
+	http2                bool
+	groups               *groupRoutes
+	heartbeats           *heartbeatBatcher
+	quotas               *snapshotQuotas
+	sequences            *sequences
+	discovery            Discovery
+	unreachable          *unreachablePeers
+	spacing              *peerSpacing
+	bulkPaused           int32
+	compression          *compressionRatios
+	fences               *termFences
+	mirror               *trafficMirror
+	watchdog             *watchdog
+	peerInfos            *peerInfos
+	jitter               *voteJitter
+	stop                 chan struct{}
+	stopOnce             sync.Once
+
+	// Treat an io.EOF from decoding a response as success and skip checking
+	// the status code and Content-Length, as older versions did.  This lets
+	// truncated responses through as zero-valued messages.
+	LegacyEOF bool
+
+	// Encode requests straight into the request body as it is sent rather
+	// than into a buffer first, so large AppendEntries batches and snapshots
+	// are never held in memory twice.  Streamed requests are sent chunked.
+	StreamRequests bool
+
+	// Multiplex AppendEntries, RequestVote and the snapshot RPCs over one
+	// persistent WebSocket per peer.  Peers that refuse the upgrade are sent
+	// plain HTTP requests instead.  The WebSocket route is only installed
+	// when this is set before Install, so every peer must opt in to accept
+	// sessions.
+	WebSocket bool
+
+	// If positive, a RequestVote that hasn't been answered within this
+	// fraction of the election timeout is sent again on a fresh connection,
+	// and whichever response arrives first is used.
+	VoteHedgeFraction float64
 }
 
 type HTTPMuxer interface {
 	HandleFunc(string, func(http.ResponseWriter, *http.Request))
 }
 
+// Outgoing RPCs travel on one of two lanes, each with its own connection pool:
+// AppendEntries and RequestVote use the latency lane (Transport) while
+// snapshots use the bulk lane (BulkTransport).  A large snapshot body can then
+// never hold up a heartbeat queued behind it on a shared keep-alive connection.
+type lane int
+
+const (
+	latencyLane lane = iota
+	bulkLane
+
+	// Hedged vote requests use a lane that never reuses connections, so the
+	// duplicate can't end up queued behind the original.
+	hedgeLane
+)
+
+// The raft request and response messages all encode to and decode from
+// protobufs with these methods.
+type encoder interface {
+	Encode(w io.Writer) (int, error)
+}
+
+type decoder interface {
+	Decode(r io.Reader) (int, error)
+}
+
+// Reports whether a response is missing, including a nil pointer of the
+// response's type, as a stopped server returns.
+func noResponse(resp encoder) bool {
+	if resp == nil {
+		return true
+	}
+	v := reflect.ValueOf(resp)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// Messages with fields carried in HTTP headers rather than the body implement
+// these, and send and handle copy those fields across.
+type headerWriter interface {
+	writeHeader(h http.Header)
+}
+
+type headerReader interface {
+	readHeader(h http.Header)
+}
+
 //------------------------------------------------------------------------------
 //
 // Constructor
@@ -44,19 +174,60 @@ type HTTPMuxer interface {
 //------------------------------------------------------------------------------
 
 // Creates a new HTTP transporter with the given path prefix.
-func NewHTTPTransporter(prefix string) *HTTPTransporter {
+func NewHTTPTransporter(prefix string, options ...Option) *HTTPTransporter {
 	t := &HTTPTransporter{
-		DisableKeepAlives:    false,
-		prefix:               prefix,
-		appendEntriesPath:    joinPath(prefix, "/appendEntries"),
-		requestVotePath:      joinPath(prefix, "/requestVote"),
-		snapshotPath:         joinPath(prefix, "/snapshot"),
-		snapshotRecoveryPath: joinPath(prefix, "/snapshotRecovery"),
-		Transport: &http.Transport{
-			Dial: UnixDialer,
-		},
-	}
-	t.httpClient.Transport = t.Transport
+		DisableKeepAlives: false,
+		prefix:            prefix,
+		noChunks:          make(map[string]bool),
+		noCommitUpdates:   make(map[string]bool),
+		requestIDs:        newRequestIDs(),
+		processed:         newProcessedRequests(),
+		Transport:         &http.Transport{},
+		BulkTransport:     &http.Transport{},
+		hedgeTransport:    &http.Transport{DisableKeepAlives: true},
+		throttle:          newThrottle(),
+		capture:           &payloadCapture{config: DefaultCaptureConfig},
+		stats:             newTransportStats(),
+		ws:                newWSPool(),
+		dualStack:         newDualStackDialer(),
+		queues:            newSendQueues(),
+		addresses:         newAddressBook(),
+		gates:             newHandlerGates(),
+		groups:            newGroupRoutes(),
+		quotas:            newSnapshotQuotas(),
+		sequences:         newSequences(),
+		unreachable:       newUnreachablePeers(),
+		spacing:           newPeerSpacing(),
+		compression:       newCompressionRatios(),
+		fences:            newTermFences(),
+		mirror:            newTrafficMirror(),
+		watchdog:          newWatchdog(),
+		peerInfos:         newPeerInfos(),
+		jitter:            newVoteJitter(),
+		stop:              make(chan struct{}),
+	}
+	t.setPaths(DefaultPaths)
+	t.cfg.Store(&Config{})
+	for _, transport := range t.transports() {
+		transport.Dial = t.dial
+		transport.DialTLSContext = t.dialTLS
+		transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+		transport.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	t.httpClient.Transport = &clusterRoundTripper{t, &tlsUpgrader{t, t.Transport}}
+	t.bulkClient.Transport = &clusterRoundTripper{t, &tlsUpgrader{t, t.BulkTransport}}
+	t.hedgeClient.Transport = &clusterRoundTripper{t, &tlsUpgrader{t, t.hedgeTransport}}
+	t.ws.dialer.NetDial = t.dial
+	t.ws.dialer.NetDialTLSContext = t.dialTLS
+	t.srv = newSRVResolver(t.closeIdleConnections)
+	for _, option := range options {
+		option(t)
+	}
+	for i := len(t.middleware) - 1; i >= 0; i-- {
+		t.httpClient.Transport = t.middleware[i](t.httpClient.Transport)
+		t.bulkClient.Transport = t.middleware[i](t.bulkClient.Transport)
+		t.hedgeClient.Transport = t.middleware[i](t.hedgeClient.Transport)
+	}
 	return t
 }
 
@@ -66,6 +237,11 @@ func NewHTTPTransporter(prefix string) *HTTPTransporter {
 //
 //------------------------------------------------------------------------------
 
+// Retrieves the HTTP transports of the latency, bulk and hedge lanes.
+func (t *HTTPTransporter) transports() []*http.Transport {
+	return []*http.Transport{t.Transport, t.BulkTransport, t.hedgeTransport}
+}
+
 // Retrieves the path prefix used by the transporter.
 func (t *HTTPTransporter) Prefix() string {
 	return t.prefix
@@ -91,6 +267,22 @@ func (t *HTTPTransporter) SnapshotRecoveryPath() string {
 	return t.snapshotRecoveryPath
 }
 
+// Limits outbound traffic to all peers combined.
+func (t *HTTPTransporter) SetGlobalLimit(limit Limit) {
+	t.throttle.setGlobal(limit)
+}
+
+// Limits outbound traffic to a single peer, identified by name.  Both this and
+// the global limit apply.
+func (t *HTTPTransporter) SetPeerLimit(name string, limit Limit) {
+	t.throttle.setPeer(name, limit)
+}
+
+// Configures capture of payloads that fail to decode.
+func (t *HTTPTransporter) SetCaptureConfig(config CaptureConfig) {
+	t.capture.configure(config)
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -101,12 +293,59 @@ func (t *HTTPTransporter) SnapshotRecoveryPath() string {
 // Installation
 //--------------------------------------
 
-// Applies Raft routes to an HTTP router for a given server.
+// Prepares an HTTP server to serve the transporter's routes.  With WithHTTP2
+// it accepts h2c alongside HTTP/1.1, so peers not using HTTP/2 can still
+// connect.
+func (t *HTTPTransporter) ConfigureServer(srv *http.Server) {
+	if t.http2 {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+
+// Applies Raft routes to an HTTP router for a given server.  Routes for
+// optional RPCs are only applied if the server implements them, and the
+// WebSocket route only if WebSocket mode is enabled.  If a cluster ID is
+// configured, requests from peers without the same one are rejected.
 func (t *HTTPTransporter) Install(server raft.Server, mux HTTPMuxer) {
-	mux.HandleFunc(t.AppendEntriesPath(), t.appendEntriesHandler(server))
+	t.install(server, mux, "")
+}
+
+func (t *HTTPTransporter) install(server raft.Server, mux HTTPMuxer, group string) {
+	mux = &limitMuxer{t, &clusterMuxer{t, mux}, t.handlerRPCs()}
+
+	mux.HandleFunc(t.AppendEntriesPath(), t.mirrored("ae", t.appendEntriesHandler(server)))
+	mux.HandleFunc(t.CommitUpdatePath(), t.mirrored("cu", t.commitUpdateHandler(server)))
 	mux.HandleFunc(t.RequestVotePath(), t.requestVoteHandler(server))
-	mux.HandleFunc(t.SnapshotPath(), t.snapshotHandler(server))
-	mux.HandleFunc(t.SnapshotRecoveryPath(), t.snapshotRecoveryHandler(server))
+	mux.HandleFunc(t.SnapshotPath(), t.mirrored("ss", t.snapshotHandler(server)))
+	mux.HandleFunc(t.SnapshotRecoveryPath(), t.mirrored("ssr", t.snapshotRecoveryHandler(server)))
+	mux.HandleFunc(t.PingPath(), t.pingHandler(server))
+	mux.HandleFunc(t.ForwardPath(), t.forwardHandler(server))
+	mux.HandleFunc(t.JoinPath(), t.joinHandler(server, group))
+	mux.HandleFunc(t.LeavePath(), t.leaveHandler(server, group))
+	if t.WebSocket {
+		mux.HandleFunc(t.WebSocketPath(), t.webSocketHandler(server))
+	}
+
+	store := newChunkStore(server)
+	mux.HandleFunc(t.SnapshotManifestPath(), t.snapshotManifestHandler(server, store))
+	mux.HandleFunc(t.SnapshotChunkPath(), t.snapshotChunkHandler(server, store))
+	mux.HandleFunc(t.SnapshotCommitPath(), t.snapshotCommitHandler(server, store))
+
+	if tn, ok := server.(TimeoutNowServer); ok {
+		mux.HandleFunc(t.TimeoutNowPath(), t.timeoutNowHandler(server, tn))
+	}
+	if pv, ok := server.(PreVoteServer); ok {
+		mux.HandleFunc(t.PreVotePath(), t.preVoteHandler(server, pv))
+	}
+	if ri, ok := server.(ReadIndexServer); ok {
+		mux.HandleFunc(t.ReadIndexPath(), t.readIndexHandler(server, ri))
+	}
+	for _, rpc := range t.registeredRPCs() {
+		mux.HandleFunc(joinPath(t.prefix, rpc.path), t.customRPCHandler(server, rpc))
+	}
 }
 
 //--------------------------------------
@@ -114,64 +353,74 @@ func (t *HTTPTransporter) Install(server raft.Server, mux HTTPMuxer) {
 //--------------------------------------
 
 func debugAction(server raft.Server, peer *raft.Peer, method string, url string) {
-	debuglog.Debugln(server.Name(), "->", peer.Name, "POST", url)
+	debuglog.DebugTagln("transporter.send", server.Name(), "->", peer.Name, method, url)
 }
 
 // Sends an AppendEntries RPC to a peer.
 func (t *HTTPTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
-	var b bytes.Buffer
-	if _, err := req.Encode(&b); err != nil {
-		debuglog.Debugln("transporter.ae.encoding.error:", err)
+	done, ok := t.admitAppendEntries(server, peer)
+	if !ok {
 		return nil
 	}
+	defer done()
 
-	url := joinPath(peer.ConnectionString, t.AppendEntriesPath())
-	debugAction(server, peer, "POST", url)
-
-	t.Transport.ResponseHeaderTimeout = server.ElectionTimeout()
-	httpResp, err := t.httpClient.Post(url, "application/protobuf", &b)
-	if httpResp == nil || err != nil {
-		debuglog.Debugln("transporter.ae.response.error:", err)
-		return nil
+	if t.commitUpdates && len(req.Entries) == 0 && !t.commitUpdatesRefused(peer) {
+		if resp, ok := t.sendCommitUpdate(server, peer, req); ok {
+			return resp
+		}
 	}
-	defer httpResp.Body.Close()
 
 	resp := &raft.AppendEntriesResponse{}
-	if _, err = resp.Decode(httpResp.Body); err != nil && err != io.EOF {
-		debuglog.Debugln("transporter.ae.decoding.error:", err)
+	if err := t.send(server, peer, "ae", latencyLane, t.AppendEntriesPath(), req, resp); err != nil {
 		return nil
 	}
-
 	return resp
 }
 
 // Sends a RequestVote RPC to a peer.
 func (t *HTTPTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
-	var b bytes.Buffer
-	if _, err := req.Encode(&b); err != nil {
-		debuglog.Debugln("transporter.rv.encoding.error:", err)
+	if !t.jitterVote(server, peer, req) {
 		return nil
 	}
-
-	url := fmt.Sprintf("%s%s", peer.ConnectionString, t.RequestVotePath())
-	debugAction(server, peer, "POST", url)
-
-	httpResp, err := t.httpClient.Post(url, "application/protobuf", &b)
-	if httpResp == nil || err != nil {
-		debuglog.Debugln("transporter.rv.response.error:", err)
-		return nil
+	if t.VoteHedgeFraction > 0 {
+		return t.sendHedgedVote(server, peer, req)
 	}
-	defer httpResp.Body.Close()
 
 	resp := &raft.RequestVoteResponse{}
-	if _, err = resp.Decode(httpResp.Body); err != nil && err != io.EOF {
-		debuglog.Debugln("transporter.rv.decoding.error:", err)
+	if err := t.send(server, peer, "rv", latencyLane, t.RequestVotePath(), req, resp); err != nil {
 		return nil
 	}
-
 	return resp
 }
 
+// Stops the transporter's background work: the watchdog, traffic mirroring
+// and probes of unreachable peers.  Idle connections are closed; RPCs already
+// in flight are left to finish.
+func (t *HTTPTransporter) Close() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	t.closeIdleConnections()
+	return nil
+}
+
+// Closes idle connections to every peer.
+func (t *HTTPTransporter) closeIdleConnections() {
+	t.Transport.CloseIdleConnections()
+	t.BulkTransport.CloseIdleConnections()
+	if t.quic != nil {
+		t.quic.CloseIdleConnections()
+	}
+}
+
+// Builds the URL of a path on a peer, resolving dns+srv connection strings
+// and noting any alternative addresses.
+func (t *HTTPTransporter) peerURL(peer *raft.Peer, thePath string) (string, error) {
+	base, err := t.addresses.resolve(t.connectionString(peer.Name, peer.ConnectionString), t.srv)
+	if err != nil {
+		return "", err
+	}
+	return joinPath(base, thePath), nil
+}
+
 func joinPath(connectionString, thePath string) string {
 	u, err := url.Parse(connectionString)
 	if err != nil {
@@ -183,56 +432,292 @@ func joinPath(connectionString, thePath string) string {
 
 // Sends a SnapshotRequest RPC to a peer.
 func (t *HTTPTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
-	var b bytes.Buffer
-	if _, err := req.Encode(&b); err != nil {
-		debuglog.Debugln("transporter.rv.encoding.error:", err)
+	resp := &raft.SnapshotResponse{}
+	if err := t.send(server, peer, "ss", bulkLane, t.SnapshotPath(), req, resp); err != nil {
 		return nil
 	}
+	return resp
+}
 
-	url := joinPath(peer.ConnectionString, t.snapshotPath)
-	debugAction(server, peer, "POST", url)
-
-	httpResp, err := t.httpClient.Post(url, "application/protobuf", &b)
-	if httpResp == nil || err != nil {
-		debuglog.Debugln("transporter.rv.response.error:", err)
-		return nil
+// Sends a SnapshotRecoveryRequest RPC to a peer.
+func (t *HTTPTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	if !t.chunksRefused(peer) {
+		resp, err := t.sendSnapshotChunks(server, peer, req)
+		if err == nil {
+			return resp
+		}
+		if rerr, ok := err.(*RequestError); !ok || rerr.StatusCode != http.StatusNotFound {
+			return nil
+		}
+		debuglog.Debugf("%s does not accept snapshot chunks, sending whole", peer.Name)
+		t.refuseChunks(peer)
 	}
-	defer httpResp.Body.Close()
 
-	resp := &raft.SnapshotResponse{}
-	if _, err = resp.Decode(httpResp.Body); err != nil && err != io.EOF {
-		debuglog.Debugln("transporter.rv.decoding.error:", err)
+	resp := &raft.SnapshotRecoveryResponse{}
+	if err := t.send(server, peer, "ssr", bulkLane, t.SnapshotRecoveryPath(), req, resp); err != nil {
 		return nil
 	}
-
 	return resp
 }
 
-// Sends a SnapshotRequest RPC to a peer.
-func (t *HTTPTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
-	var b bytes.Buffer
-	if _, err := req.Encode(&b); err != nil {
-		debuglog.Debugln("transporter.rv.encoding.error:", err)
-		return nil
+// Encodes a request, POSTs it to the given path on a peer over the given lane
+// and decodes the response.  The rpc name keys the debug log lines.
+func (t *HTTPTransporter) send(server raft.Server, peer *raft.Peer, rpc string, l lane, thePath string, req encoder, resp decoder) (err error) {
+	var counter *sentCounter
+	var received int64
+	var roundTrip time.Duration
+	start := t.stats.start(peer.Name)
+	defer func() {
+		t.stats.sent(rpc, err)
+		t.stats.finish(peer.Name, start, err, counter.count(), received, roundTrip)
+		if onError := t.config().OnSendError; err != nil && onError != nil {
+			onError(peer.Name, rpc, err)
+		}
+	}()
+
+	if err := t.unreachable.check(peer.Name); err != nil {
+		debuglog.Debugln("transporter."+rpc+".unreachable.error:", peer.Name)
+		return err
+	}
+	if l == bulkLane && !t.BulkTransfersAllowed() {
+		debuglog.Debugln("transporter."+rpc+".paused.error:", peer.Name)
+		return ErrBulkPaused
+	}
+	ctx, cancel := context.WithCancel(withPeerName(context.Background(), peer.Name))
+	defer cancel()
+	defer t.track("outgoing", rpc, peer.Name, cancel)()
+	defer func() {
+		if t.unreachable.record(peer, err, t.config().UnreachableTTL) {
+			go t.probeUnreachable(peer.Name)
+		}
+		if isDialError(err) {
+			err = withKind(err, ErrPeerUnreachable)
+		}
+	}()
+
+	release, err := t.queues.acquire(peer.Name, l, rpc)
+	if err != nil {
+		debuglog.Debugln("transporter."+rpc+".queue.error:", err)
+		return err
+	}
+	defer release()
+
+	group := groupOf(server)
+	var seq uint64
+	if sequencedRPCs[rpc] {
+		var term uint64
+		seq, term = t.sequences.start(group, peer.Name, rpc), server.Term()
+		defer func() {
+			if err == nil {
+				err = t.checkFresh(server, group, peer.Name, rpc, seq, term)
+			}
+		}()
+	}
+
+	url, err := t.peerURL(peer, t.groupPath(group, thePath))
+	if err != nil {
+		debuglog.Debugln("transporter."+rpc+".resolve.error:", err)
+		return err
+	}
+	id := t.requestIDs.idFor(peer.Name, req)
+	debugAction(server, peer, "POST", url+" "+id)
+
+	t.throttle.waitRPC(peer.Name)
+
+	cfg := t.config()
+	key := cfg.sealKey()
+
+	if rpcType, ok := wsRPCs[rpc]; ok && t.WebSocket && l != hedgeLane && group == "" && key == nil {
+		if s := t.wsSession(server, peer); s != nil {
+			called := time.Now()
+			if err := s.call(rpcType, req, resp); err != nil {
+				return err
+			}
+			if latencyRPCs[rpc] {
+				roundTrip = time.Since(called)
+			}
+			return nil
+		}
+	}
+
+	var body io.ReadCloser
+	var trailer http.Header
+	var sum string
+	var compress bool
+	length := int64(-1)
+	if t.StreamRequests && key == nil {
+		compress = t.compression.compress(rpc, -1, cfg)
+		body, trailer = streamBody(rpc, req, cfg, compress, t.compression)
+	} else {
+		encodeStart := time.Now()
+		b := getBuffer()
+		if _, err := req.Encode(b); err != nil {
+			debuglog.Debugln("transporter."+rpc+".encoding.error:", err)
+			putBuffer(b)
+			return err
+		}
+		sum = checksum(b.Bytes())
+		compress = t.compression.compress(rpc, b.Len(), cfg)
+		if compress {
+			z, err := gzipBuffer(b, cfg.compressionLevel())
+			raw := b.Len()
+			putBuffer(b)
+			if err != nil {
+				debuglog.Debugln("transporter."+rpc+".compression.error:", err)
+				return err
+			}
+			t.compression.observe(rpc, int64(raw), int64(z.Len()), cfg)
+			b = z
+		}
+		if key != nil {
+			encoding := ""
+			if compress {
+				encoding = "gzip"
+			}
+			sealed, err := sealBuffer(key, sealContext("request", urlPath(url), encoding), b)
+			putBuffer(b)
+			if err != nil {
+				debuglog.Debugln("transporter."+rpc+".encryption.error:", err)
+				return err
+			}
+			b = sealed
+		}
+		length = int64(b.Len())
+		body = newPooledBody(b)
+		t.stats.observe(rpc, phaseEncode, time.Since(encodeStart))
+	}
+	var r io.Reader = body
+	if l == bulkLane {
+		r = t.throttle.reader(peer.Name, body)
+	}
+	counter = &sentCounter{r: r}
+	body = &readCloser{counter, body}
+
+	if isSnapshotRPC(rpc) {
+		if err := t.quotas.reserveSend(peer.Name, length); err != nil {
+			debuglog.Debugln("transporter."+rpc+".quota.error:", err)
+			body.Close()
+			return err
+		}
+		defer func() { t.quotas.sent(peer.Name, counter.count()) }()
 	}
 
-	url := joinPath(peer.ConnectionString, t.snapshotRecoveryPath)
-	debugAction(server, peer, "POST", url)
+	// Latency-lane RPCs are bounded as a whole.  Bulk transfers aren't,
+	// since a snapshot commit is applied before its response is written.
+	if l != bulkLane {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, cfg.responseTimeout(server.ElectionTimeout()))
+		defer cancelTimeout()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		debuglog.Debugln("transporter."+rpc+".request.error:", err)
+		body.Close()
+		return err
+	}
+	httpReq.ContentLength = length
+	httpReq.Header.Set("Content-Type", "application/protobuf")
+	if key != nil {
+		httpReq.Header.Set(keyIDHeader, key.ID)
+		if compress {
+			httpReq.Header.Set(sealedEncodingHeader, "gzip")
+		}
+	} else if compress {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	if trailer != nil {
+		httpReq.Trailer = trailer
+	} else {
+		httpReq.Header.Set(checksumHeader, sum)
+	}
+	httpReq.Header.Set(requestIDHeader, id)
+	httpReq.Header.Set(nameHeader, server.Name())
+	if seq != 0 {
+		httpReq.Header.Set(sequenceHeader, formatSequence(seq))
+	}
+	t.stampGroup(group, httpReq.Header)
+	if hw, ok := req.(headerWriter); ok {
+		hw.writeHeader(httpReq.Header)
+	}
+
+	client := &t.httpClient
+	switch l {
+	case bulkLane:
+		client = &t.bulkClient
+	case hedgeLane:
+		client = &t.hedgeClient
+	}
 
-	httpResp, err := t.httpClient.Post(url, "application/protobuf", &b)
+	posted := time.Now()
+	httpResp, err := client.Do(httpReq)
 	if httpResp == nil || err != nil {
-		debuglog.Debugln("transporter.rv.response.error:", err)
-		return nil
+		debuglog.Debugln("transporter."+rpc+".response.error:", err)
+		t.srv.invalidate(t.connectionString(peer.Name, peer.ConnectionString))
+		return err
 	}
 	defer httpResp.Body.Close()
+	t.stats.observePost(rpc, time.Since(posted), httpResp)
+
+	if !t.LegacyEOF {
+		if err := checkStatus(httpResp); err != nil {
+			debuglog.Debugln("transporter."+rpc+".status.error:", err)
+			if cerr := checksumRejected(rpc, httpResp); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	if err := t.checkTerm(server, peer.Name, rpc, httpResp); err != nil {
+		return err
+	}
+	t.recordMetadata(peer.Name, httpResp.Header)
+	if err := cfg.openResponse(httpResp); err != nil {
+		debuglog.Debugln("transporter."+rpc+".decryption.error:", err)
+		return err
+	}
 
-	resp := &raft.SnapshotRecoveryResponse{}
-	if _, err = resp.Decode(httpResp.Body); err != nil && err != io.EOF {
-		debuglog.Debugln("transporter.rv.decoding.error:", err)
-		return nil
+	respBody := io.Reader(httpResp.Body)
+	captured := t.capture.buffer()
+	if captured != nil {
+		respBody = io.TeeReader(respBody, captured)
 	}
 
-	return resp
+	summed := newChecksumReader(respBody)
+	counted := &countingReader{r: summed}
+	if hr, ok := resp.(headerReader); ok {
+		hr.readHeader(httpResp.Header)
+	}
+	decodeStart := time.Now()
+	_, err = resp.Decode(counted)
+	if t.LegacyEOF {
+		if err == io.EOF {
+			err = nil
+		}
+	} else {
+		err = validateResponse(rpc, httpResp, counted.n, err)
+	}
+	if err == nil {
+		err = summed.verify(rpc, "response", httpResp.Header.Get(checksumHeader))
+	} else if !t.LegacyEOF {
+		// A body that arrived whole but didn't decode may be corrupted
+		// rather than truncated.
+		io.Copy(ioutil.Discard, counted)
+		if httpResp.ContentLength < 0 || counted.n >= httpResp.ContentLength {
+			err = corrupted(summed, rpc, "response", httpResp.Header.Get(checksumHeader), err)
+		}
+	}
+	received = counted.n
+	if err != nil {
+		debuglog.Debugln("transporter."+rpc+".decoding.error:", err)
+		t.capture.record(rpc, "response", peer.Name, captured, err)
+		return err
+	}
+	t.stats.observe(rpc, phaseDecode, time.Since(decodeStart))
+	if latencyRPCs[rpc] {
+		roundTrip = time.Since(posted)
+	}
+
+	return nil
 }
 
 //--------------------------------------
@@ -241,76 +726,181 @@ func (t *HTTPTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *
 
 // Handles incoming AppendEntries requests.
 func (t *HTTPTransporter) appendEntriesHandler(server raft.Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		debuglog.Debugln(server.Name(), "RECV /appendEntries")
-
-		req := &raft.AppendEntriesRequest{}
-		if _, err := req.Decode(r.Body); err != nil {
-			http.Error(w, "", http.StatusBadRequest)
-			return
-		}
-
-		resp := server.AppendEntries(req)
-		if _, err := resp.Encode(w); err != nil {
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		}
-	}
+	return t.handle(server, "ae", "/appendEntries",
+		func() decoder { return appendEntriesPool.Get().(*raft.AppendEntriesRequest) },
+		func(req decoder) encoder {
+			defer releaseAppendEntries(req.(*raft.AppendEntriesRequest))
+			return server.AppendEntries(req.(*raft.AppendEntriesRequest))
+		})
 }
 
 // Handles incoming RequestVote requests.
 func (t *HTTPTransporter) requestVoteHandler(server raft.Server) http.HandlerFunc {
+	return t.handle(server, "rv", "/requestVote",
+		func() decoder { return requestVotePool.Get().(*raft.RequestVoteRequest) },
+		func(req decoder) encoder {
+			defer requestVotePool.Put(req)
+			return server.RequestVote(req.(*raft.RequestVoteRequest))
+		})
+}
+
+// Handles incoming Snapshot requests.
+func (t *HTTPTransporter) snapshotHandler(server raft.Server) http.HandlerFunc {
+	return t.handle(server, "ss", "/snapshot",
+		func() decoder { return snapshotRequestPool.Get().(*raft.SnapshotRequest) },
+		func(req decoder) encoder {
+			defer snapshotRequestPool.Put(req)
+			return server.RequestSnapshot(req.(*raft.SnapshotRequest))
+		})
+}
+
+// Handles incoming SnapshotRecovery requests.
+func (t *HTTPTransporter) snapshotRecoveryHandler(server raft.Server) http.HandlerFunc {
+	return t.handle(server, "ssr", "/snapshotRecovery",
+		func() decoder { return &raft.SnapshotRecoveryRequest{} },
+		func(req decoder) encoder {
+			return server.SnapshotRecoveryRequest(req.(*raft.SnapshotRecoveryRequest))
+		})
+}
+
+// Builds a handler that decodes a request created by newReq, passes it to
+// call and encodes the response.  A request repeating the ID of one already
+// processed is answered with the earlier response.
+func (t *HTTPTransporter) handle(server raft.Server, rpc string, name string, newReq func() decoder, call func(decoder) encoder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		debuglog.Debugln(server.Name(), "RECV /requestVote")
+		id := r.Header.Get(requestIDHeader)
+		debuglog.DebugTagln("transporter.recv", server.Name(), "RECV", name, id)
 
-		req := &raft.RequestVoteRequest{}
-		if _, err := req.Decode(r.Body); err != nil {
-			http.Error(w, "", http.StatusBadRequest)
-			return
+		var raw *countingReader
+		from := r.Header.Get(nameHeader)
+		if from == "" {
+			from = r.RemoteAddr
+		}
+		defer t.track("incoming", rpc, from, cancelResponse(w))()
+		if isSnapshotRPC(rpc) {
+			if wait, err := t.quotas.admitReceive(from); err != nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+				httpError(w, err, http.StatusTooManyRequests)
+				return
+			}
+			raw = &countingReader{r: r.Body}
+			r.Body = &readCloser{raw, r.Body}
 		}
 
-		resp := server.RequestVote(req)
-		if _, err := resp.Encode(w); err != nil {
-			http.Error(w, "", http.StatusInternalServerError)
+		limited := limitBody(w, r, t.config().MaxRequestSize)
+		body, err := t.requestBody(r, limited)
+		if err != nil {
+			rejectRequest(w, rpc, limited.cause(err))
 			return
 		}
-	}
-}
-
-// Handles incoming Snapshot requests.
-func (t *HTTPTransporter) snapshotHandler(server raft.Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		debuglog.Debugln(server.Name(), "RECV /snapshot")
+		captured := t.capture.buffer()
+		if captured != nil {
+			body = io.TeeReader(body, captured)
+		}
 
-		req := &raft.SnapshotRequest{}
-		if _, err := req.Decode(r.Body); err != nil {
-			http.Error(w, "", http.StatusBadRequest)
+		req := newReq()
+		err = decodeRequest(rpc, r, body, req, !isSnapshotRPC(rpc))
+		t.stats.received(rpc, err)
+		if raw != nil {
+			t.quotas.received(from, raw.n)
+		}
+		if err != nil {
+			t.capture.record(rpc, "request", r.RemoteAddr, captured, err)
+			if cerr, ok := err.(*ChecksumError); ok {
+				checksumFailed(w, cerr)
+				return
+			}
+			rejectRequest(w, rpc, limited.cause(err))
 			return
 		}
+		if hr, ok := req.(headerReader); ok {
+			hr.readHeader(r.Header)
+		}
+
+		var entry *processedRequest
+		if id != "" {
+			e, seen := t.processed.begin(id)
+			if seen {
+				<-e.done
+				if e.resp != nil {
+					debuglog.DebugTagln("transporter.duplicate", server.Name(), "DUPLICATE", name, id)
+					t.stampMetadata(w.Header(), server)
+					t.writeResponse(w, r, rpc, e.header, e.resp)
+					return
+				}
+			} else {
+				// Settles the entry even if the handler panics, so repeats
+				// waiting on it don't hang.  A no-op once finished.
+				entry = e
+				defer entry.finish(nil, nil)
+			}
+		}
 
-		resp := server.RequestSnapshot(req)
-		if _, err := resp.Encode(w); err != nil {
+		b := getBuffer()
+		defer putBuffer(b)
+
+		start := time.Now()
+		resp := call(req)
+		if !noResponse(resp) {
+			_, err = resp.Encode(b)
+		}
+		if noResponse(resp) || err != nil {
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
+
+		header := http.Header{}
+		if hw, ok := resp.(headerWriter); ok {
+			hw.writeHeader(header)
+		}
+		setTerm(header, server.Term())
+		if entry != nil {
+			entry.finish(header, append([]byte(nil), b.Bytes()...))
+		}
+
+		setServerTime(w, start)
+		t.stampMetadata(w.Header(), server)
+		t.writeResponse(w, r, rpc, header, b.Bytes())
 	}
 }
 
-// Handles incoming SnapshotRecovery requests.
-func (t *HTTPTransporter) snapshotRecoveryHandler(server raft.Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		debuglog.Debugln(server.Name(), "RECV /snapshotRecovery")
-
-		req := &raft.SnapshotRecoveryRequest{}
-		if _, err := req.Decode(r.Body); err != nil {
-			http.Error(w, "", http.StatusBadRequest)
-			return
+// Writes an encoded response body to r along with any message headers,
+// compressing it if configured to and the peer accepts it, and encrypting it
+// if keys are configured.  The rpc names the request being answered.
+func (t *HTTPTransporter) writeResponse(w http.ResponseWriter, r *http.Request, rpc string, header http.Header, body []byte) {
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(checksumHeader, checksum(body))
+
+	cfg := t.config()
+	encoding := ""
+	if acceptsGzip(r) && t.compression.compress(rpc+".response", len(body), cfg) {
+		z, err := gzipBuffer(bytes.NewBuffer(body), cfg.compressionLevel())
+		if err == nil {
+			defer putBuffer(z)
+			t.compression.observe(rpc+".response", int64(len(body)), int64(z.Len()), cfg)
+			body = z.Bytes()
+			encoding = "gzip"
 		}
+	}
 
-		resp := server.SnapshotRecoveryRequest(req)
-		if _, err := resp.Encode(w); err != nil {
+	if key := cfg.responseKey(r); key != nil {
+		sealed, err := sealBuffer(key, sealContext("response", r.URL.Path, encoding), bytes.NewBuffer(body))
+		if err != nil {
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
+		defer putBuffer(sealed)
+		body = sealed.Bytes()
+		w.Header().Set(keyIDHeader, key.ID)
+		if encoding != "" {
+			w.Header().Set(sealedEncodingHeader, encoding)
+		}
+	} else if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
 	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
 }
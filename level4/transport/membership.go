@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"net/http"
+	"time"
+)
+
+// How long a join or leave handler waits for the command to commit, including
+// any time spent finding and forwarding to the leader.
+const MembershipTimeout = 5 * time.Second
+
+func init() {
+	RegisterCommand(&raft.DefaultJoinCommand{})
+	RegisterCommand(&raft.DefaultLeaveCommand{})
+}
+
+// Retrieves the Join path.
+func (t *HTTPTransporter) JoinPath() string {
+	return t.memberJoinPath
+}
+
+// Retrieves the Leave path.
+func (t *HTTPTransporter) LeavePath() string {
+	return t.memberLeavePath
+}
+
+// Asks the server at connectionString to add a server to the cluster.  Any
+// member will do; followers forward the request to the leader.
+func (t *HTTPTransporter) SendJoinRequest(connectionString string, cmd *raft.DefaultJoinCommand) error {
+	return t.sendMembership(connectionString, "", t.JoinPath(), cmd)
+}
+
+// Asks the server at connectionString to remove a server from the cluster.
+// Any member will do; followers forward the request to the leader.
+func (t *HTTPTransporter) SendLeaveRequest(connectionString string, cmd *raft.DefaultLeaveCommand) error {
+	return t.sendMembership(connectionString, "", t.LeavePath(), cmd)
+}
+
+func (t *HTTPTransporter) sendMembership(connectionString, group, thePath string, cmd raft.Command) error {
+	base, err := t.addresses.resolve(connectionString, t.srv)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(cmd); err != nil {
+		return err
+	}
+
+	url := joinPath(base, t.groupPath(group, thePath))
+	debuglog.Debugln("->", "POST", url, cmd.CommandName())
+
+	httpReq, err := http.NewRequest("POST", url, &b)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	t.stampGroup(group, httpReq.Header)
+	if err := t.config().sealRequest(httpReq, b.Bytes()); err != nil {
+		return err
+	}
+
+	httpResp, err := t.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	return checkStatus(httpResp)
+}
+
+// Handles incoming Join requests.
+func (t *HTTPTransporter) joinHandler(server raft.Server, group string) http.HandlerFunc {
+	return t.membershipHandler(server, group, "/join", func() raft.Command {
+		return &raft.DefaultJoinCommand{}
+	})
+}
+
+// Handles incoming Leave requests.
+func (t *HTTPTransporter) leaveHandler(server raft.Server, group string) http.HandlerFunc {
+	return t.membershipHandler(server, group, "/leave", func() raft.Command {
+		return &raft.DefaultLeaveCommand{}
+	})
+}
+
+func (t *HTTPTransporter) membershipHandler(server raft.Server, group, name string, newCmd func() raft.Command) http.HandlerFunc {
+	forwarder := t.Group(group).NewForwarder(server)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		debuglog.DebugTagln("transporter.membership.recv", server.Name(), "RECV", name, "as", server.State())
+
+		cmd := newCmd()
+		if err := t.config().openRequest(r); err != nil {
+			rejectRequest(w, name, err)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(cmd); err != nil {
+			http.Error(w, fmt.Sprintf("Could not decode %s: %s", cmd.CommandName(), err),
+				http.StatusBadRequest)
+			return
+		}
+
+		if join, ok := cmd.(*raft.DefaultJoinCommand); ok && join.ConnectionString == "" {
+			http.Error(w, "Join request with empty connection string", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), MembershipTimeout)
+		defer cancel()
+
+		if _, err := forwarder.ForwardToLeader(ctx, cmd); err != nil {
+			debuglog.Debugf("Could not execute %s: %s", cmd.CommandName(), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The time a MemoryNetwork's delays are measured in.
+type Clock interface {
+	// Blocks for d of the clock's time.
+	Sleep(d time.Duration)
+}
+
+type wallClock struct{}
+
+func (wallClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// A VirtualClock only moves when advanced, releasing the sleepers whose time
+// has come.
+type VirtualClock struct {
+	mutex    sync.Mutex
+	now      time.Duration
+	sleepers []virtualSleeper
+	stopped  bool
+}
+
+type virtualSleeper struct {
+	until time.Duration
+	wake  chan struct{}
+}
+
+// Faults a MemoryNetwork injects into every RPC between connected servers.
+type MemoryFaults struct {
+	// Fraction of requests, and separately of responses, that are lost.
+	DropRate float64
+
+	// How long each RPC takes, plus up to Jitter more.
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+// A MemoryNetwork carries Raft RPCs between servers in the same process
+// without touching the network, for simulations.  It is itself the
+// Transporter handed to each server; servers are reachable once installed.
+// Messages are encoded and decoded on the way through, so servers never share
+// them.
+//
+// Faults are drawn from a random source per link, seeded from the network's
+// seed and the names at either end, so a link sees the same sequence of drops
+// and delays on every run with the same seed regardless of how the other
+// links' goroutines were scheduled.
+type MemoryNetwork struct {
+	seed       int64
+	mutex      sync.Mutex
+	servers    map[string]raft.Server
+	partitions map[string]int
+	links      map[string]*rand.Rand
+	faults     MemoryFaults
+	clock      Clock
+}
+
+var _ Transporter = (*MemoryNetwork)(nil)
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Creates a network drawing faults from the given seed.
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		seed:       seed,
+		servers:    make(map[string]raft.Server),
+		partitions: make(map[string]int),
+		links:      make(map[string]*rand.Rand),
+		clock:      wallClock{},
+	}
+}
+
+// Creates a clock at time zero.
+func NewVirtualClock() *VirtualClock {
+	return &VirtualClock{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the seed faults are drawn from.
+func (n *MemoryNetwork) Seed() int64 {
+	return n.seed
+}
+
+// Sets the clock delays are measured in.  Without one, delays are slept on
+// the wall clock.
+func (n *MemoryNetwork) SetClock(clock Clock) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.clock = clock
+}
+
+// Retrieves how far the clock has been advanced.
+func (c *VirtualClock) Now() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Sets the faults injected from now on.
+func (n *MemoryNetwork) SetFaults(faults MemoryFaults) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.faults = faults
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Blocks until the clock has been advanced by d.
+func (c *VirtualClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	if c.stopped {
+		c.mutex.Unlock()
+		return
+	}
+	s := virtualSleeper{until: c.now + d, wake: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+	c.mutex.Unlock()
+
+	<-s.wake
+}
+
+// Moves the clock forward by d, waking every sleeper due by then.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now += d
+	waiting := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if s.until <= c.now {
+			close(s.wake)
+		} else {
+			waiting = append(waiting, s)
+		}
+	}
+	c.sleepers = waiting
+}
+
+// Wakes every sleeper, and lets later sleeps return at once.
+func (c *VirtualClock) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stopped = true
+	for _, s := range c.sleepers {
+		close(s.wake)
+	}
+	c.sleepers = nil
+}
+
+// Makes a server reachable by its name, replacing any server of the same
+// name, as when a server restarts.
+func (n *MemoryNetwork) Install(server raft.Server) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[server.Name()] = server
+}
+
+// Makes a server unreachable, as when it crashes.
+func (n *MemoryNetwork) Remove(name string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.servers, name)
+}
+
+// Splits the network so servers can only reach others in the same group.
+// Servers in no group are cut off from everyone.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, name := range group {
+			n.partitions[name] = i + 1
+		}
+	}
+	// Servers outside every group get a partition of their own.
+	for name := range n.servers {
+		if _, ok := n.partitions[name]; !ok {
+			n.partitions[name] = -len(n.partitions) - 1
+		}
+	}
+}
+
+// Reconnects every server.
+func (n *MemoryNetwork) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.partitions = make(map[string]int)
+}
+
+// Sends a RequestVote RPC to a peer.
+func (n *MemoryNetwork) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	if resp := n.send(server, peer, VoteRPC, req); resp != nil {
+		return resp.(*raft.RequestVoteResponse)
+	}
+	return nil
+}
+
+// Sends an AppendEntries RPC to a peer.
+func (n *MemoryNetwork) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	if resp := n.send(server, peer, AppendEntriesRPC, req); resp != nil {
+		return resp.(*raft.AppendEntriesResponse)
+	}
+	return nil
+}
+
+// Sends a SnapshotRequest RPC to a peer.
+func (n *MemoryNetwork) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	if resp := n.send(server, peer, SnapshotRPC, req); resp != nil {
+		return resp.(*raft.SnapshotResponse)
+	}
+	return nil
+}
+
+// Sends a SnapshotRecoveryRequest RPC to a peer.
+func (n *MemoryNetwork) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	if resp := n.send(server, peer, SnapshotRecoveryRPC, req); resp != nil {
+		return resp.(*raft.SnapshotRecoveryResponse)
+	}
+	return nil
+}
+
+func (n *MemoryNetwork) send(server raft.Server, peer *raft.Peer, rpc RPCType, req encoder) decoder {
+	target, dropRequest, dropResponse, delay, clock := n.route(server.Name(), peer.Name)
+	if target == nil {
+		debuglog.Debugln("transporter.memory."+rpc.key()+".unreachable:", peer.Name)
+		return nil
+	}
+
+	in, out, err := newMessages(rpc)
+	if err == nil {
+		err = copyMessage(req, in)
+	}
+	if err != nil {
+		debuglog.Debugln("transporter.memory."+rpc.key()+".encoding.error:", err)
+		return nil
+	}
+
+	// Lost requests and responses both take as long as the RPC would have,
+	// as a sender waiting on a timeout would see.
+	clock.Sleep(delay)
+	if dropRequest {
+		return nil
+	}
+	// A server stopped during the delay gives no response.
+	resp := dispatch(target, rpc, in)
+	if dropResponse || noResponse(resp) {
+		return nil
+	}
+
+	if err := copyMessage(resp, out); err != nil {
+		debuglog.Debugln("transporter.memory."+rpc.key()+".decoding.error:", err)
+		return nil
+	}
+	return out
+}
+
+// Looks up the server a peer name reaches and draws the faults for one RPC,
+// returning the clock to delay it on.  The target is nil if the peer isn't
+// installed or is partitioned away.
+func (n *MemoryNetwork) route(from, to string) (raft.Server, bool, bool, time.Duration, Clock) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	target := n.servers[to]
+	if target == nil || n.partitions[from] != n.partitions[to] {
+		return nil, false, false, 0, nil
+	}
+
+	link := from + "->" + to
+	rnd := n.links[link]
+	if rnd == nil {
+		h := fnv.New64a()
+		h.Write([]byte(link))
+		rnd = rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))
+		n.links[link] = rnd
+	}
+
+	// Every draw is made whether or not it is used, so changing one fault
+	// doesn't shift the others.
+	dropRequest := rnd.Float64() < n.faults.DropRate
+	dropResponse := rnd.Float64() < n.faults.DropRate
+	delay := n.faults.Delay
+	jitter := rnd.Int63()
+	if n.faults.Jitter > 0 {
+		delay += time.Duration(jitter % int64(n.faults.Jitter))
+	}
+	return target, dropRequest, dropResponse, delay, n.clock
+}
+
+func copyMessage(from encoder, to decoder) error {
+	var b bytes.Buffer
+	if _, err := from.Encode(&b); err != nil {
+		return err
+	}
+	if _, err := to.Decode(&b); err != nil {
+		return fmt.Errorf("Could not decode %T: %s", to, err)
+	}
+	return nil
+}
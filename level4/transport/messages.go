@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Fields up to this long are read in one allocation.
+const messagePieceSize = 64 * 1024
+
+var errMessageTooLong = errors.New("Message field longer than its input")
+
+// RPCs that raft itself doesn't define are encoded with encoding/binary, in
+// the same style as db.Action: big-endian fixed-width integers and
+// length-prefixed strings, in field order.  A messageWriter and messageReader
+// carry the first error forward so Encode and Decode methods can be written
+// as a flat list of fields.
+//
+// Lengths and counts read from the wire are never trusted for allocation.  A
+// length or count that couldn't fit in what remains of the input, when the
+// input knows its length as a buffered body does, fails the message with
+// errMessageTooLong.  Otherwise long fields are read in pieces, so the memory
+// a field takes is bounded by the bytes that actually arrive.  For incoming
+// requests Config.MaxRequestSize bounds those in turn, both on the wire and,
+// for compressed bodies, once decompressed.
+
+type messageWriter struct {
+	w   io.Writer
+	n   int
+	err error
+}
+
+func (m *messageWriter) write(v interface{}) {
+	if m.err != nil {
+		return
+	}
+	if m.err = binary.Write(m.w, binary.BigEndian, v); m.err == nil {
+		m.n += binary.Size(v)
+	}
+}
+
+func (m *messageWriter) uint64(v uint64) {
+	m.write(v)
+}
+
+func (m *messageWriter) bool(v bool) {
+	m.write(v)
+}
+
+func (m *messageWriter) bytes(b []byte) {
+	m.write(uint32(len(b)))
+	if m.err == nil {
+		var n int
+		n, m.err = m.w.Write(b)
+		m.n += n
+	}
+}
+
+func (m *messageWriter) string(s string) {
+	m.bytes([]byte(s))
+}
+
+func (m *messageWriter) result() (int, error) {
+	return m.n, m.err
+}
+
+type messageReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+// Implemented by readers that know how many bytes they have left, such as
+// bytes.Reader.
+type lenReader interface {
+	Len() int
+}
+
+// Fails the message if n bytes couldn't remain in the input.
+func (m *messageReader) fits(n uint64) bool {
+	if m.err != nil {
+		return false
+	}
+	if l, ok := m.r.(lenReader); ok && n > uint64(l.Len()) {
+		m.err = errMessageTooLong
+		return false
+	}
+	return true
+}
+
+// Reads a count of items, each at least size bytes long.
+func (m *messageReader) count(size uint64) uint64 {
+	n := m.uint64()
+	if size > 0 && n > (1<<63)/size {
+		m.err = errMessageTooLong
+		return 0
+	}
+	if !m.fits(n * size) {
+		return 0
+	}
+	return n
+}
+
+func (m *messageReader) read(v interface{}) {
+	if m.err != nil {
+		return
+	}
+	if m.err = binary.Read(m.r, binary.BigEndian, v); m.err == nil {
+		m.n += binary.Size(v)
+	}
+}
+
+func (m *messageReader) uint64() uint64 {
+	var v uint64
+	m.read(&v)
+	return v
+}
+
+func (m *messageReader) bool() bool {
+	var v bool
+	m.read(&v)
+	return v
+}
+
+func (m *messageReader) bytes() []byte {
+	var length uint32
+	m.read(&length)
+	if m.err != nil {
+		return nil
+	}
+	if !m.fits(uint64(length)) {
+		return nil
+	}
+	if length <= messagePieceSize {
+		b := make([]byte, length)
+		var n int
+		n, m.err = io.ReadFull(m.r, b)
+		m.n += n
+		return b
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, m.r, int64(length))
+	m.n += int(n)
+	if err != nil {
+		m.err = err
+		if err == io.EOF {
+			m.err = io.ErrUnexpectedEOF
+		}
+	}
+	return buf.Bytes()
+}
+
+func (m *messageReader) string() string {
+	return string(m.bytes())
+}
+
+// Reports the bytes read and the first error.  Running out of input partway
+// through a message is reported as io.ErrUnexpectedEOF, not io.EOF, so it
+// can't be mistaken for a clean end of stream.
+func (m *messageReader) result() (int, error) {
+	if m.err == io.EOF && m.n > 0 {
+		return m.n, io.ErrUnexpectedEOF
+	}
+	return m.n, m.err
+}
@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Incoming AppendEntries, and optionally whole snapshots, can be mirrored to
+// a shadow server, such as a staging build of a new version, to try it
+// against real traffic.  Once a request has been handled successfully its
+// body and headers are replayed, exactly as received, to the same route on
+// the shadow, in the background and in order.  The shadow's responses are
+// ignored and it never counts towards a quorum, so it can fall behind, fail
+// or disappear without affecting the cluster; if it falls more than Depth
+// requests behind, requests are dropped.  The shadow must share the
+// cluster's encryption keys if any are configured.
+//
+// Snapshots sent in chunks aren't mirrored, since which chunks are sent
+// depends on the real follower's answers.
+
+// Requests waiting to be mirrored beyond which they are dropped, unless
+// MirrorConfig.Depth says otherwise.
+const DefaultMirrorDepth = 256
+
+// How long a mirrored request may take.
+const DefaultMirrorTimeout = 5 * time.Second
+
+// Where incoming traffic is mirrored to.
+type MirrorConfig struct {
+	// The connection string of the shadow server.  Empty disables
+	// mirroring.
+	ConnectionString string
+
+	// Also mirror snapshots sent whole.
+	Snapshots bool
+
+	// Requests waiting to be mirrored beyond which they are dropped.  Zero
+	// uses DefaultMirrorDepth.
+	Depth int
+}
+
+// Counts of requests mirrored, dropped because the shadow fell behind, and
+// failed or refused by the shadow.
+type MirrorStats struct {
+	Mirrored uint64 `json:"mirrored"`
+	Dropped  uint64 `json:"dropped"`
+	Failed   uint64 `json:"failed"`
+}
+
+type trafficMirror struct {
+	mutex   sync.Mutex
+	pending []*mirroredRequest
+	wake    chan struct{}
+	started bool
+	stats   MirrorStats
+}
+
+type mirroredRequest struct {
+	connectionString string
+	path             string
+	header           http.Header
+	body             []byte
+}
+
+// Records the status a handler responds with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func newTrafficMirror() *trafficMirror {
+	return &trafficMirror{wake: make(chan struct{}, 1)}
+}
+
+func (c MirrorConfig) depth() int {
+	if c.Depth == 0 {
+		return DefaultMirrorDepth
+	}
+	return c.Depth
+}
+
+// Retrieves counts of the requests mirrored to the shadow server.
+func (t *HTTPTransporter) MirrorStats() MirrorStats {
+	t.mirror.mutex.Lock()
+	defer t.mirror.mutex.Unlock()
+	return t.mirror.stats
+}
+
+// Wraps the handler of an RPC to mirror the requests it handles successfully.
+func (t *HTTPTransporter) mirrored(rpc string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := t.config().Mirror
+		if cfg.ConnectionString == "" || (isSnapshotRPC(rpc) && !cfg.Snapshots) {
+			handler(w, r)
+			return
+		}
+
+		var body bytes.Buffer
+		r.Body = &readCloser{io.TeeReader(r.Body, &body), r.Body}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		if sw.status != http.StatusOK {
+			return
+		}
+		// Read whatever the handler left, so the body and any trailers are
+		// complete.
+		io.Copy(ioutil.Discard, r.Body)
+
+		header := r.Header.Clone()
+		for k, v := range r.Trailer {
+			header[k] = v
+		}
+		t.mirror.enqueue(t, cfg, &mirroredRequest{
+			connectionString: cfg.ConnectionString,
+			path:             r.URL.Path,
+			header:           header,
+			body:             body.Bytes(),
+		})
+	}
+}
+
+func (m *trafficMirror) enqueue(t *HTTPTransporter, cfg MirrorConfig, req *mirroredRequest) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.pending) >= cfg.depth() {
+		m.stats.Dropped++
+		debuglog.Debugln("transporter.mirror.dropped:", req.path)
+		return
+	}
+	m.pending = append(m.pending, req)
+	if !m.started {
+		m.started = true
+		go m.run(t)
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends mirrored requests one at a time, in the order they were handled.
+func (m *trafficMirror) run(t *HTTPTransporter) {
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-m.wake:
+		}
+
+		for {
+			m.mutex.Lock()
+			if len(m.pending) == 0 {
+				m.mutex.Unlock()
+				break
+			}
+			req := m.pending[0]
+			m.pending[0] = nil
+			m.pending = m.pending[1:]
+			m.mutex.Unlock()
+
+			err := t.sendMirrored(req)
+
+			m.mutex.Lock()
+			if err != nil {
+				m.stats.Failed++
+			} else {
+				m.stats.Mirrored++
+			}
+			m.mutex.Unlock()
+		}
+	}
+}
+
+func (t *HTTPTransporter) sendMirrored(req *mirroredRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultMirrorTimeout)
+	defer cancel()
+
+	base, err := t.srv.resolve(req.connectionString)
+	if err != nil {
+		debuglog.Debugln("transporter.mirror.resolve.error:", err)
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", joinPath(base, req.path), bytes.NewReader(req.body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header = req.header
+
+	httpResp, err := t.bulkClient.Do(httpReq)
+	if err != nil {
+		debuglog.Debugln("transporter.mirror.response.error:", err)
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if err := checkStatus(httpResp); err != nil {
+		debuglog.Debugln("transporter.mirror.status.error:", err)
+		return err
+	}
+	io.Copy(ioutil.Discard, httpResp.Body)
+	return nil
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Lets an http.ResponseController reach the connection.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A connection string may list several addresses of the same server,
+// separated by commas, for servers reachable over more than one interface:
+//
+//	http://10.0.0.1:4000,http://10.0.1.1:4000
+//
+// Requests are addressed to the first, and dials fail over through the rest
+// in order, starting with whichever last worked.  Each address must be an
+// http:// URL; dns+srv names can't be listed.
+const addressSeparator = ","
+
+// Retrieves the addresses listed in a connection string.
+func Addresses(connectionString string) []string {
+	parts := strings.Split(connectionString, addressSeparator)
+	addrs := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			addrs = append(addrs, part)
+		}
+	}
+	return addrs
+}
+
+// Joins addresses of a single server into a connection string.
+func JoinAddresses(addrs ...string) string {
+	return strings.Join(addrs, addressSeparator)
+}
+
+// An addressBook remembers the addresses of servers with several, keyed by
+// the dial address of the first, and which of them last worked.
+type addressBook struct {
+	mutex  sync.Mutex
+	groups map[string]*addressGroup
+}
+
+type addressGroup struct {
+	connectionString string
+	hosts            []string
+	last             int
+}
+
+func newAddressBook() *addressBook {
+	return &addressBook{groups: make(map[string]*addressGroup)}
+}
+
+// Returns the base URL requests to a connection string are addressed to,
+// noting its other addresses for dial to fail over to.
+func (b *addressBook) resolve(connectionString string, srv *srvResolver) (string, error) {
+	addrs := Addresses(connectionString)
+	if len(addrs) < 2 {
+		return srv.resolve(connectionString)
+	}
+
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return "", err
+		}
+		hosts[i] = u.Host
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, key := range addressKeys(hosts[0]) {
+		if g := b.groups[key]; g == nil || g.connectionString != connectionString {
+			b.groups[key] = &addressGroup{
+				connectionString: connectionString,
+				hosts:            hosts,
+			}
+		}
+	}
+	return addrs[0], nil
+}
+
+// Dials an encoded address, failing over through the server's other addresses
+// if it has any.
+func (b *addressBook) dial(encoded string, dial func(encoded string) (net.Conn, error)) (net.Conn, error) {
+	b.mutex.Lock()
+	g := b.groups[Decode(encoded)]
+	var hosts []string
+	var last int
+	if g != nil {
+		hosts, last = g.hosts, g.last
+	}
+	b.mutex.Unlock()
+
+	if g == nil {
+		return dial(encoded)
+	}
+
+	_, port, _ := net.SplitHostPort(encoded)
+
+	var firstErr error
+	for i := range hosts {
+		n := (last + i) % len(hosts)
+		conn, err := dial(withPort(hosts[n], port))
+		if err == nil {
+			if n != last {
+				debuglog.Debugf("Failed over from %s to %s", hosts[last], hosts[n])
+				b.mutex.Lock()
+				g.last = n
+				b.mutex.Unlock()
+			}
+			return conn, nil
+		}
+		debuglog.Debugf("Dialing %s failed: %s", hosts[n], err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Returns the keys a group whose first address is host is found under.  The
+// HTTP transport adds the scheme's default port to hosts without one, which
+// may be 80 or 443 depending on whether TLS is in use.
+func addressKeys(host string) []string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return []string{Decode(host)}
+	}
+	return []string{Decode(withPort(host, "80")), Decode(withPort(host, "443"))}
+}
+
+// Adds a port to a URL host that doesn't have one.
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil || port == "" {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
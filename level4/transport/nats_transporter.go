@@ -0,0 +1,391 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"github.com/nats-io/nats.go"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Headers splitting a request too large for one NATS message into parts.
+	// Every part but the last is acknowledged with an empty reply.
+	natsTransferHeader = "Raft-Transfer"
+	natsPartHeader     = "Raft-Part"
+	natsPartsHeader    = "Raft-Parts"
+
+	// The header a handler reports a failure in, in place of a response.
+	natsErrorHeader = "Raft-Error"
+
+	// Room left in each message for the subject, reply inbox and headers.
+	natsHeaderAllowance = 1024
+
+	// How long the parts of an incomplete request are kept.
+	natsTransferTimeout = time.Minute
+
+	// The most requests being reassembled from parts at once.  Parts of
+	// further requests are refused until one completes or times out.
+	natsMaxTransfers = 16
+
+	// The largest request reassembled from parts, when the transporter's
+	// MaxRequestSize is zero.
+	DefaultNATSMaxRequestSize = 1 << 30
+)
+
+// A NATSTransporter carries Raft RPCs over NATS request/reply rather than
+// direct connections between servers, for networks where servers can reach
+// a NATS cluster but not each other.  Requests to a server are published on
+// <prefix>.<name>.<rpc>, so peers are addressed by name and their connection
+// strings go unused.  Requests larger than the server's maximum payload, such
+// as snapshots, are split into parts and reassembled by the receiver.
+type NATSTransporter struct {
+	conn      *nats.Conn
+	prefix    string
+	transfers *natsTransfers
+	ids       uint64
+	idPrefix  string
+	mutex     sync.Mutex
+	subs      []*nats.Subscription
+
+	// How long to wait for each reply.  Zero uses the server's election
+	// timeout.
+	Timeout time.Duration
+
+	// The largest request, in bytes, accepted once reassembled from parts.
+	// Zero uses DefaultNATSMaxRequestSize.
+	MaxRequestSize int64
+}
+
+var _ Transporter = (*NATSTransporter)(nil)
+
+// The parts received so far of requests split across messages.
+type natsTransfers struct {
+	mutex     sync.Mutex
+	transfers map[string]*natsTransfer
+}
+
+type natsTransfer struct {
+	parts    [][]byte
+	received int
+	size     int64
+	started  time.Time
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Creates a transporter publishing under the given subject prefix on conn,
+// which the caller remains responsible for closing.
+func NewNATSTransporter(conn *nats.Conn, prefix string) *NATSTransporter {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return &NATSTransporter{
+		conn:      conn,
+		prefix:    prefix,
+		transfers: &natsTransfers{transfers: make(map[string]*natsTransfer)},
+		idPrefix:  hex.EncodeToString(b),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the subject prefix used by the transporter.
+func (t *NATSTransporter) Prefix() string {
+	return t.prefix
+}
+
+// Retrieves the subject a server's requests of an RPC type are published on.
+func (t *NATSTransporter) subject(name string, rpc RPCType) string {
+	return t.prefix + "." + subjectToken(name) + "." + rpc.key()
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Outgoing
+//--------------------------------------
+
+// Sends a RequestVote RPC to a peer.
+func (t *NATSTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	resp := &raft.RequestVoteResponse{}
+	if err := t.send(server, peer, VoteRPC, req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Sends an AppendEntries RPC to a peer.
+func (t *NATSTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	resp := &raft.AppendEntriesResponse{}
+	if err := t.send(server, peer, AppendEntriesRPC, req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Sends a SnapshotRequest RPC to a peer.
+func (t *NATSTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	resp := &raft.SnapshotResponse{}
+	if err := t.send(server, peer, SnapshotRPC, req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Sends a SnapshotRecoveryRequest RPC to a peer.
+func (t *NATSTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	resp := &raft.SnapshotRecoveryResponse{}
+	if err := t.send(server, peer, SnapshotRecoveryRPC, req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+func (t *NATSTransporter) send(server raft.Server, peer *raft.Peer, rpc RPCType, req encoder, resp decoder) error {
+	subject := t.subject(peer.Name, rpc)
+	debuglog.DebugTagln("transporter.nats.send", server.Name(), "->", peer.Name, "NATS", subject)
+
+	var b bytes.Buffer
+	if _, err := req.Encode(&b); err != nil {
+		debuglog.Debugln("transporter.nats."+rpc.key()+".encoding.error:", err)
+		return err
+	}
+
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = server.ElectionTimeout()
+	}
+
+	data := b.Bytes()
+	size := int(t.conn.MaxPayload()) - natsHeaderAllowance
+	parts := (len(data) + size - 1) / size
+	if parts < 1 {
+		parts = 1
+	}
+	id := t.idPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&t.ids, 1), 10)
+
+	var reply *nats.Msg
+	for i := 0; i < parts; i++ {
+		msg := nats.NewMsg(subject)
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		msg.Data = data[i*size : end]
+		if parts > 1 {
+			msg.Header.Set(natsTransferHeader, id)
+			msg.Header.Set(natsPartHeader, strconv.Itoa(i))
+			msg.Header.Set(natsPartsHeader, strconv.Itoa(parts))
+		}
+
+		var err error
+		reply, err = t.conn.RequestMsg(msg, timeout)
+		if err != nil {
+			debuglog.Debugln("transporter.nats."+rpc.key()+".response.error:", err)
+			return err
+		}
+		if e := reply.Header.Get(natsErrorHeader); e != "" {
+			debuglog.Debugln("transporter.nats."+rpc.key()+".response.error:", e)
+			return errors.New(e)
+		}
+	}
+
+	if _, err := resp.Decode(bytes.NewReader(reply.Data)); err != nil {
+		debuglog.Debugln("transporter.nats."+rpc.key()+".decoding.error:", err)
+		return &DecodeError{RPC: rpc.key(), Direction: "response", Err: err}
+	}
+	return nil
+}
+
+//--------------------------------------
+// Incoming
+//--------------------------------------
+
+// Subscribes to requests for a server.  Each request is handled on its own
+// goroutine, so a snapshot being applied doesn't hold up heartbeats.
+func (t *NATSTransporter) Install(server raft.Server) error {
+	sub, err := t.conn.Subscribe(t.prefix+"."+subjectToken(server.Name())+".*", func(msg *nats.Msg) {
+		go t.handle(server, msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.subs = append(t.subs, sub)
+	t.mutex.Unlock()
+	return nil
+}
+
+// Unsubscribes from requests for every installed server.
+func (t *NATSTransporter) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var err error
+	for _, sub := range t.subs {
+		if e := sub.Unsubscribe(); e != nil && err == nil {
+			err = e
+		}
+	}
+	t.subs = nil
+	return err
+}
+
+func (t *NATSTransporter) handle(server raft.Server, msg *nats.Msg) {
+	rpc, ok := wsRPCs[msg.Subject[strings.LastIndex(msg.Subject, ".")+1:]]
+	if !ok {
+		t.fail(msg, fmt.Errorf("Unknown RPC %s", msg.Subject))
+		return
+	}
+	debuglog.DebugTagln("transporter.nats.recv", server.Name(), "RECV", "NATS", rpc.key())
+
+	data := msg.Data
+	if id := msg.Header.Get(natsTransferHeader); id != "" {
+		max := t.maxRequestSize()
+		size := t.conn.MaxPayload() - natsHeaderAllowance
+		complete, err := t.transfers.add(id, msg.Header, msg.Data, max, int((max+size-1)/size))
+		if err == nil && complete == nil {
+			// Acknowledge the part so the sender sends the next.
+			msg.Respond(nil)
+			return
+		}
+		if err != nil {
+			t.fail(msg, err)
+			return
+		}
+		data = complete
+	}
+
+	req, _, err := newMessages(rpc)
+	if err == nil {
+		_, err = req.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		err = &DecodeError{RPC: rpc.key(), Direction: "request", Err: err}
+		t.fail(msg, err)
+		return
+	}
+
+	resp := dispatch(server, rpc, req)
+	if resp == nil {
+		t.fail(msg, errNoResponse)
+		return
+	}
+	var b bytes.Buffer
+	if _, err := resp.Encode(&b); err != nil {
+		t.fail(msg, err)
+		return
+	}
+
+	if err := msg.Respond(b.Bytes()); err != nil {
+		debuglog.Debugln("transporter.nats."+rpc.key()+".respond.error:", err)
+	}
+}
+
+func (t *NATSTransporter) fail(msg *nats.Msg, err error) {
+	debuglog.Debugln("transporter.nats.request.error:", err)
+	reply := nats.NewMsg(msg.Reply)
+	reply.Header.Set(natsErrorHeader, err.Error())
+	msg.RespondMsg(reply)
+}
+
+// Retrieves the largest request accepted once reassembled.
+func (t *NATSTransporter) maxRequestSize() int64 {
+	if t.MaxRequestSize > 0 {
+		return t.MaxRequestSize
+	}
+	return DefaultNATSMaxRequestSize
+}
+
+// Adds a part of a request, returning the whole request once every part has
+// arrived.  Requests are refused if they would exceed max bytes, or claim
+// more than maxParts parts, the most a sender splitting a request of max
+// bytes would need.
+func (s *natsTransfers) add(id string, header nats.Header, data []byte, max int64, maxParts int) ([]byte, error) {
+	part, err := strconv.Atoi(header.Get(natsPartHeader))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid part %q", header.Get(natsPartHeader))
+	}
+	parts, err := strconv.Atoi(header.Get(natsPartsHeader))
+	if err != nil || parts < 1 || part < 0 || part >= parts {
+		return nil, fmt.Errorf("Invalid part %d of %q", part, header.Get(natsPartsHeader))
+	}
+	if parts > maxParts {
+		return nil, withKind(fmt.Errorf("Transfer %s of %d parts exceeds %d bytes", id, parts, max), ErrRequestTooLarge)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for key, tr := range s.transfers {
+		if now.Sub(tr.started) > natsTransferTimeout {
+			delete(s.transfers, key)
+		}
+	}
+
+	tr, ok := s.transfers[id]
+	if !ok {
+		if len(s.transfers) >= natsMaxTransfers {
+			return nil, withKind(fmt.Errorf("Too many transfers in progress"), ErrThrottled)
+		}
+		tr = &natsTransfer{parts: make([][]byte, parts), started: now}
+		s.transfers[id] = tr
+	}
+	if len(tr.parts) != parts {
+		delete(s.transfers, id)
+		return nil, fmt.Errorf("Transfer %s changed from %d to %d parts", id, len(tr.parts), parts)
+	}
+	if tr.parts[part] == nil {
+		tr.received++
+	}
+	tr.size += int64(len(data) - len(tr.parts[part]))
+	if tr.size > max {
+		delete(s.transfers, id)
+		return nil, withKind(fmt.Errorf("Transfer %s exceeds %d bytes", id, max), ErrRequestTooLarge)
+	}
+	tr.parts[part] = append([]byte{}, data...)
+
+	if tr.received < parts {
+		return nil, nil
+	}
+	delete(s.transfers, id)
+	return bytes.Join(tr.parts, nil), nil
+}
+
+// Escapes a server name for use as a single subject token, which can't
+// contain dots, wildcards or whitespace.
+func subjectToken(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
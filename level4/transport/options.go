@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// An Option configures an HTTPTransporter at construction time.
+type Option func(*HTTPTransporter)
+
+// The idle connections kept per peer on each of the transporter's HTTP
+// transports unless WithMaxIdleConnsPerHost says otherwise.  Well above
+// net/http's default of two, so bursts of replication traffic reuse
+// connections instead of dialing new ones.
+const DefaultMaxIdleConnsPerHost = 16
+
+// How long idle connections to peers are kept unless WithIdleConnTimeout says
+// otherwise.
+const DefaultIdleConnTimeout = 90 * time.Second
+
+// Sets how long an idle connection to a peer is kept before closing it.  Zero
+// keeps idle connections indefinitely.
+func WithIdleConnTimeout(d time.Duration) Option {
+	return func(t *HTTPTransporter) {
+		for _, transport := range t.transports() {
+			transport.IdleConnTimeout = d
+		}
+	}
+}
+
+// Sets how many idle connections to each peer are kept for reuse.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(t *HTTPTransporter) {
+		for _, transport := range t.transports() {
+			transport.MaxIdleConnsPerHost = n
+		}
+	}
+}
+
+// Sets the TCP keep-alive probing of connections to peers.  Without this
+// option, the operating system's idle time and interval are used after the
+// first 15 seconds.
+func WithTCPKeepAlive(cfg net.KeepAliveConfig) Option {
+	return func(t *HTTPTransporter) {
+		t.keepAlive = cfg
+	}
+}
+
+// Speaks HTTP/2 to peers, multiplexing RPCs over a single connection per
+// peer.  Over TLS it is negotiated with ALPN; without TLS requests are sent
+// as h2c with prior knowledge, so every peer must also be using this option
+// and serving through a server set up by ConfigureServer.
+func WithHTTP2() Option {
+	return func(t *HTTPTransporter) {
+		t.http2 = true
+		for _, transport := range t.transports() {
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetHTTP2(true)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+}
+
+// Wraps the round trippers of the transporter's HTTP clients, e.g. to observe
+// the requests it sends.  Wrappers apply after every other option, in order,
+// so the first is outermost.
+func WithClientMiddleware(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(t *HTTPTransporter) {
+		t.middleware = append(t.middleware, wrap)
+	}
+}
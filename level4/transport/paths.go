@@ -0,0 +1,97 @@
+package transport
+
+// The names of the routes a transporter serves, each joined to its prefix.
+// Every peer must use the same names.
+type Paths struct {
+	AppendEntries    string
+	CommitUpdate     string
+	RequestVote      string
+	Snapshot         string
+	SnapshotRecovery string
+	SnapshotChunks   string
+	Ping             string
+	TimeoutNow       string
+	PreVote          string
+	ReadIndex        string
+	Forward          string
+	Join             string
+	Leave            string
+	Admin            string
+	WebSocket        string
+	Heartbeats       string
+}
+
+// The route names used unless WithPaths says otherwise.
+var DefaultPaths = Paths{
+	AppendEntries:    "/appendEntries",
+	CommitUpdate:     "/commitUpdate",
+	RequestVote:      "/requestVote",
+	Snapshot:         "/snapshot",
+	SnapshotRecovery: "/snapshotRecovery",
+	SnapshotChunks:   "/snapshotChunks",
+	Ping:             "/ping",
+	TimeoutNow:       "/timeoutNow",
+	PreVote:          "/preVote",
+	ReadIndex:        "/readIndex",
+	Forward:          "/forward",
+	Join:             "/join",
+	Leave:            "/leave",
+	Admin:            "/admin",
+	WebSocket:        "/ws",
+	Heartbeats:       "/heartbeats",
+}
+
+// Overrides route names, for serving alongside routes that would collide with
+// the defaults or matching another implementation's scheme.  Empty fields
+// keep their default names.
+func WithPaths(paths Paths) Option {
+	return func(t *HTTPTransporter) {
+		t.setPaths(paths.withDefaults())
+	}
+}
+
+func (p Paths) withDefaults() Paths {
+	d := DefaultPaths
+	for _, f := range []struct{ to, from *string }{
+		{&d.AppendEntries, &p.AppendEntries},
+		{&d.CommitUpdate, &p.CommitUpdate},
+		{&d.RequestVote, &p.RequestVote},
+		{&d.Snapshot, &p.Snapshot},
+		{&d.SnapshotRecovery, &p.SnapshotRecovery},
+		{&d.SnapshotChunks, &p.SnapshotChunks},
+		{&d.Ping, &p.Ping},
+		{&d.TimeoutNow, &p.TimeoutNow},
+		{&d.PreVote, &p.PreVote},
+		{&d.ReadIndex, &p.ReadIndex},
+		{&d.Forward, &p.Forward},
+		{&d.Join, &p.Join},
+		{&d.Leave, &p.Leave},
+		{&d.Admin, &p.Admin},
+		{&d.WebSocket, &p.WebSocket},
+		{&d.Heartbeats, &p.Heartbeats},
+	} {
+		if *f.from != "" {
+			*f.to = *f.from
+		}
+	}
+	return d
+}
+
+func (t *HTTPTransporter) setPaths(p Paths) {
+	t.appendEntriesPath = joinPath(t.prefix, p.AppendEntries)
+	t.commitUpdatePath = joinPath(t.prefix, p.CommitUpdate)
+	t.requestVotePath = joinPath(t.prefix, p.RequestVote)
+	t.snapshotPath = joinPath(t.prefix, p.Snapshot)
+	t.snapshotRecoveryPath = joinPath(t.prefix, p.SnapshotRecovery)
+	t.snapshotChunksPath = joinPath(t.prefix, p.SnapshotChunks)
+	t.pingPath = joinPath(t.prefix, p.Ping)
+	t.timeoutNowPath = joinPath(t.prefix, p.TimeoutNow)
+	t.preVotePath = joinPath(t.prefix, p.PreVote)
+	t.readIndexPath = joinPath(t.prefix, p.ReadIndex)
+	t.forwardPath = joinPath(t.prefix, p.Forward)
+	t.memberJoinPath = joinPath(t.prefix, p.Join)
+	t.memberLeavePath = joinPath(t.prefix, p.Leave)
+	t.adminPath = joinPath(t.prefix, p.Admin)
+	t.webSocketPath = joinPath(t.prefix, p.WebSocket)
+	t.heartbeatsPath = joinPath(t.prefix, p.Heartbeats)
+}
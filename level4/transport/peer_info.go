@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With Config.ResponseMetadata, servers describe themselves in headers on
+// every RPC response: their commit index, the leader they know of and their
+// version, alongside the term every response carries.  Senders parse these
+// into a PeerInfo, passed to Config.OnPeerInfo before the Send* call that
+// received it returns, and kept as the peer's latest for PeerInfo.  This
+// gives leader redirection hints and shows how far behind a peer is without
+// extra RPCs.  The leader is named in the same header as in Forward's
+// redirections.
+const (
+	commitIndexHeader = "X-Raft-Commit-Index"
+	versionHeader     = "X-Raft-Version"
+)
+
+// A peer's description of itself, from the metadata of its latest response.
+type PeerInfo struct {
+	Term        uint64    `json:"term"`
+	CommitIndex uint64    `json:"commitIndex"`
+	Leader      string    `json:"leader"`
+	Version     string    `json:"version"`
+	Received    time.Time `json:"received"`
+}
+
+type peerInfos struct {
+	mutex sync.Mutex
+	peers map[string]PeerInfo
+}
+
+func newPeerInfos() *peerInfos {
+	return &peerInfos{peers: make(map[string]PeerInfo)}
+}
+
+// Retrieves what the named peer last reported of itself.  The second result
+// is false if it hasn't sent any metadata.
+func (t *HTTPTransporter) PeerInfo(name string) (PeerInfo, bool) {
+	t.peerInfos.mutex.Lock()
+	defer t.peerInfos.mutex.Unlock()
+
+	info, ok := t.peerInfos.peers[name]
+	return info, ok
+}
+
+// Describes the local server in a response's headers, if configured to.
+func (t *HTTPTransporter) stampMetadata(h http.Header, server raft.Server) {
+	cfg := t.config()
+	if !cfg.ResponseMetadata {
+		return
+	}
+	h.Set(commitIndexHeader, strconv.FormatUint(server.CommitIndex(), 10))
+	if leader := server.Leader(); leader != "" {
+		h.Set(leaderHeader, leader)
+	}
+	if cfg.Version != "" {
+		h.Set(versionHeader, cfg.Version)
+	}
+}
+
+// Records the metadata of a response from a peer, if it has any.
+func (t *HTTPTransporter) recordMetadata(peer string, h http.Header) {
+	commitIndex, err := strconv.ParseUint(h.Get(commitIndexHeader), 10, 64)
+	if err != nil {
+		return
+	}
+	info := PeerInfo{
+		CommitIndex: commitIndex,
+		Leader:      h.Get(leaderHeader),
+		Version:     h.Get(versionHeader),
+		Received:    time.Now(),
+	}
+	info.Term, _ = strconv.ParseUint(h.Get(termHeader), 10, 64)
+
+	t.peerInfos.mutex.Lock()
+	t.peerInfos.peers[peer] = info
+	t.peerInfos.mutex.Unlock()
+
+	if onInfo := t.config().OnPeerInfo; onInfo != nil {
+		onInfo(peer, info)
+	}
+}
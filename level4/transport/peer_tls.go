@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// By default a peer's certificate must be valid for the host of its
+// connection string, which can't work for peers addressed by raw IP with
+// certificates naming a host, for Unix sockets fronted by TLS, or for
+// SPIFFE-style certificates that identify a workload by URI rather than by
+// host.  Config.PeerTLS overrides, per peer, the name expected and sent as
+// SNI, and how the peer's identity is checked.
+
+// TLS settings for dialing a single peer.
+type PeerTLS struct {
+	// The name sent as SNI and expected in the peer's certificate.  Empty
+	// uses the host of the peer's connection string.
+	ServerName string
+
+	// Skips checking that the certificate is valid for ServerName.  The
+	// chain is still verified against the configured roots, leaving the
+	// peer's identity to VerifyPeerCertificate.
+	SkipHostnameCheck bool
+
+	// Called, if set, with the peer's certificates and the verified chains
+	// once the handshake's own checks have passed.  An error fails the
+	// handshake.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+var errNoPeerCertificates = errors.New("Peer presented no certificates")
+
+type peerNameKey struct{}
+
+// Returns a context carrying the name of the peer a connection is dialed
+// for, so dialTLS can apply the peer's TLS settings.
+func withPeerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, peerNameKey{}, name)
+}
+
+func peerNameFrom(ctx context.Context) string {
+	name, _ := ctx.Value(peerNameKey{}).(string)
+	return name
+}
+
+// Applies a peer's settings to the TLS config it is dialed with.
+func (p PeerTLS) apply(config *tls.Config) {
+	if p.ServerName != "" {
+		config.ServerName = p.ServerName
+	}
+	if !p.SkipHostnameCheck {
+		config.VerifyPeerCertificate = p.VerifyPeerCertificate
+		return
+	}
+
+	// Verification is done here in place of the handshake's, which can't
+	// skip only the hostname.
+	config.InsecureSkipVerify = true
+	roots, verify := config.RootCAs, p.VerifyPeerCertificate
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errNoPeerCertificates
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := cs.PeerCertificates[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		if verify == nil {
+			return nil
+		}
+		raw := make([][]byte, len(cs.PeerCertificates))
+		for i, cert := range cs.PeerCertificates {
+			raw[i] = cert.Raw
+		}
+		return verify(raw, chains)
+	}
+}
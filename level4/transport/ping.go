@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"net/http"
+	"time"
+)
+
+// How long ProbePeer waits for a peer to answer.
+const DefaultProbeTimeout = time.Second
+
+// A HealthStatus describes a peer as reported by its ping endpoint.
+type HealthStatus struct {
+	Name        string        `json:"name"`
+	State       string        `json:"state"`
+	Term        uint64        `json:"term"`
+	CommitIndex uint64        `json:"commitIndex"`
+	Leader      string        `json:"leader"`
+	RTT         time.Duration `json:"-"`
+}
+
+// Retrieves the Ping path.
+func (t *HTTPTransporter) PingPath() string {
+	return t.pingPath
+}
+
+// Pings a peer, returning its reported status and the round-trip time.
+func (t *HTTPTransporter) ProbePeer(peer *raft.Peer) (HealthStatus, error) {
+	var status HealthStatus
+
+	ctx, cancel := context.WithTimeout(withPeerName(context.Background(), peer.Name), DefaultProbeTimeout)
+	defer cancel()
+
+	url, err := t.peerURL(peer, t.PingPath())
+	if err != nil {
+		return status, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return status, err
+	}
+
+	start := time.Now()
+	httpResp, err := t.httpClient.Do(httpReq)
+	if err != nil {
+		debuglog.Debugln("transporter.ping.response.error:", err)
+		return status, err
+	}
+	defer httpResp.Body.Close()
+
+	if err := checkStatus(httpResp); err != nil {
+		return status, err
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&status); err != nil {
+		debuglog.Debugln("transporter.ping.decoding.error:", err)
+		return status, err
+	}
+	status.RTT = time.Since(start)
+
+	return status, nil
+}
+
+// Handles incoming Ping requests.
+func (t *HTTPTransporter) pingHandler(server raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := HealthStatus{
+			Name:        server.Name(),
+			State:       server.State(),
+			Term:        server.Term(),
+			CommitIndex: server.CommitIndex(),
+			Leader:      server.Leader(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&status); err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	}
+}
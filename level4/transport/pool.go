@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"bytes"
+	"github.com/metcalf/raft"
+	"sync"
+)
+
+// Buffers that grew beyond this (e.g. for a snapshot) are dropped rather than
+// pooled so one large transfer doesn't pin its memory forever.
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// Pools of incoming request messages.  A message can only be reused if the
+// server keeps no reference to it once the RPC returns, which rules out
+// SnapshotRecovery (the server keeps the peers and state).  The log keeps an
+// AppendEntries request's entries but not the request, and Decode gives each
+// request a fresh Entries slice, so an AppendEntries request can be pooled
+// once its Entries are dropped.  Decode overwrites every field, so pooled
+// messages need no other reset.
+//
+// Response messages aren't pooled: incoming RPCs' responses are allocated by
+// the server, and outgoing RPCs' responses are handed to the server, which
+// goes on using them after the send returns.
+var appendEntriesPool = sync.Pool{
+	New: func() interface{} { return &raft.AppendEntriesRequest{} },
+}
+
+var requestVotePool = sync.Pool{
+	New: func() interface{} { return &raft.RequestVoteRequest{} },
+}
+
+var snapshotRequestPool = sync.Pool{
+	New: func() interface{} { return &raft.SnapshotRequest{} },
+}
+
+// Returns an AppendEntries request to its pool, without the entries the log
+// may still be using.
+func releaseAppendEntries(req *raft.AppendEntriesRequest) {
+	req.Entries = nil
+	appendEntriesPool.Put(req)
+}
+
+// A pooledBody is an outgoing request body backed by a pooled buffer.  The
+// HTTP transport closes the body once it has finished writing it, even when
+// that happens after the response has been returned, so Close is the only
+// safe point to hand the buffer back.
+type pooledBody struct {
+	*bytes.Buffer
+	once sync.Once
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{Buffer: buf}
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() { putBuffer(b.Buffer) })
+	return nil
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+)
+
+// A PreVoteRequest asks whether a peer would grant its vote if the candidate
+// started an election for Term.  Unlike RequestVote it changes no state on
+// either side, so a node rejoining after a partition can learn that it would
+// lose without bumping every peer's term and disrupting the current leader.
+type PreVoteRequest struct {
+	Term          uint64
+	LastLogIndex  uint64
+	LastLogTerm   uint64
+	CandidateName string
+}
+
+type PreVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// A PreVoteServer supports the pre-vote phase.  raft.Server doesn't, so
+// Install only registers the PreVote route for servers that implement this,
+// typically a wrapper around raft.Server.  A cluster.Cluster installs such a
+// wrapper with SetServerExtension and polls its peers with PreVote.
+type PreVoteServer interface {
+	PreVote(req *PreVoteRequest) *PreVoteResponse
+}
+
+func (req *PreVoteRequest) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(req.Term)
+	m.uint64(req.LastLogIndex)
+	m.uint64(req.LastLogTerm)
+	m.string(req.CandidateName)
+	return m.result()
+}
+
+func (req *PreVoteRequest) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	req.Term = m.uint64()
+	req.LastLogIndex = m.uint64()
+	req.LastLogTerm = m.uint64()
+	req.CandidateName = m.string()
+	return m.result()
+}
+
+func (resp *PreVoteResponse) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(resp.Term)
+	m.bool(resp.VoteGranted)
+	return m.result()
+}
+
+func (resp *PreVoteResponse) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	resp.Term = m.uint64()
+	resp.VoteGranted = m.bool()
+	return m.result()
+}
+
+// Retrieves the PreVote path.
+func (t *HTTPTransporter) PreVotePath() string {
+	return t.preVotePath
+}
+
+// Sends a PreVote RPC to a peer.
+func (t *HTTPTransporter) SendPreVoteRequest(server raft.Server, peer *raft.Peer, req *PreVoteRequest) *PreVoteResponse {
+	resp := &PreVoteResponse{}
+	if err := t.send(server, peer, "pv", latencyLane, t.PreVotePath(), req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Handles incoming PreVote requests.
+func (t *HTTPTransporter) preVoteHandler(server raft.Server, pv PreVoteServer) http.HandlerFunc {
+	return t.handle(server, "pv", "/preVote",
+		func() decoder { return &PreVoteRequest{} },
+		func(req decoder) encoder {
+			return pv.PreVote(req.(*PreVoteRequest))
+		})
+}
@@ -0,0 +1,179 @@
+package transport
+
+import (
+	"sync"
+)
+
+// What to do with a send when a peer's queue is full.
+type QueuePolicy int
+
+const (
+	// Fail the new send, leaving the queue as it is.
+	RejectNew QueuePolicy = iota
+
+	// Fail the send that has waited longest and queue the new one.  Newer
+	// AppendEntries supersede older ones, so this keeps replication to a
+	// lagging peer current.
+	DropOldest
+)
+
+// A QueueConfig bounds the sends to each peer, with a separate queue for each
+// lane so a backlog of snapshot chunks never holds up AppendEntries.  Once
+// MaxInFlight sends to a peer on a lane are outstanding, further sends wait in
+// a queue of up to Depth; beyond that Policy decides which send fails.  A
+// failed send returns a nil response, as any other transport failure does, so
+// the Raft layer backs off rather than piling up blocked goroutines behind a
+// slow peer.  Votes are never queued: an election can't wait behind
+// replication, and dropping a vote in favour of a newer AppendEntries would
+// only delay it.
+type QueueConfig struct {
+	// Sends in flight to each peer on each lane at once.  Zero disables
+	// queueing.
+	MaxInFlight int
+
+	// Sends waiting for each peer on each lane beyond those in flight.
+	Depth int
+
+	Policy QueuePolicy
+
+	// Called, if set, for each send refused or dropped from a queue, with
+	// ErrQueueFull or ErrQueueDropped.
+	OnDrop func(peer, rpc string, err error)
+}
+
+// Both match ErrThrottled.
+var (
+	ErrQueueFull    error = &kindError{"Send queue is full", []error{ErrThrottled}}
+	ErrQueueDropped error = &kindError{"Dropped from send queue", []error{ErrThrottled}}
+)
+
+// RPCs that bypass the queues.
+var unqueuedRPCs = map[string]bool{
+	"rv": true,
+	"pv": true,
+}
+
+type sendQueues struct {
+	mutex sync.Mutex
+	cfg   QueueConfig
+	peers map[queueKey]*peerQueue
+}
+
+type queueKey struct {
+	name string
+	lane lane
+}
+
+type peerQueue struct {
+	inFlight int
+	waiting  []chan error
+}
+
+func newSendQueues() *sendQueues {
+	return &sendQueues{peers: make(map[queueKey]*peerQueue)}
+}
+
+// Retrieves the number of sends waiting in the named peer's queues.
+func (t *HTTPTransporter) QueueDepth(name string) int {
+	return t.queues.depth(name)
+}
+
+func (q *sendQueues) configure(cfg QueueConfig) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.cfg = cfg
+	for _, p := range q.peers {
+		q.dispatch(p)
+	}
+}
+
+func (q *sendQueues) get(key queueKey) *peerQueue {
+	p, ok := q.peers[key]
+	if !ok {
+		p = &peerQueue{}
+		q.peers[key] = p
+	}
+	return p
+}
+
+// Waits for a send slot to the named peer on a lane, returning a function to
+// release it once the send is done.
+func (q *sendQueues) acquire(name string, l lane, rpc string) (func(), error) {
+	q.mutex.Lock()
+	cfg := q.cfg
+	if cfg.MaxInFlight <= 0 || unqueuedRPCs[rpc] {
+		q.mutex.Unlock()
+		return func() {}, nil
+	}
+
+	key := queueKey{name, l}
+	p := q.get(key)
+	if p.inFlight < cfg.MaxInFlight && len(p.waiting) == 0 {
+		p.inFlight++
+		q.mutex.Unlock()
+		return func() { q.release(key) }, nil
+	}
+
+	var dropped chan error
+	if len(p.waiting) >= cfg.Depth {
+		if cfg.Policy != DropOldest || cfg.Depth == 0 {
+			q.mutex.Unlock()
+			q.dropped(cfg, name, rpc, ErrQueueFull)
+			return nil, ErrQueueFull
+		}
+		dropped = p.waiting[0]
+		p.waiting = p.waiting[1:]
+	}
+
+	ready := make(chan error, 1)
+	p.waiting = append(p.waiting, ready)
+	q.mutex.Unlock()
+
+	if dropped != nil {
+		dropped <- ErrQueueDropped
+	}
+	if err := <-ready; err != nil {
+		q.dropped(cfg, name, rpc, err)
+		return nil, err
+	}
+	return func() { q.release(key) }, nil
+}
+
+func (q *sendQueues) release(key queueKey) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	p := q.get(key)
+	p.inFlight--
+	q.dispatch(p)
+}
+
+// Starts as many waiting sends as there are free slots.  Must be called with
+// the mutex held.
+func (q *sendQueues) dispatch(p *peerQueue) {
+	for len(p.waiting) > 0 && (q.cfg.MaxInFlight <= 0 || p.inFlight < q.cfg.MaxInFlight) {
+		p.inFlight++
+		p.waiting[0] <- nil
+		p.waiting = p.waiting[1:]
+	}
+}
+
+func (q *sendQueues) dropped(cfg QueueConfig, name, rpc string, err error) {
+	if cfg.OnDrop != nil {
+		cfg.OnDrop(name, rpc, err)
+	}
+}
+
+func (q *sendQueues) depth(name string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	depth := 0
+	for key, p := range q.peers {
+		if key.name == name {
+			depth += len(p.waiting)
+		}
+	}
+	return depth
+}
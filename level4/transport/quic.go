@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"crypto/tls"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a QUIC connection may go without any traffic before it is
+	// considered dead.
+	quicIdleTimeout = 30 * time.Second
+
+	// How often an otherwise idle QUIC connection is pinged to keep NAT
+	// bindings and the idle timer alive.
+	quicKeepAlive = 5 * time.Second
+)
+
+// Sends RPCs over HTTP/3 instead of HTTP/1.1.  Each RPC travels on its own
+// QUIC stream of a single connection per peer, so a lost packet holds up only
+// the RPC it belongs to, and TLS session resumption lets a connection that
+// dropped be re-established with 0-RTT.  Peers must be serving with
+// ListenAndServeQUIC at the host and port of their connection strings; Unix
+// socket connection strings are not supported.
+func WithQUIC(tlsConfig *tls.Config) Option {
+	return func(t *HTTPTransporter) {
+		config := tlsConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+
+		t.quic = &http3.Transport{
+			TLSClientConfig: config,
+			QUICConfig:      newQUICConfig(),
+		}
+		rt := &clusterRoundTripper{t, &quicRoundTripper{t.quic}}
+		t.httpClient.Transport = rt
+		t.bulkClient.Transport = rt
+		t.hedgeClient.Transport = rt
+	}
+}
+
+// Serves handler, typically the mux the transporter was installed on, over
+// HTTP/3 on the UDP address addr.
+func ListenAndServeQUIC(addr string, tlsConfig *tls.Config, handler http.Handler) error {
+	server := &http3.Server{
+		Addr:       addr,
+		TLSConfig:  http3.ConfigureTLSConfig(tlsConfig),
+		QUICConfig: newQUICConfig(),
+		Handler:    handler,
+	}
+	return server.ListenAndServe()
+}
+
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  quicIdleTimeout,
+		KeepAlivePeriod: quicKeepAlive,
+		Allow0RTT:       true,
+	}
+}
+
+// Connection strings are http:// URLs, but HTTP/3 is only spoken over https.
+type quicRoundTripper struct {
+	rt *http3.Transport
+}
+
+func (q *quicRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "https"
+		req.Host = strings.TrimSuffix(req.Host, ":80")
+	}
+	return q.rt.RoundTrip(req)
+}
@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot transfers dwarf every other RPC, so on links billed by the byte
+// they are what's worth metering.  Request bodies of the snapshot RPCs (ss,
+// ssr and the chunked ssr.* transfers) are counted per peer, in total and
+// within a rolling window, and can be capped per window.
+
+// The accounting window used when a SnapshotQuota doesn't set one.
+const DefaultQuotaWindow = time.Hour
+
+// A SnapshotQuota caps the snapshot bytes exchanged with each peer per window.
+// Once a peer's cap is reached, snapshots to it fail with ErrQuotaExceeded
+// and snapshots from it are refused with 429 Too Many Requests until the
+// window rolls over.  The Raft layer retries failed snapshots, so a follower
+// catches up once the window resets.
+type SnapshotQuota struct {
+	// Length of the accounting window.  Zero uses DefaultQuotaWindow.
+	Window time.Duration
+
+	// Snapshot bytes that may be sent to and received from each peer per
+	// window.  Zero is unlimited.
+	MaxSent     int64
+	MaxReceived int64
+
+	// If positive, OnWarn is called the first time in a window that a peer's
+	// usage crosses this fraction of a cap.
+	WarnFraction float64
+	OnWarn       func(peer string, usage SnapshotUsage)
+}
+
+// The snapshot bytes exchanged with a peer.
+type SnapshotUsage struct {
+	// The current window and the bytes exchanged in it.
+	WindowStart time.Time
+	Sent        int64
+	Received    int64
+
+	// The bytes exchanged since the transporter started.
+	TotalSent     int64
+	TotalReceived int64
+}
+
+// Matches ErrThrottled.
+var ErrQuotaExceeded error = &kindError{"Snapshot quota exceeded", []error{ErrThrottled}}
+
+type snapshotQuotas struct {
+	mutex sync.Mutex
+	cfg   SnapshotQuota
+	peers map[string]*snapshotAccount
+}
+
+type snapshotAccount struct {
+	usage          SnapshotUsage
+	warnedSent     bool
+	warnedReceived bool
+}
+
+func newSnapshotQuotas() *snapshotQuotas {
+	return &snapshotQuotas{peers: make(map[string]*snapshotAccount)}
+}
+
+// Retrieves the snapshot bytes exchanged with each peer.
+func (t *HTTPTransporter) SnapshotUsage() map[string]SnapshotUsage {
+	return t.quotas.snapshot()
+}
+
+// Reports whether an RPC carries snapshot data.
+func isSnapshotRPC(rpc string) bool {
+	return rpc == "ss" || rpc == "ssr" || strings.HasPrefix(rpc, "ssr.")
+}
+
+func (q *snapshotQuotas) configure(cfg SnapshotQuota) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.cfg = cfg
+}
+
+func (q *snapshotQuotas) snapshot() map[string]SnapshotUsage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	usage := make(map[string]SnapshotUsage, len(q.peers))
+	for name, a := range q.peers {
+		q.roll(a, time.Now())
+		usage[name] = a.usage
+	}
+	return usage
+}
+
+// Returns the account for a peer with its window brought up to date.
+func (q *snapshotQuotas) get(name string) *snapshotAccount {
+	a, ok := q.peers[name]
+	if !ok {
+		a = &snapshotAccount{usage: SnapshotUsage{WindowStart: time.Now()}}
+		q.peers[name] = a
+	}
+	q.roll(a, time.Now())
+	return a
+}
+
+func (q *snapshotQuotas) roll(a *snapshotAccount, now time.Time) {
+	window := q.window()
+	if now.Sub(a.usage.WindowStart) < window {
+		return
+	}
+	a.usage.WindowStart = a.usage.WindowStart.Add(now.Sub(a.usage.WindowStart) / window * window)
+	a.usage.Sent = 0
+	a.usage.Received = 0
+	a.warnedSent = false
+	a.warnedReceived = false
+}
+
+func (q *snapshotQuotas) window() time.Duration {
+	if q.cfg.Window > 0 {
+		return q.cfg.Window
+	}
+	return DefaultQuotaWindow
+}
+
+// Checks that n more bytes may be sent to a peer.  n is negative if the size
+// isn't known yet, in which case only an exhausted quota refuses the send.
+func (q *snapshotQuotas) reserveSend(name string, n int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return exceeds(q.get(name).usage.Sent, n, q.cfg.MaxSent)
+}
+
+// Checks that a peer may send more bytes, returning how long until it may if
+// not.
+func (q *snapshotQuotas) admitReceive(name string) (time.Duration, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	a := q.get(name)
+	if err := exceeds(a.usage.Received, -1, q.cfg.MaxReceived); err != nil {
+		return a.usage.WindowStart.Add(q.window()).Sub(time.Now()), err
+	}
+	return 0, nil
+}
+
+func exceeds(used, n, max int64) error {
+	if max <= 0 {
+		return nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	if used >= max || used+n > max {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Records bytes sent to a peer.
+func (q *snapshotQuotas) sent(name string, n int64) {
+	q.add(name, n, 0)
+}
+
+// Records bytes received from a peer.
+func (q *snapshotQuotas) received(name string, n int64) {
+	q.add(name, 0, n)
+}
+
+func (q *snapshotQuotas) add(name string, sent, received int64) {
+	q.mutex.Lock()
+	a := q.get(name)
+	a.usage.Sent += sent
+	a.usage.TotalSent += sent
+	a.usage.Received += received
+	a.usage.TotalReceived += received
+
+	cfg := q.cfg
+	warn := false
+	if cfg.WarnFraction > 0 && cfg.OnWarn != nil {
+		if !a.warnedSent && crossed(a.usage.Sent, cfg.MaxSent, cfg.WarnFraction) {
+			a.warnedSent = true
+			warn = true
+		}
+		if !a.warnedReceived && crossed(a.usage.Received, cfg.MaxReceived, cfg.WarnFraction) {
+			a.warnedReceived = true
+			warn = true
+		}
+	}
+	usage := a.usage
+	q.mutex.Unlock()
+
+	if warn {
+		cfg.OnWarn(name, usage)
+	}
+}
+
+func crossed(used, max int64, fraction float64) bool {
+	return max > 0 && float64(used) >= fraction*float64(max)
+}
@@ -92,7 +92,13 @@ func (m *RaftListener) StartAccepting() error {
 	return nil
 }
 
+// Listens on addr, which may be a Unix socket path or a TCP address.  Unix
+// sockets are bound with DefaultUnixSocketOptions.
 func Listen(addr string) (net.Listener, error) {
+	return ListenWithOptions(addr, DefaultUnixSocketOptions)
+}
+
+func listen(addr string) (net.Listener, error) {
 	network := Network(addr)
 	log.Printf("Listening on %s: %s", network, addr)
 
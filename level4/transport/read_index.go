@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+)
+
+// A ReadIndexRequest asks the leader for an index that is safe to serve a
+// linearizable read at.  The leader confirms it still holds a quorum and
+// replies with its commit index; once the follower has applied that far it
+// can answer the read locally, without a log entry for the read.
+type ReadIndexRequest struct {
+	Term       uint64
+	ServerName string
+}
+
+type ReadIndexResponse struct {
+	Term      uint64
+	ReadIndex uint64
+	Success   bool
+}
+
+// A ReadIndexServer can confirm its leadership and report a read index.
+// raft.Server doesn't, so Install only registers the ReadIndex route for
+// servers that implement this, typically a wrapper around raft.Server.  A
+// cluster.Cluster installs such a wrapper with SetServerExtension and asks
+// for a read index with ReadIndex.
+type ReadIndexServer interface {
+	ReadIndex(req *ReadIndexRequest) *ReadIndexResponse
+}
+
+func (req *ReadIndexRequest) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(req.Term)
+	m.string(req.ServerName)
+	return m.result()
+}
+
+func (req *ReadIndexRequest) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	req.Term = m.uint64()
+	req.ServerName = m.string()
+	return m.result()
+}
+
+func (resp *ReadIndexResponse) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(resp.Term)
+	m.uint64(resp.ReadIndex)
+	m.bool(resp.Success)
+	return m.result()
+}
+
+func (resp *ReadIndexResponse) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	resp.Term = m.uint64()
+	resp.ReadIndex = m.uint64()
+	resp.Success = m.bool()
+	return m.result()
+}
+
+// Retrieves the ReadIndex path.
+func (t *HTTPTransporter) ReadIndexPath() string {
+	return t.readIndexPath
+}
+
+// Sends a ReadIndex RPC to a peer, normally the leader.
+func (t *HTTPTransporter) SendReadIndexRequest(server raft.Server, peer *raft.Peer, req *ReadIndexRequest) *ReadIndexResponse {
+	resp := &ReadIndexResponse{}
+	if err := t.send(server, peer, "ri", latencyLane, t.ReadIndexPath(), req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Handles incoming ReadIndex requests.
+func (t *HTTPTransporter) readIndexHandler(server raft.Server, ri ReadIndexServer) http.HandlerFunc {
+	return t.handle(server, "ri", "/readIndex",
+		func() decoder { return &ReadIndexRequest{} },
+		func(req decoder) encoder {
+			return ri.ReadIndex(req.(*ReadIndexRequest))
+		})
+}
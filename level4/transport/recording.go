@@ -0,0 +1,551 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/metcalf/raft"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Identifies one of the Raft RPCs.  The values match the request type bytes
+// of the BinaryTransporter wire format.
+type RPCType uint8
+
+const (
+	VoteRPC             RPCType = 1
+	AppendEntriesRPC    RPCType = 2
+	SnapshotRPC         RPCType = 3
+	SnapshotRecoveryRPC RPCType = 4
+)
+
+func (r RPCType) String() string {
+	switch r {
+	case VoteRPC:
+		return "requestVote"
+	case AppendEntriesRPC:
+		return "appendEntries"
+	case SnapshotRPC:
+		return "snapshot"
+	case SnapshotRecoveryRPC:
+		return "snapshotRecovery"
+	}
+	return fmt.Sprintf("rpc(%d)", uint8(r))
+}
+
+// Creates empty request and response messages for an RPC type.
+func newMessages(rpc RPCType) (decoder, decoder, error) {
+	switch rpc {
+	case VoteRPC:
+		return &raft.RequestVoteRequest{}, &raft.RequestVoteResponse{}, nil
+	case AppendEntriesRPC:
+		return &raft.AppendEntriesRequest{}, &raft.AppendEntriesResponse{}, nil
+	case SnapshotRPC:
+		return &raft.SnapshotRequest{}, &raft.SnapshotResponse{}, nil
+	case SnapshotRecoveryRPC:
+		return &raft.SnapshotRecoveryRequest{}, &raft.SnapshotRecoveryResponse{}, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown RPC type %d", uint8(rpc))
+}
+
+// Hands a decoded request to the matching server method.  Returns nil, not a
+// nil response of the RPC's type, if the server gave no response, as it
+// doesn't once stopped.
+func dispatch(server raft.Server, rpc RPCType, req decoder) encoder {
+	switch rpc {
+	case VoteRPC:
+		if resp := server.RequestVote(req.(*raft.RequestVoteRequest)); resp != nil {
+			return resp
+		}
+	case AppendEntriesRPC:
+		if resp := server.AppendEntries(req.(*raft.AppendEntriesRequest)); resp != nil {
+			return resp
+		}
+	case SnapshotRPC:
+		if resp := server.RequestSnapshot(req.(*raft.SnapshotRequest)); resp != nil {
+			return resp
+		}
+	case SnapshotRecoveryRPC:
+		if resp := server.SnapshotRecoveryRequest(req.(*raft.SnapshotRecoveryRequest)); resp != nil {
+			return resp
+		}
+	}
+	return nil
+}
+
+type Direction uint8
+
+const (
+	Outgoing Direction = 1
+	Incoming Direction = 2
+)
+
+// A Record is one RPC as seen by a server.  Request and Response hold the
+// encoded messages; Response is nil if the RPC failed.
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	RPC       RPCType
+	Peer      string
+	Request   []byte
+	Response  []byte
+}
+
+//------------------------------------------------------------------------------
+//
+// Recorder
+//
+//------------------------------------------------------------------------------
+
+// Records waiting to be written before a Recorder starts dropping them.
+const recorderQueueSize = 1024
+
+var ErrRecorderClosed = errors.New("Recorder is closed")
+
+// A Recorder appends Records to a trace file.  Records are written by a
+// background goroutine, which flushes whenever it runs out of records to
+// write, so RPCs never wait on the disk yet a trace still survives the crash
+// it is meant to explain, bar the last few records.  If the writer falls more
+// than recorderQueueSize records behind, new records are dropped and counted.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	records chan *Record
+	done    chan struct{}
+	closed  bool
+	dropped uint64
+	err     error
+}
+
+// Opens a trace file for appending, creating it if needed.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		file:    file,
+		records: make(chan *Record, recorderQueueSize),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Queues a record to be appended to the trace.  Returns the first error the
+// writer hit, if any.
+func (r *Recorder) Write(rec *Record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	select {
+	case r.records <- rec:
+	default:
+		r.dropped++
+	}
+	return r.err
+}
+
+// Retrieves the number of records dropped because the writer fell behind.
+func (r *Recorder) Dropped() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.dropped
+}
+
+// Writes the queued records and closes the trace file.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRecorderClosed
+	}
+	r.closed = true
+	close(r.records)
+	r.mutex.Unlock()
+
+	<-r.done
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	w := bufio.NewWriter(r.file)
+	for rec := range r.records {
+		err := writeRecord(w, rec)
+		if err == nil && len(r.records) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			r.mutex.Lock()
+			if r.err == nil {
+				r.err = err
+			}
+			r.mutex.Unlock()
+		}
+	}
+	w.Flush()
+}
+
+func (r *Recorder) record(dir Direction, rpc RPCType, peer string, req encoder, resp encoder, ok bool) {
+	rec := &Record{
+		Time:      time.Now(),
+		Direction: dir,
+		RPC:       rpc,
+		Peer:      peer,
+	}
+
+	var b bytes.Buffer
+	req.Encode(&b)
+	rec.Request = b.Bytes()
+
+	if ok {
+		var b bytes.Buffer
+		resp.Encode(&b)
+		rec.Response = b.Bytes()
+	}
+
+	r.Write(rec)
+}
+
+// Records are framed as: timestamp (int64 ns), direction (uint8), rpc
+// (uint8), peer (uint16 length + bytes), request (uint32 length + bytes),
+// response present (uint8) and response (uint32 length + bytes).
+func writeRecord(w io.Writer, rec *Record) error {
+	var hasResponse uint8
+	if rec.Response != nil {
+		hasResponse = 1
+	}
+
+	fields := []interface{}{
+		rec.Time.UnixNano(),
+		uint8(rec.Direction),
+		uint8(rec.RPC),
+		uint16(len(rec.Peer)), []byte(rec.Peer),
+		uint32(len(rec.Request)), rec.Request,
+		hasResponse,
+		uint32(len(rec.Response)), rec.Response,
+	}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRecord(r io.Reader) (*Record, error) {
+	var nanos int64
+	var dir, rpc, hasResponse uint8
+	var peerLen uint16
+	var reqLen, respLen uint32
+
+	if err := binary.Read(r, binary.BigEndian, &nanos); err != nil {
+		return nil, err
+	}
+
+	readBytes := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+
+	rec := &Record{Time: time.Unix(0, nanos)}
+	var peer []byte
+	var err error
+
+	steps := []func() error{
+		func() error { return binary.Read(r, binary.BigEndian, &dir) },
+		func() error { return binary.Read(r, binary.BigEndian, &rpc) },
+		func() error { return binary.Read(r, binary.BigEndian, &peerLen) },
+		func() error { peer, err = readBytes(int(peerLen)); return err },
+		func() error { return binary.Read(r, binary.BigEndian, &reqLen) },
+		func() error { rec.Request, err = readBytes(int(reqLen)); return err },
+		func() error { return binary.Read(r, binary.BigEndian, &hasResponse) },
+		func() error { return binary.Read(r, binary.BigEndian, &respLen) },
+		func() error { rec.Response, err = readBytes(int(respLen)); return err },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	rec.Direction = Direction(dir)
+	rec.RPC = RPCType(rpc)
+	rec.Peer = string(peer)
+	if hasResponse == 0 {
+		rec.Response = nil
+	}
+
+	return rec, nil
+}
+
+// Reads every record in a trace file.
+func LoadTrace(path string) ([]*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var records []*Record
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, fmt.Errorf("Trace %s corrupt after %d records: %s", path, len(records), err)
+		}
+		records = append(records, rec)
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Recording transporter and server
+//
+//------------------------------------------------------------------------------
+
+// A RecordingTransporter records every outgoing RPC, and its response, before
+// handing the response back to the server.
+type RecordingTransporter struct {
+	next     Transporter
+	recorder *Recorder
+}
+
+func NewRecordingTransporter(next Transporter, recorder *Recorder) *RecordingTransporter {
+	return &RecordingTransporter{next: next, recorder: recorder}
+}
+
+// Records outgoing RPCs as part of a Chain.
+func Recording(recorder *Recorder) Decorator {
+	return func(next Transporter) Transporter {
+		return NewRecordingTransporter(next, recorder)
+	}
+}
+
+func (t *RecordingTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	resp := t.next.SendVoteRequest(server, peer, req)
+	t.recorder.record(Outgoing, VoteRPC, peer.Name, req, resp, resp != nil)
+	return resp
+}
+
+func (t *RecordingTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	resp := t.next.SendAppendEntriesRequest(server, peer, req)
+	t.recorder.record(Outgoing, AppendEntriesRPC, peer.Name, req, resp, resp != nil)
+	return resp
+}
+
+func (t *RecordingTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	resp := t.next.SendSnapshotRequest(server, peer, req)
+	t.recorder.record(Outgoing, SnapshotRPC, peer.Name, req, resp, resp != nil)
+	return resp
+}
+
+func (t *RecordingTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	resp := t.next.SendSnapshotRecoveryRequest(server, peer, req)
+	t.recorder.record(Outgoing, SnapshotRecoveryRPC, peer.Name, req, resp, resp != nil)
+	return resp
+}
+
+// Wraps a server so the RPCs it receives are recorded.  Install the wrapped
+// server in place of the original to capture both sides of the traffic.
+func RecordServer(server raft.Server, recorder *Recorder) raft.Server {
+	return &recordingServer{server, recorder}
+}
+
+type recordingServer struct {
+	raft.Server
+	recorder *Recorder
+}
+
+func (s *recordingServer) RequestVote(req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	resp := s.Server.RequestVote(req)
+	s.recorder.record(Incoming, VoteRPC, req.CandidateName, req, resp, resp != nil)
+	return resp
+}
+
+func (s *recordingServer) AppendEntries(req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	resp := s.Server.AppendEntries(req)
+	s.recorder.record(Incoming, AppendEntriesRPC, req.LeaderName, req, resp, resp != nil)
+	return resp
+}
+
+func (s *recordingServer) RequestSnapshot(req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	resp := s.Server.RequestSnapshot(req)
+	s.recorder.record(Incoming, SnapshotRPC, req.LeaderName, req, resp, resp != nil)
+	return resp
+}
+
+func (s *recordingServer) SnapshotRecoveryRequest(req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	resp := s.Server.SnapshotRecoveryRequest(req)
+	s.recorder.record(Incoming, SnapshotRecoveryRPC, req.LeaderName, req, resp, resp != nil)
+	return resp
+}
+
+//------------------------------------------------------------------------------
+//
+// Replay
+//
+//------------------------------------------------------------------------------
+
+// A Mismatch is an incoming RPC whose response during replay differed from
+// the recorded one.  Response is nil if the server gave none.
+type Mismatch struct {
+	Index    int
+	Record   *Record
+	Response []byte
+}
+
+// A Replayer feeds a recorded trace back into a server: incoming requests are
+// delivered in their recorded order, and outgoing requests made by the server
+// are answered with the recorded responses to the same peer and RPC.
+type Replayer struct {
+	records []*Record
+	mutex   sync.Mutex
+	pending map[string][]*Record
+}
+
+func NewReplayer(records []*Record) *Replayer {
+	r := &Replayer{
+		records: records,
+		pending: make(map[string][]*Record),
+	}
+	for _, rec := range records {
+		if rec.Direction == Outgoing {
+			key := replayKey(rec.RPC, rec.Peer)
+			r.pending[key] = append(r.pending[key], rec)
+		}
+	}
+	return r
+}
+
+func replayKey(rpc RPCType, peer string) string {
+	return fmt.Sprintf("%d/%s", rpc, peer)
+}
+
+// Returns a Transporter that answers outgoing RPCs from the trace.  Pass it to
+// raft.NewServer for the server being replayed into.
+func (r *Replayer) Transporter() Transporter {
+	return &replayTransporter{r}
+}
+
+// Returns the next recorded response for an outgoing RPC, decoded into resp,
+// or false if the trace has none left or the recorded RPC failed.
+func (r *Replayer) respond(rpc RPCType, peer string, resp decoder) bool {
+	r.mutex.Lock()
+	key := replayKey(rpc, peer)
+	queue := r.pending[key]
+	if len(queue) == 0 {
+		r.mutex.Unlock()
+		return false
+	}
+	rec := queue[0]
+	r.pending[key] = queue[1:]
+	r.mutex.Unlock()
+
+	if rec.Response == nil {
+		return false
+	}
+	_, err := resp.Decode(bytes.NewReader(rec.Response))
+	return err == nil || err == io.EOF
+}
+
+// Delivers each incoming request in the trace to the server and reports the
+// responses that differ from those recorded.  With realtime set, the recorded
+// gaps between requests are reproduced.
+func (r *Replayer) Replay(server raft.Server, realtime bool) ([]Mismatch, error) {
+	var mismatches []Mismatch
+	var last time.Time
+
+	for i, rec := range r.records {
+		if rec.Direction != Incoming {
+			continue
+		}
+
+		if realtime && !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		req, _, err := newMessages(rec.RPC)
+		if err != nil {
+			return mismatches, err
+		}
+		if _, err := req.Decode(bytes.NewReader(rec.Request)); err != nil && err != io.EOF {
+			return mismatches, fmt.Errorf("Record %d: could not decode request: %s", i, err)
+		}
+
+		// A server that gives no response matches only a recorded failure.
+		var got []byte
+		if resp := dispatch(server, rec.RPC, req); resp != nil {
+			var b bytes.Buffer
+			resp.Encode(&b)
+			got = append([]byte{}, b.Bytes()...)
+		}
+		if (got == nil) != (rec.Response == nil) || !bytes.Equal(got, rec.Response) {
+			mismatches = append(mismatches, Mismatch{
+				Index:    i,
+				Record:   rec,
+				Response: got,
+			})
+		}
+	}
+
+	return mismatches, nil
+}
+
+type replayTransporter struct {
+	r *Replayer
+}
+
+func (t *replayTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	resp := &raft.RequestVoteResponse{}
+	if !t.r.respond(VoteRPC, peer.Name, resp) {
+		return nil
+	}
+	return resp
+}
+
+func (t *replayTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	resp := &raft.AppendEntriesResponse{}
+	if !t.r.respond(AppendEntriesRPC, peer.Name, resp) {
+		return nil
+	}
+	return resp
+}
+
+func (t *replayTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	resp := &raft.SnapshotResponse{}
+	if !t.r.respond(SnapshotRPC, peer.Name, resp) {
+		return nil
+	}
+	return resp
+}
+
+func (t *replayTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	resp := &raft.SnapshotRecoveryResponse{}
+	if !t.r.respond(SnapshotRecoveryRPC, peer.Name, resp) {
+		return nil
+	}
+	return resp
+}
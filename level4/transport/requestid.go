@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Every outgoing RPC carries an ID in requestIDHeader.  Sending the same
+// request object to the same peer again shortly afterwards, as Retry does
+// after an ambiguous failure, reuses its ID, and handlers answer a repeated ID
+// with the response they gave the first time instead of processing it again.
+// IDs also appear in the debug log on both ends for correlation.
+const requestIDHeader = "X-Raft-Request-Id"
+
+const (
+	// How long a sent request keeps its ID for resends.
+	resendWindow = 5 * time.Second
+
+	// How many sent requests are remembered for resends.
+	maxResends = 64
+
+	// How many processed requests a handler remembers.
+	maxProcessed = 1024
+)
+
+type requestIDs struct {
+	mu     sync.Mutex
+	prefix string
+	next   uint64
+	recent []sentRequest
+}
+
+type sentRequest struct {
+	peer string
+	req  encoder
+	id   string
+	at   time.Time
+}
+
+type processedRequests struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// A processedRequest is closed once its response is known.  If the original
+// failed, resp is nil and a repeat is processed afresh.
+type processedRequest struct {
+	id     string
+	done   chan struct{}
+	once   sync.Once
+	header http.Header
+	resp   []byte
+}
+
+func newRequestIDs() *requestIDs {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &requestIDs{prefix: hex.EncodeToString(b)}
+}
+
+// Returns the ID for sending req to peer, reusing the one it was last sent
+// with if that was recent.
+func (r *requestIDs) idFor(peer string, req encoder) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var id string
+	live := r.recent[:0]
+	for _, s := range r.recent {
+		if now.Sub(s.at) > resendWindow {
+			continue
+		}
+		if s.peer == peer && s.req == req {
+			id = s.id
+		}
+		live = append(live, s)
+	}
+	r.recent = live
+	if id != "" {
+		return id
+	}
+
+	r.next++
+	id = fmt.Sprintf("%s-%d", r.prefix, r.next)
+	r.recent = append(r.recent, sentRequest{peer, req, id, now})
+	if len(r.recent) > maxResends {
+		r.recent = append(r.recent[:0], r.recent[1:]...)
+	}
+
+	return id
+}
+
+func newProcessedRequests() *processedRequests {
+	return &processedRequests{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Starts processing the request with the given ID.  If it has been seen
+// before, returns the existing entry and true; the caller should wait on its
+// done channel rather than process the request again.
+func (p *processedRequests) begin(id string) (*processedRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.entries[id]; ok {
+		p.order.MoveToFront(el)
+		return el.Value.(*processedRequest), true
+	}
+
+	e := &processedRequest{id: id, done: make(chan struct{})}
+	p.entries[id] = p.order.PushFront(e)
+	for p.order.Len() > maxProcessed {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.entries, oldest.Value.(*processedRequest).id)
+	}
+
+	return e, false
+}
+
+// Records the response to a processed request, or nil if it failed.  Only
+// the first call has any effect.
+func (e *processedRequest) finish(header http.Header, resp []byte) {
+	e.once.Do(func() {
+		e.header = header
+		e.resp = resp
+		close(e.done)
+	})
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package transport
+
+import (
+	sysunix "golang.org/x/sys/unix"
+	"syscall"
+)
+
+// Sets SO_REUSEPORT on a socket before it is bound.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var err error
+	cerr := conn.Control(func(fd uintptr) {
+		err = sysunix.SetsockoptInt(int(fd), sysunix.SOL_SOCKET, sysunix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"errors"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"strconv"
+	"sync"
+)
+
+// Requests that carry Raft state to each peer are numbered per group and RPC
+// type, and the number is sent in this header.  A response is only passed
+// back to the server if no later request of the same type to the same peer
+// in the same group has been answered and the server's term hasn't changed
+// while it was in flight.  Otherwise retries, hedged votes and slow
+// connections could hand the server a response older than one it has already
+// acted on.  Other RPCs, such as ReadIndex and custom RPCs, are plain
+// request/response calls whose answers stand on their own, so concurrent
+// calls of them aren't numbered or discarded.
+const sequenceHeader = "X-Raft-Sequence"
+
+// The RPCs whose responses are numbered.
+var sequencedRPCs = map[string]bool{
+	"ae": true,
+	"cu": true,
+	"rv": true,
+	"pv": true,
+}
+
+// Returned in place of a response overtaken by a later one or by a change of
+// term.
+var ErrStaleResponse = errors.New("Stale response discarded")
+
+// Returned in place of a response discarded because the server's term changed
+// while it was outstanding.  It matches both ErrStaleResponse and
+// ErrTermMismatch.
+var errStaleTerm error = &kindError{"Stale response discarded after term change", []error{ErrStaleResponse, ErrTermMismatch}}
+
+type sequences struct {
+	mutex sync.Mutex
+	peers map[string]*sequence
+}
+
+type sequence struct {
+	next     uint64
+	answered uint64
+}
+
+func newSequences() *sequences {
+	return &sequences{peers: make(map[string]*sequence)}
+}
+
+func (s *sequences) get(group, peer, rpc string) *sequence {
+	key := group + " " + peer + " " + rpc
+	seq, ok := s.peers[key]
+	if !ok {
+		seq = &sequence{}
+		s.peers[key] = seq
+	}
+	return seq
+}
+
+// Numbers the next request of an RPC type to a peer in a group.
+func (s *sequences) start(group, peer, rpc string) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seq := s.get(group, peer, rpc)
+	seq.next++
+	return seq.next
+}
+
+// Records the response to request n, reporting whether it is the latest.
+func (s *sequences) answer(group, peer, rpc string, n uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seq := s.get(group, peer, rpc)
+	if n < seq.answered {
+		return false
+	}
+	seq.answered = n
+	return true
+}
+
+// Checks that the response to request n, sent in term, is still current.
+func (t *HTTPTransporter) checkFresh(server raft.Server, group, peer, rpc string, n, term uint64) error {
+	stale := ErrStaleResponse
+	if server.Term() != term {
+		stale = errStaleTerm
+	} else if t.sequences.answer(group, peer, rpc, n) {
+		return nil
+	}
+	debuglog.Debugln("transporter."+rpc+".stale.error:", peer, n)
+	t.stats.stale(rpc)
+	return stale
+}
+
+func formatSequence(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
@@ -0,0 +1,194 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/metcalf/raft"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeouts of the HTTP servers Serve starts.  Requests and responses have no
+// overall deadline, since a snapshot may take a long time to stream; the
+// transporter's own timeouts bound RPCs from the sending side.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultServeIdleTimeout  = 2 * time.Minute
+)
+
+// A ServeOption configures the server started by Serve.
+type ServeOption func(*serveConfig)
+
+type serveConfig struct {
+	unixSocket        UnixSocketOptions
+	reusePort         bool
+	admin             bool
+	noTLS             bool
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	handler           func(http.Handler) http.Handler
+}
+
+// An HTTPServer serves a transporter's routes on a listener of its own.
+type HTTPServer struct {
+	srv      *http.Server
+	listener net.Listener
+	done     chan struct{}
+	mutex    sync.Mutex
+	err      error
+}
+
+// Binds TCP listeners with SO_REUSEPORT, so several processes can listen on
+// the same port, as during a rolling restart.  Unsupported on some
+// platforms, where Serve fails.
+func ServeReusePort() ServeOption {
+	return func(c *serveConfig) {
+		c.reusePort = true
+	}
+}
+
+// Sets the options used when serving on a Unix socket.  Without this option,
+// DefaultUnixSocketOptions are used.
+func ServeUnixSocket(opts UnixSocketOptions) ServeOption {
+	return func(c *serveConfig) {
+		c.unixSocket = opts
+	}
+}
+
+// Serves the admin endpoints alongside the Raft routes.
+func ServeAdmin() ServeOption {
+	return func(c *serveConfig) {
+		c.admin = true
+	}
+}
+
+// Serves plain HTTP even if the transporter's configuration has TLS
+// material, as when TLS is terminated in front of the server.
+func ServeWithoutTLS() ServeOption {
+	return func(c *serveConfig) {
+		c.noTLS = true
+	}
+}
+
+// Sets how long a client may take to send request headers, and how long an
+// idle keep-alive connection is kept open.  Zero removes the limit.
+func ServeTimeouts(readHeader, idle time.Duration) ServeOption {
+	return func(c *serveConfig) {
+		c.readHeaderTimeout = readHeader
+		c.idleTimeout = idle
+	}
+}
+
+// Wraps the handler serving the routes, as with logging or auth middleware.
+func ServeMiddleware(middleware func(http.Handler) http.Handler) ServeOption {
+	return func(c *serveConfig) {
+		c.handler = middleware
+	}
+}
+
+// Listens on addr, a TCP address or Unix socket path, and serves the Raft
+// routes for a server there in the background, over TLS if the transporter's
+// configuration has TLS material.  Returns once the listener is bound, so
+// peers can be told to connect straight away.
+func (t *HTTPTransporter) Serve(addr string, server raft.Server, opts ...ServeOption) (*HTTPServer, error) {
+	cfg := &serveConfig{
+		unixSocket:        DefaultUnixSocketOptions,
+		readHeaderTimeout: DefaultReadHeaderTimeout,
+		idleTimeout:       DefaultServeIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	mux := http.NewServeMux()
+	t.Install(server, t.MethodMuxer(mux))
+	if cfg.admin {
+		t.InstallAdmin(server, t.MethodMuxer(mux))
+	}
+	var handler http.Handler = mux
+	if cfg.handler != nil {
+		handler = cfg.handler(mux)
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+	}
+	t.ConfigureServer(srv)
+
+	l, err := cfg.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.config().TLS != nil && !cfg.noTLS {
+		l = tls.NewListener(l, t.ServerTLSConfig())
+	}
+
+	s := &HTTPServer{srv: srv, listener: l, done: make(chan struct{})}
+	go s.serve()
+	return s, nil
+}
+
+func (c *serveConfig) listen(addr string) (net.Listener, error) {
+	if !c.reusePort || Network(addr) != "tcp" {
+		return ListenWithOptions(addr, c.unixSocket)
+	}
+
+	log.Printf("Listening on tcp with SO_REUSEPORT: %s", addr)
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func (s *HTTPServer) serve() {
+	err := s.srv.Serve(s.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	s.mutex.Lock()
+	s.err = err
+	s.mutex.Unlock()
+	close(s.done)
+}
+
+// Retrieves the address the server is listening on, with any port chosen by
+// the system filled in.
+func (s *HTTPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stops accepting connections and waits for requests in progress to finish
+// or ctx to expire, then closes the remaining connections.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		s.srv.Close()
+	}
+	<-s.done
+	return err
+}
+
+// Closes the listener and every connection immediately.
+func (s *HTTPServer) Close() error {
+	err := s.srv.Close()
+	<-s.done
+	return err
+}
+
+// Returns a channel closed once the server has stopped.
+func (s *HTTPServer) Done() <-chan struct{} {
+	return s.done
+}
+
+// Retrieves the error that stopped the server, or nil if it was shut down or
+// is still running.
+func (s *HTTPServer) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
@@ -0,0 +1,176 @@
+package transport
+
+import (
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AppendEntries to a peer can be spaced out, so a chronically slow replica
+// (across a WAN, say) is sent to less often than the heartbeat interval and
+// never has more than one AppendEntries outstanding, rather than tying up a
+// sender for every heartbeat that would otherwise pile up behind it.  A send
+// skipped for spacing fails without reaching the peer; Raft resends whatever
+// it carried with the next one.  Spacing is set per peer with
+// SetAppendEntriesInterval, or automatically for peers whose latency EWMA
+// exceeds Config.SlowPeers.Threshold.  Either way it is capped at half the
+// election timeout, so a spaced follower still hears from its leader in time.
+
+// The weight of each new sample in a peer's latency EWMA.
+const latencyEWMAWeight = 0.2
+
+// RPCs whose round trips feed the latency EWMA.  Snapshots take as long as
+// their size demands and votes are rare, so neither says how responsive a
+// replica is.
+var latencyRPCs = map[string]bool{
+	"ae": true,
+	"cu": true,
+}
+
+// Spacing applied to peers detected as slow.
+type SlowPeerPolicy struct {
+	// A peer is slow while the EWMA of its AppendEntries round trips
+	// exceeds this.  Zero disables detection.
+	Threshold time.Duration
+
+	// The least time between AppendEntries to a slow peer.  Zero uses twice
+	// the peer's EWMA.
+	Interval time.Duration
+}
+
+type peerSpacing struct {
+	mutex sync.Mutex
+	peers map[string]*spacedPeer
+}
+
+type spacedPeer struct {
+	interval time.Duration
+	skipped  uint64
+
+	// The last AppendEntries to the peer of each group.  Groups are separate
+	// Raft servers, so each is spaced separately.
+	groups map[string]*spacedSend
+}
+
+type spacedSend struct {
+	last     time.Time
+	inFlight bool
+}
+
+func newPeerSpacing() *peerSpacing {
+	return &peerSpacing{peers: make(map[string]*spacedPeer)}
+}
+
+func (s *peerSpacing) get(key string) *spacedPeer {
+	p, ok := s.peers[key]
+	if !ok {
+		p = &spacedPeer{groups: make(map[string]*spacedSend)}
+		s.peers[key] = p
+	}
+	return p
+}
+
+// Spaces AppendEntries to the named peer at least interval apart, whatever
+// its latency.  Zero returns the peer to automatic detection.
+func (t *HTTPTransporter) SetAppendEntriesInterval(name string, interval time.Duration) {
+	t.spacing.mutex.Lock()
+	defer t.spacing.mutex.Unlock()
+	t.spacing.get(name).interval = interval
+}
+
+// Retrieves the names of peers currently detected as slow, in order.
+func (t *HTTPTransporter) SlowPeers() []string {
+	threshold := t.config().SlowPeers.Threshold
+	if threshold <= 0 {
+		return nil
+	}
+
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+
+	var names []string
+	for name, p := range t.stats.peers {
+		if p.LatencyEWMA > threshold {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns how far apart AppendEntries to a peer must be, or zero if they
+// needn't be spaced.
+func (t *HTTPTransporter) appendEntriesInterval(server raft.Server, name string) time.Duration {
+	t.spacing.mutex.Lock()
+	var interval time.Duration
+	if p, ok := t.spacing.peers[name]; ok {
+		interval = p.interval
+	}
+	t.spacing.mutex.Unlock()
+
+	if interval <= 0 {
+		policy := t.config().SlowPeers
+		if policy.Threshold <= 0 {
+			return 0
+		}
+		ewma := t.stats.latencyEWMA(name)
+		if ewma <= policy.Threshold {
+			return 0
+		}
+		interval = policy.Interval
+		if interval <= 0 {
+			interval = 2 * ewma
+		}
+	}
+
+	if limit := server.ElectionTimeout() / 2; interval > limit {
+		interval = limit
+	}
+	return interval
+}
+
+// Admits an AppendEntries to a peer unless it comes too soon after the last
+// or one is still outstanding.  If admitted, the returned function must be
+// called once the RPC completes.
+func (t *HTTPTransporter) admitAppendEntries(server raft.Server, peer *raft.Peer) (func(), bool) {
+	interval := t.appendEntriesInterval(server, peer.Name)
+	group := groupOf(server)
+
+	t.spacing.mutex.Lock()
+	defer t.spacing.mutex.Unlock()
+
+	p := t.spacing.get(peer.Name)
+	send, ok := p.groups[group]
+	if !ok {
+		send = &spacedSend{}
+		p.groups[group] = send
+	}
+	now := time.Now()
+	if interval > 0 && (send.inFlight || now.Sub(send.last) < interval) {
+		p.skipped++
+		debuglog.Debugln("transporter.ae.spaced:", peer.Name, interval)
+		return nil, false
+	}
+	send.last = now
+	send.inFlight = true
+
+	return func() {
+		t.spacing.mutex.Lock()
+		send.inFlight = false
+		t.spacing.mutex.Unlock()
+	}, true
+}
+
+// Retrieves how many AppendEntries to the named peer were skipped for
+// spacing.
+func (s *peerSpacing) skipped(name string) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p, ok := s.peers[name]; ok {
+		return p.skipped
+	}
+	return 0
+}
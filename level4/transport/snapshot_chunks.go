@@ -0,0 +1,768 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Snapshot recovery requests are sent in content-addressed chunks so that a
+// transfer interrupted partway through can pick up where it left off:
+//
+//   1. The leader encodes the SnapshotRecoveryRequest to a spool file,
+//      splitting it into chunks as it goes, and sends a manifest listing each
+//      chunk's SHA-256.
+//   2. The follower replies with the chunks it doesn't already hold from a
+//      previous attempt.
+//   3. The leader sends only those chunks, which the follower verifies and
+//      stores under its raft path.
+//   4. The leader commits the manifest and the follower reassembles the
+//      request into a file and applies it.
+//
+// Chunks are read from and written to files as they are sent and received, so
+// neither side holds more of a snapshot in memory than raft itself needs to
+// encode or decode the request.
+//
+// Peers that don't serve the chunk routes are sent the request whole.
+//
+// A follower keeps the last request it applied as a base and reports its hash
+// in the manifest response.  If the leader still holds that base, it diffs the
+// new request against it and sends the delta through the same steps, with the
+// base named in the manifest's header.  Should anything go wrong with a delta
+// the leader falls back to sending the full request.  Both sides keep their
+// bases on disk.
+
+// The size of the chunks snapshot recovery requests are split into.
+var SnapshotChunkSize = 1 << 20
+
+// Names the base a chunked payload is a delta against on manifests, and the
+// base a follower holds on manifest responses.
+const snapshotBaseHeader = "X-Raft-Snapshot-Base"
+
+const basePrefix = "base-"
+
+// The follower reassembles a committed payload into a file of this name, and
+// a delta's target into one with the suffix.
+const (
+	assemblyName        = "assembly"
+	deltaAssemblySuffix = "-target"
+)
+
+var errChunkMismatch = errors.New("Snapshot chunk does not match its hash")
+
+// A SnapshotManifest lists, in order, the hashes of the chunks making up an
+// encoded SnapshotRecoveryRequest, or a delta against Base if it is set.
+type SnapshotManifest struct {
+	LeaderName string
+	Size       uint64
+	Chunks     [][]byte
+	Base       []byte
+}
+
+// A SnapshotManifestResponse lists the indices into the manifest of the
+// chunks the follower still needs, and the hash of the base it holds.
+type SnapshotManifestResponse struct {
+	Missing []uint64
+	Base    []byte
+}
+
+// A chunked payload ready to send, spooled to a file.
+type snapshotPayload struct {
+	manifest *SnapshotManifest
+	file     *os.File
+	hash     []byte
+	kept     bool
+}
+
+// Writes a payload to its spool file, hashing it whole and in chunks.
+type payloadWriter struct {
+	p     *snapshotPayload
+	w     *bufio.Writer
+	whole hash.Hash
+	chunk hash.Hash
+	n     int
+}
+
+type SnapshotChunk struct {
+	Hash []byte
+	Data []byte
+}
+
+type SnapshotChunkResponse struct {
+	Success bool
+}
+
+// Chunks are stored one file per chunk, named by hash, alongside the base in a
+// file named by basePrefix and its hash.
+type chunkStore struct {
+	mu  sync.Mutex
+	dir string
+
+	// Held through a commit, which uses the assembly files.
+	commit sync.Mutex
+}
+
+//------------------------------------------------------------------------------
+//
+// Encoding
+//
+//------------------------------------------------------------------------------
+
+func (m *SnapshotManifest) Encode(w io.Writer) (int, error) {
+	mw := &messageWriter{w: w}
+	mw.string(m.LeaderName)
+	mw.uint64(m.Size)
+	mw.uint64(uint64(len(m.Chunks)))
+	for _, hash := range m.Chunks {
+		mw.bytes(hash)
+	}
+	return mw.result()
+}
+
+func (m *SnapshotManifest) Decode(r io.Reader) (int, error) {
+	mr := &messageReader{r: r}
+	m.LeaderName = mr.string()
+	m.Size = mr.uint64()
+	count := mr.count(4)
+	m.Chunks = nil
+	for i := uint64(0); i < count && mr.err == nil; i++ {
+		m.Chunks = append(m.Chunks, mr.bytes())
+	}
+	return mr.result()
+}
+
+func (m *SnapshotManifest) writeHeader(h http.Header) {
+	if len(m.Base) > 0 {
+		h.Set(snapshotBaseHeader, hex.EncodeToString(m.Base))
+	}
+}
+
+func (m *SnapshotManifest) readHeader(h http.Header) {
+	m.Base, _ = hex.DecodeString(h.Get(snapshotBaseHeader))
+}
+
+func (resp *SnapshotManifestResponse) writeHeader(h http.Header) {
+	if len(resp.Base) > 0 {
+		h.Set(snapshotBaseHeader, hex.EncodeToString(resp.Base))
+	}
+}
+
+func (resp *SnapshotManifestResponse) readHeader(h http.Header) {
+	resp.Base, _ = hex.DecodeString(h.Get(snapshotBaseHeader))
+}
+
+func (resp *SnapshotManifestResponse) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(uint64(len(resp.Missing)))
+	for _, index := range resp.Missing {
+		m.uint64(index)
+	}
+	return m.result()
+}
+
+func (resp *SnapshotManifestResponse) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	count := m.count(8)
+	resp.Missing = nil
+	for i := uint64(0); i < count && m.err == nil; i++ {
+		resp.Missing = append(resp.Missing, m.uint64())
+	}
+	return m.result()
+}
+
+func (c *SnapshotChunk) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.bytes(c.Hash)
+	m.bytes(c.Data)
+	return m.result()
+}
+
+func (c *SnapshotChunk) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	c.Hash = m.bytes()
+	c.Data = m.bytes()
+	return m.result()
+}
+
+func (resp *SnapshotChunkResponse) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.bool(resp.Success)
+	return m.result()
+}
+
+func (resp *SnapshotChunkResponse) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	resp.Success = m.bool()
+	return m.result()
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the snapshot manifest path.
+func (t *HTTPTransporter) SnapshotManifestPath() string {
+	return joinPath(t.snapshotChunksPath, "/manifest")
+}
+
+// Retrieves the snapshot chunk path.
+func (t *HTTPTransporter) SnapshotChunkPath() string {
+	return joinPath(t.snapshotChunksPath, "/chunk")
+}
+
+// Retrieves the snapshot commit path.
+func (t *HTTPTransporter) SnapshotCommitPath() string {
+	return joinPath(t.snapshotChunksPath, "/commit")
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Outgoing
+//--------------------------------------
+
+// Sends a SnapshotRecoveryRequest as chunks, skipping those the peer already
+// holds and sending a delta if the peer holds a base this server kept.
+func (t *HTTPTransporter) sendSnapshotChunks(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) (*raft.SnapshotRecoveryResponse, error) {
+	spool := filepath.Join(server.Path(), "snapshot-spool")
+	full, err := spoolPayload(server, spool, func(w io.Writer) error {
+		_, err := req.Encode(w)
+		return err
+	})
+	if err != nil {
+		debuglog.Debugln("transporter.ssr.encoding.error:", err)
+		return nil, err
+	}
+	defer full.close()
+
+	missing := &SnapshotManifestResponse{}
+	if err := t.send(server, peer, "ssr.manifest", bulkLane, t.SnapshotManifestPath(), full.manifest, missing); err != nil {
+		return nil, err
+	}
+
+	if base, size := t.bases.open(missing.Base); base != nil {
+		delta, err := spoolPayload(server, spool, func(w io.Writer) error {
+			return makeDelta(base, size, full.file, int64(full.manifest.Size), full.hash, w)
+		})
+		base.Close()
+		if err != nil {
+			debuglog.Debugln("transporter.ssr.delta.error:", err)
+		} else {
+			defer delta.close()
+			delta.manifest.Base = missing.Base
+
+			if delta.manifest.Size < full.manifest.Size/2 {
+				resp, err := t.sendSnapshotPayload(server, peer, delta, nil)
+				if err == nil {
+					t.keepBase(server, full)
+					return resp, nil
+				}
+				debuglog.Debugf("Could not send snapshot delta to %s, sending whole: %s", peer.Name, err)
+				missing = nil
+			}
+		}
+	}
+
+	resp, err := t.sendSnapshotPayload(server, peer, full, missing)
+	if err != nil {
+		return nil, err
+	}
+	t.keepBase(server, full)
+
+	return resp, nil
+}
+
+// Keeps a payload sent in full as a base to diff later payloads against.
+func (t *HTTPTransporter) keepBase(server raft.Server, p *snapshotPayload) {
+	if path, err := p.keep(); err == nil {
+		t.bases.add(p.hash, path, int64(p.manifest.Size), filepath.Join(server.Path(), "snapshot-bases"))
+	}
+}
+
+// Sends the chunks of a payload the peer is missing and commits it.  If
+// missing is nil, the payload's manifest is sent first to find out.
+func (t *HTTPTransporter) sendSnapshotPayload(server raft.Server, peer *raft.Peer, payload *snapshotPayload, missing *SnapshotManifestResponse) (*raft.SnapshotRecoveryResponse, error) {
+	manifest := payload.manifest
+	if missing == nil {
+		missing = &SnapshotManifestResponse{}
+		if err := t.send(server, peer, "ssr.manifest", bulkLane, t.SnapshotManifestPath(), manifest, missing); err != nil {
+			return nil, err
+		}
+		if len(manifest.Base) > 0 && !bytes.Equal(missing.Base, manifest.Base) {
+			return nil, fmt.Errorf("Peer no longer holds snapshot base %x", manifest.Base)
+		}
+	}
+	debuglog.Debugf("Sending %d of %d snapshot chunks to %s", len(missing.Missing), len(manifest.Chunks), peer.Name)
+
+	for _, index := range missing.Missing {
+		if index >= uint64(len(manifest.Chunks)) {
+			return nil, fmt.Errorf("Peer asked for snapshot chunk %d of %d", index, len(manifest.Chunks))
+		}
+
+		data, err := payload.chunk(index)
+		if err != nil {
+			return nil, err
+		}
+		chunk := &SnapshotChunk{Hash: manifest.Chunks[index], Data: data}
+		resp := &SnapshotChunkResponse{}
+		if err := t.send(server, peer, "ssr.chunk", bulkLane, t.SnapshotChunkPath(), chunk, resp); err != nil {
+			return nil, err
+		}
+		if !resp.Success {
+			return nil, fmt.Errorf("Peer rejected snapshot chunk %d", index)
+		}
+	}
+
+	resp := &raft.SnapshotRecoveryResponse{}
+	if err := t.send(server, peer, "ssr.commit", bulkLane, t.SnapshotCommitPath(), manifest, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Spools the payload encode writes to a file in dir, building the manifest of
+// its chunks as it is written.
+func spoolPayload(server raft.Server, dir string, encode func(io.Writer) error) (*snapshotPayload, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir, "payload-")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &snapshotPayload{
+		manifest: &SnapshotManifest{LeaderName: server.Name()},
+		file:     file,
+	}
+	w := &payloadWriter{p: p, w: bufio.NewWriter(file), whole: sha256.New(), chunk: sha256.New()}
+	err = encode(w)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	w.cut()
+	p.hash = w.whole.Sum(nil)
+
+	return p, nil
+}
+
+func (w *payloadWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := SnapshotChunkSize - w.n
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := w.w.Write(b[:n]); err != nil {
+			return written, err
+		}
+		w.whole.Write(b[:n])
+		w.chunk.Write(b[:n])
+		w.n += n
+		written += n
+		b = b[n:]
+
+		if w.n == SnapshotChunkSize {
+			w.cut()
+		}
+	}
+	return written, nil
+}
+
+// Ends the current chunk, adding it to the manifest.
+func (w *payloadWriter) cut() {
+	if w.n == 0 {
+		return
+	}
+	w.p.manifest.Chunks = append(w.p.manifest.Chunks, w.chunk.Sum(nil))
+	w.p.manifest.Size += uint64(w.n)
+	w.chunk.Reset()
+	w.n = 0
+}
+
+// Reads a chunk of the payload back from its file.
+func (p *snapshotPayload) chunk(index uint64) ([]byte, error) {
+	off := index * uint64(SnapshotChunkSize)
+	n := p.manifest.Size - off
+	if n > uint64(SnapshotChunkSize) {
+		n = uint64(SnapshotChunkSize)
+	}
+	b := make([]byte, n)
+	if _, err := p.file.ReadAt(b, int64(off)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Closes the payload's file and returns its path, leaving it for the caller.
+func (p *snapshotPayload) keep() (string, error) {
+	p.kept = true
+	return p.file.Name(), p.file.Close()
+}
+
+// Closes and removes the payload's file, unless it was kept.
+func (p *snapshotPayload) close() {
+	if p.kept {
+		return
+	}
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+// Reports whether a peer is known not to serve the chunk routes.
+func (t *HTTPTransporter) chunksRefused(peer *raft.Peer) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.noChunks[peer.Name]
+}
+
+func (t *HTTPTransporter) refuseChunks(peer *raft.Peer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.noChunks[peer.Name] = true
+}
+
+//--------------------------------------
+// Incoming
+//--------------------------------------
+
+// Handles incoming snapshot manifests.
+func (t *HTTPTransporter) snapshotManifestHandler(server raft.Server, store *chunkStore) http.HandlerFunc {
+	return t.handle(server, "ssr.manifest", "/snapshotChunks/manifest",
+		func() decoder { return &SnapshotManifest{} },
+		func(req decoder) encoder {
+			return &SnapshotManifestResponse{
+				Missing: store.missing(req.(*SnapshotManifest)),
+				Base:    store.baseHash(),
+			}
+		})
+}
+
+// Handles incoming snapshot chunks.
+func (t *HTTPTransporter) snapshotChunkHandler(server raft.Server, store *chunkStore) http.HandlerFunc {
+	return t.handle(server, "ssr.chunk", "/snapshotChunks/chunk",
+		func() decoder { return &SnapshotChunk{} },
+		func(req decoder) encoder {
+			chunk := req.(*SnapshotChunk)
+			if err := store.put(chunk.Hash, chunk.Data); err != nil {
+				debuglog.Debugln("transporter.ssr.chunk.store.error:", err)
+				return &SnapshotChunkResponse{Success: false}
+			}
+			return &SnapshotChunkResponse{Success: true}
+		})
+}
+
+// Handles incoming snapshot commits.  Unlike the other handlers, a commit
+// can fail after it has been decoded, if a chunk it names has gone missing.
+func (t *HTTPTransporter) snapshotCommitHandler(server raft.Server, store *chunkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		debuglog.DebugTagln("transporter.ssr.commit.recv", server.Name(), "RECV", "/snapshotChunks/commit")
+
+		limited := limitBody(w, r, t.config().MaxRequestSize)
+		body, err := t.requestBody(r, limited)
+		if err != nil {
+			rejectRequest(w, "ssr.commit", limited.cause(err))
+			return
+		}
+
+		manifest := &SnapshotManifest{}
+		err = decodeRequest("ssr.commit", r, body, manifest, true)
+		t.stats.received("ssr.commit", err)
+		if err != nil {
+			if cerr, ok := err.(*ChecksumError); ok {
+				checksumFailed(w, cerr)
+				return
+			}
+			rejectRequest(w, "ssr.commit", limited.cause(err))
+			return
+		}
+
+		manifest.readHeader(r.Header)
+
+		store.commit.Lock()
+		defer store.commit.Unlock()
+
+		payload, err := store.assemble(manifest, assemblyName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		defer payload.Close()
+
+		if len(manifest.Base) > 0 {
+			base, size := store.base(manifest.Base)
+			if base == nil {
+				http.Error(w, "Snapshot base is no longer held", http.StatusPreconditionFailed)
+				return
+			}
+			defer base.Close()
+
+			delta := payload
+			if payload, err = store.create(assemblyName + deltaAssemblySuffix); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer payload.Close()
+
+			out := bufio.NewWriter(payload)
+			err = applyDelta(base, size, delta, out, t.config().MaxSnapshotSize)
+			if err == nil {
+				err = out.Flush()
+			}
+			if err == nil {
+				_, err = payload.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		req := &raft.SnapshotRecoveryRequest{}
+		if _, err := req.Decode(bufio.NewReader(payload)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b := getBuffer()
+		defer putBuffer(b)
+
+		resp := server.SnapshotRecoveryRequest(req)
+		if resp == nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if _, err := resp.Encode(b); err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		store.retain(nil)
+		if resp.Success {
+			store.saveBase(payload)
+		}
+
+		t.writeResponse(w, r, "ssr.commit", nil, b.Bytes())
+	}
+}
+
+//--------------------------------------
+// Chunk store
+//--------------------------------------
+
+func newChunkStore(server raft.Server) *chunkStore {
+	return &chunkStore{dir: filepath.Join(server.Path(), "snapshot-chunks")}
+}
+
+func (s *chunkStore) path(hash []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(hash))
+}
+
+// Returns the indices of the manifest's chunks that aren't stored, and
+// discards any stored chunks the manifest doesn't mention.
+func (s *chunkStore) missing(manifest *SnapshotManifest) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExcept(manifest.Chunks)
+
+	missing := []uint64{}
+	for i, hash := range manifest.Chunks {
+		if _, err := os.Stat(s.path(hash)); err != nil {
+			missing = append(missing, uint64(i))
+		}
+	}
+	return missing
+}
+
+// Verifies a chunk against its hash and stores it.
+func (s *chunkStore) put(hash, data []byte) error {
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], hash) {
+		return errChunkMismatch
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a chunk interrupted partway through
+	// is never mistaken for a complete one.
+	tmp, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(hash))
+}
+
+// Creates, or truncates, a file in the store for reassembling a payload.
+func (s *chunkStore) create(name string) (*os.File, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(s.dir, name))
+}
+
+// Copies the manifest's chunks in order into the named file, checking each
+// against its hash, and returns the file ready to read back.
+func (s *chunkStore) assemble(manifest *SnapshotManifest, name string) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.create(name)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		f.Close()
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	var size uint64
+	for i, hash := range manifest.Chunks {
+		chunk, err := ioutil.ReadFile(s.path(hash))
+		if err != nil {
+			return fail(fmt.Errorf("Missing snapshot chunk %d: %s", i, err))
+		}
+		if sum := sha256.Sum256(chunk); !bytes.Equal(sum[:], hash) {
+			os.Remove(s.path(hash))
+			return fail(errChunkMismatch)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return fail(err)
+		}
+		size += uint64(len(chunk))
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	if size != manifest.Size {
+		return fail(fmt.Errorf("Assembled snapshot is %d bytes, expected %d", size, manifest.Size))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return f, nil
+}
+
+// Removes every stored chunk not in keep.
+func (s *chunkStore) retain(keep [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExcept(keep)
+}
+
+func (s *chunkStore) removeExcept(keep [][]byte) {
+	names, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	wanted := make(map[string]bool, len(keep))
+	for _, hash := range keep {
+		wanted[hex.EncodeToString(hash)] = true
+	}
+	for _, info := range names {
+		name := info.Name()
+		if !wanted[name] && !strings.HasPrefix(name, basePrefix) && !strings.HasPrefix(name, assemblyName) {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+}
+
+// Returns the hash of the held base, or nil if there is none.
+func (s *chunkStore) baseHash() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, _ := filepath.Glob(filepath.Join(s.dir, basePrefix+"*"))
+	if len(names) == 0 {
+		return nil
+	}
+	hash, _ := hex.DecodeString(strings.TrimPrefix(filepath.Base(names[0]), basePrefix))
+	return hash
+}
+
+// Opens the held base if it has the given hash, returning it and its size.
+func (s *chunkStore) base(hash []byte) (*os.File, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(filepath.Join(s.dir, basePrefix+hex.EncodeToString(hash)))
+	if err != nil {
+		return nil, 0
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil || !bytes.Equal(h.Sum(nil), hash) {
+		f.Close()
+		return nil, 0
+	}
+	return f, size
+}
+
+// Replaces the held base with an applied payload, moving its file.
+func (s *chunkStore) saveBase(payload *os.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := sha256.New()
+	_, err := payload.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(h, payload)
+	}
+	if err != nil {
+		debuglog.Debugln("transporter.ssr.base.error:", err)
+		return
+	}
+	name := filepath.Join(s.dir, basePrefix+hex.EncodeToString(h.Sum(nil)))
+
+	old, _ := filepath.Glob(filepath.Join(s.dir, basePrefix+"*"))
+	if err := os.Rename(payload.Name(), name); err != nil {
+		debuglog.Debugln("transporter.ssr.base.error:", err)
+		return
+	}
+	for _, o := range old {
+		if o != name {
+			os.Remove(o)
+		}
+	}
+}
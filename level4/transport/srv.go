@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection strings of the form dns+srv://_raft._tcp.node1.example.com name
+// a DNS SRV record rather than an address.  The record is looked up when
+// first used and again every SRVRefreshInterval, so a node rescheduled onto a
+// new host is found again without changing its connection string.
+const srvScheme = "dns+srv://"
+
+var SRVRefreshInterval = 30 * time.Second
+
+func isSRV(connectionString string) bool {
+	return strings.HasPrefix(connectionString, srvScheme)
+}
+
+type srvEntry struct {
+	base    string
+	expires time.Time
+}
+
+// An srvResolver maps dns+srv connection strings to http:// base URLs.
+type srvResolver struct {
+	mutex    sync.Mutex
+	entries  map[string]*srvEntry
+	onChange func()
+	lookup   func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+// onChange is called whenever a record resolves to a different address than
+// before, so the caller can drop connections to the old one.
+func newSRVResolver(onChange func()) *srvResolver {
+	return &srvResolver{
+		entries:  make(map[string]*srvEntry),
+		onChange: onChange,
+		lookup:   net.LookupSRV,
+	}
+}
+
+// Returns the base URL for a connection string, resolving it if it is a
+// dns+srv one.  If a lookup fails, the last known address is used until a
+// lookup succeeds.
+func (r *srvResolver) resolve(connectionString string) (string, error) {
+	if !isSRV(connectionString) {
+		return connectionString, nil
+	}
+
+	r.mutex.Lock()
+	entry := r.entries[connectionString]
+	r.mutex.Unlock()
+
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.base, nil
+	}
+
+	base, err := r.lookupBase(strings.TrimPrefix(connectionString, srvScheme))
+	if err != nil {
+		if entry != nil {
+			debuglog.Debugf("SRV lookup of %s failed, using %s: %s", connectionString, entry.base, err)
+			return entry.base, nil
+		}
+		return "", err
+	}
+
+	r.mutex.Lock()
+	changed := entry != nil && entry.base != base
+	r.entries[connectionString] = &srvEntry{
+		base:    base,
+		expires: time.Now().Add(SRVRefreshInterval),
+	}
+	r.mutex.Unlock()
+
+	if changed {
+		debuglog.Debugf("%s moved from %s to %s", connectionString, entry.base, base)
+		if r.onChange != nil {
+			r.onChange()
+		}
+	}
+
+	return base, nil
+}
+
+// Forces the next resolve of a connection string to look it up again, e.g.
+// after a request to its current address failed.
+func (r *srvResolver) invalidate(connectionString string) {
+	if !isSRV(connectionString) {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if entry := r.entries[connectionString]; entry != nil {
+		entry.expires = time.Time{}
+	}
+}
+
+func (r *srvResolver) lookupBase(name string) (string, error) {
+	// LookupSRV sorts records by priority and shuffles them by weight, so the
+	// first one is the preferred target.
+	_, records, err := r.lookup("", "", name)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("No SRV records for %s", name)
+	}
+
+	target := strings.TrimSuffix(records[0].Target, ".")
+	return "http://" + net.JoinHostPort(target, strconv.Itoa(int(records[0].Port))), nil
+}
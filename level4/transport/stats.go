@@ -0,0 +1,252 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many recent latencies are kept per peer for PeerStats.
+const latencySamples = 128
+
+// Counters for a single RPC type.  Sent and Failed count outgoing requests,
+// with Stale counting the failures whose responses were discarded as stale
+// and Fenced those whose responses were refused for a regressed term;
+// Received and Rejected count incoming requests, with Rejected covering those
+// that could not be decoded.
+type RPCStats struct {
+	Sent     uint64 `json:"sent"`
+	Failed   uint64 `json:"failed"`
+	Stale    uint64 `json:"stale"`
+	Fenced   uint64 `json:"fenced"`
+	Received uint64 `json:"received"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// The state of outgoing RPCs to a single peer.  Latencies are over the most
+// recent RPCs, successful or not; bytes count request and response bodies.
+// The latency EWMA only follows completed AppendEntries and commit update
+// round trips, from posting the request to decoding the response, so time
+// spent queued or throttled and failures that never reach the peer don't
+// skew it.  Slow reports whether the EWMA exceeds Config.SlowPeers.Threshold,
+// and Spaced counts the AppendEntries skipped to space them out.
+type PeerStats struct {
+	LastContact         time.Time     `json:"lastContact"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	InFlight            int           `json:"inFlight"`
+	Queued              int           `json:"queued"`
+	Unreachable         bool          `json:"unreachable"`
+	MeanLatency         time.Duration `json:"meanLatency"`
+	P95Latency          time.Duration `json:"p95Latency"`
+	LatencyEWMA         time.Duration `json:"latencyEWMA"`
+	Slow                bool          `json:"slow"`
+	Spaced              uint64        `json:"spaced"`
+	BytesSent           int64         `json:"bytesSent"`
+	BytesReceived       int64         `json:"bytesReceived"`
+}
+
+type transportStats struct {
+	mu     sync.Mutex
+	rpcs   map[string]*RPCStats
+	peers  map[string]*peerStats
+	phases map[string]*rpcPhases
+}
+
+type peerStats struct {
+	PeerStats
+	latencies []time.Duration
+	next      int
+}
+
+// A sentCounter counts the bytes of a request body the HTTP transport has
+// read, which for a streamed body may still be happening in another goroutine.
+type sentCounter struct {
+	r io.Reader
+	n int64
+}
+
+func newTransportStats() *transportStats {
+	return &transportStats{
+		rpcs:   make(map[string]*RPCStats),
+		peers:  make(map[string]*peerStats),
+		phases: make(map[string]*rpcPhases),
+	}
+}
+
+// Retrieves the state of outgoing RPCs to the named peer.  The second result
+// is false if nothing has been sent to it.
+func (t *HTTPTransporter) PeerStats(name string) (PeerStats, bool) {
+	stats, ok := t.stats.peer(name)
+	stats.Queued = t.queues.depth(name)
+	stats.Unreachable = t.unreachable.unreachable(name)
+	stats.Spaced = t.spacing.skipped(name)
+	if threshold := t.config().SlowPeers.Threshold; threshold > 0 {
+		stats.Slow = stats.LatencyEWMA > threshold
+	}
+	return stats, ok
+}
+
+func (s *transportStats) get(rpc string) *RPCStats {
+	st, ok := s.rpcs[rpc]
+	if !ok {
+		st = &RPCStats{}
+		s.rpcs[rpc] = st
+	}
+	return st
+}
+
+func (s *transportStats) sent(rpc string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.get(rpc)
+	st.Sent++
+	if err != nil {
+		st.Failed++
+	}
+}
+
+func (s *transportStats) stale(rpc string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.get(rpc).Stale++
+}
+
+func (s *transportStats) fenced(rpc string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.get(rpc).Fenced++
+}
+
+func (s *transportStats) received(rpc string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.get(rpc)
+	st.Received++
+	if err != nil {
+		st.Rejected++
+	}
+}
+
+func (s *transportStats) snapshot() map[string]RPCStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]RPCStats, len(s.rpcs))
+	for rpc, st := range s.rpcs {
+		out[rpc] = *st
+	}
+	return out
+}
+
+func (s *transportStats) getPeer(name string) *peerStats {
+	p, ok := s.peers[name]
+	if !ok {
+		p = &peerStats{}
+		s.peers[name] = p
+	}
+	return p
+}
+
+// Notes the start of an RPC to a peer, returning the start time to pass to
+// finish.
+func (s *transportStats) start(peer string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.getPeer(peer).InFlight++
+	return time.Now()
+}
+
+// Notes the end of an RPC to a peer.  A non-zero round trip is fed to the
+// latency EWMA.
+func (s *transportStats) finish(peer string, start time.Time, err error, sent, received int64, roundTrip time.Duration) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.getPeer(peer)
+	p.InFlight--
+	p.BytesSent += sent
+	p.BytesReceived += received
+	// A stale response still shows the peer is up.
+	if err == nil || errors.Is(err, ErrStaleResponse) {
+		p.LastContact = now
+		p.ConsecutiveFailures = 0
+	} else {
+		p.ConsecutiveFailures++
+	}
+
+	latency := now.Sub(start)
+	if len(p.latencies) < latencySamples {
+		p.latencies = append(p.latencies, latency)
+	} else {
+		p.latencies[p.next] = latency
+		p.next = (p.next + 1) % latencySamples
+	}
+	if roundTrip <= 0 {
+		return
+	}
+	if p.LatencyEWMA == 0 {
+		p.LatencyEWMA = roundTrip
+	} else {
+		p.LatencyEWMA += time.Duration(latencyEWMAWeight * float64(roundTrip-p.LatencyEWMA))
+	}
+}
+
+// Retrieves the EWMA of a peer's AppendEntries round trips, or zero if none
+// has completed.
+func (s *transportStats) latencyEWMA(name string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.peers[name]; ok {
+		return p.LatencyEWMA
+	}
+	return 0
+}
+
+func (s *transportStats) peer(name string) (PeerStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[name]
+	if !ok {
+		return PeerStats{}, false
+	}
+
+	stats := p.PeerStats
+	if len(p.latencies) > 0 {
+		sorted := append([]time.Duration(nil), p.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		var total time.Duration
+		for _, l := range sorted {
+			total += l
+		}
+		stats.MeanLatency = total / time.Duration(len(sorted))
+		stats.P95Latency = sorted[(len(sorted)*95-1)/100]
+	}
+
+	return stats, true
+}
+
+func (c *sentCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *sentCounter) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"compress/gzip"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"io"
+	"net/http"
+)
+
+// A readCloser reads from one reader and closes another, for wrapping a
+// request body without hiding its Close from the HTTP transport.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Returns a body that encodes req as it is read.  If the transport stops
+// reading early it closes the body, which fails the encoder's next write and
+// ends the goroutine.
+//
+// The body is compressed if compress is set, and its ratio recorded in
+// ratios.  Its checksum, taken before compression, is only known once it has been encoded, so it is sent as a
+// trailer.  The returned trailer must be set as the request's Trailer before
+// sending.  Its value is filled in in place, rather than by setting the
+// map key, since the transport reads the map's keys while the body streams.
+func streamBody(rpc string, req encoder, cfg *Config, compress bool, ratios *compressionRatios) (io.ReadCloser, http.Header) {
+	pr, pw := io.Pipe()
+	trailer := http.Header{checksumHeader: []string{""}}
+
+	go func() {
+		var w io.Writer = pw
+		var z *gzip.Writer
+		compressed := &byteCounter{w: pw}
+		if compress {
+			z, _ = gzip.NewWriterLevel(compressed, cfg.compressionLevel())
+			w = z
+		}
+
+		sum := newChecksum()
+		raw, err := req.Encode(io.MultiWriter(w, sum))
+		if err == nil && z != nil {
+			err = z.Close()
+			ratios.observe(rpc, int64(raw), compressed.n, cfg)
+		}
+		if err != nil && err != io.ErrClosedPipe {
+			debuglog.Debugln("transporter."+rpc+".encoding.error:", err)
+		}
+		if err == nil {
+			trailer[checksumHeader][0] = formatChecksum(sum.Sum32())
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, trailer
+}
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// A TruncatedResponseError reports a response body that ended before its
+// Content-Length, or that was empty when a message was expected.
+type TruncatedResponseError struct {
+	RPC      string
+	Expected int64 // -1 if the peer didn't send a Content-Length
+	Received int64
+}
+
+func (e *TruncatedResponseError) Error() string {
+	if e.Expected < 0 {
+		return fmt.Sprintf("Truncated %s response: received %d bytes", e.RPC, e.Received)
+	}
+	return fmt.Sprintf("Truncated %s response: received %d of %d bytes",
+		e.RPC, e.Received, e.Expected)
+}
+
+func (e *TruncatedResponseError) Is(target error) bool {
+	return target == ErrDecodeFailure
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// A limitedBody caps a request body with http.MaxBytesReader and remembers
+// whether it was cut off, which a decoder reading it may report as a mere
+// unexpected EOF.
+type limitedBody struct {
+	io.ReadCloser
+	max      int64
+	tooLarge *http.MaxBytesError
+}
+
+// Caps the decompressed bytes of a body at the same limit as its wire bytes.
+type decompressedBody struct {
+	r io.Reader
+	b *limitedBody
+	n int64
+}
+
+func limitBody(w http.ResponseWriter, r *http.Request, max int64) *limitedBody {
+	if max <= 0 {
+		return nil
+	}
+	b := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, max), max: max}
+	r.Body = b
+	return b
+}
+
+// Returns r, the decompressed body, cut off like the body itself once more
+// than the limit has been read, so a few compressed bytes can't expand
+// without bound.
+func (b *limitedBody) decompressed(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &decompressedBody{r: r, b: b}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		errors.As(err, &b.tooLarge)
+	}
+	return n, err
+}
+
+func (d *decompressedBody) Read(p []byte) (int, error) {
+	if d.b.tooLarge != nil {
+		return 0, d.b.tooLarge
+	}
+	// Reading one byte past the limit tells a body that ends exactly at it
+	// from one that goes on.
+	if left := d.b.max + 1 - d.n; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	if d.n > d.b.max {
+		d.b.tooLarge = &http.MaxBytesError{Limit: d.b.max}
+		return n - 1, d.b.tooLarge
+	}
+	return n, err
+}
+
+// Returns the error to report for a failure reading the body: the limit, if
+// the body exceeded it, or else err.
+func (b *limitedBody) cause(err error) error {
+	if b != nil && b.tooLarge != nil {
+		return b.tooLarge
+	}
+	return err
+}
+
+// Builds a RequestError from an unsuccessful response, or returns nil.
+func checkStatus(httpResp *http.Response) error {
+	if httpResp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 512))
+	return &RequestError{
+		StatusCode: httpResp.StatusCode,
+		Message:    body,
+		kind:       responseKind(httpResp),
+	}
+}
+
+// Checks that a response body was complete, given the error from decoding it
+// and the number of body bytes the decoder consumed.
+func validateResponse(rpc string, httpResp *http.Response, received int64, decodeErr error) error {
+	if decodeErr != nil && decodeErr != io.EOF && decodeErr != io.ErrUnexpectedEOF {
+		return &DecodeError{RPC: rpc, Direction: "response", Err: decodeErr}
+	}
+
+	expected := httpResp.ContentLength
+	if decodeErr != nil || received == 0 || (expected >= 0 && received < expected) {
+		return &TruncatedResponseError{
+			RPC:      rpc,
+			Expected: expected,
+			Received: received,
+		}
+	}
+
+	return nil
+}
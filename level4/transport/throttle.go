@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Size of the chunks in which throttled request bodies are read.  Keeping this
+// small lets a large snapshot body interleave with heartbeats instead of
+// claiming a big block of the byte budget at once.
+const throttleChunkSize = 16 * 1024
+
+// A Limit caps outbound traffic.  Zero values mean unlimited.  BytesPerSec
+// only counts request bodies on the bulk lane, so AppendEntries and votes
+// never sleep off debt run up by a snapshot; RPCsPerSec counts every RPC.
+type Limit struct {
+	BytesPerSec int64
+	RPCsPerSec  float64
+}
+
+// A tokenBucket refills at rate tokens per second up to burst.  Callers take
+// tokens up front and sleep off any resulting debt, so concurrent callers are
+// served roughly in arrival order.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	// One second worth of burst, but never less than a chunk so a single
+	// read can always be satisfied after waiting.
+	burst := rate
+	if burst < throttleChunkSize {
+		burst = throttleChunkSize
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Takes n tokens and returns how long the caller must wait before using them.
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type limiter struct {
+	bytes *tokenBucket
+	rpcs  *tokenBucket
+}
+
+func newLimiter(limit Limit) *limiter {
+	return &limiter{
+		bytes: newTokenBucket(float64(limit.BytesPerSec)),
+		rpcs:  newTokenBucket(limit.RPCsPerSec),
+	}
+}
+
+// Applies the global limit and any per-peer limits to outbound requests.
+type throttle struct {
+	mutex  sync.RWMutex
+	global *limiter
+	peers  map[string]*limiter
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		global: newLimiter(Limit{}),
+		peers:  make(map[string]*limiter),
+	}
+}
+
+func (t *throttle) setGlobal(limit Limit) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.global = newLimiter(limit)
+}
+
+func (t *throttle) setPeer(name string, limit Limit) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if limit == (Limit{}) {
+		delete(t.peers, name)
+	} else {
+		t.peers[name] = newLimiter(limit)
+	}
+}
+
+func (t *throttle) limiters(name string) (*limiter, *limiter) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.global, t.peers[name]
+}
+
+func (t *throttle) wait(name string, n float64, bucket func(*limiter) *tokenBucket) {
+	global, peer := t.limiters(name)
+
+	delay := bucket(global).take(n)
+	if peer != nil {
+		if d := bucket(peer).take(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Blocks until an RPC to the named peer is allowed.
+func (t *throttle) waitRPC(name string) {
+	t.wait(name, 1, func(l *limiter) *tokenBucket { return l.rpcs })
+}
+
+// Wraps a request body so reading it consumes byte tokens for the named peer.
+func (t *throttle) reader(name string, r io.Reader) io.Reader {
+	global, peer := t.limiters(name)
+	if global.bytes == nil && (peer == nil || peer.bytes == nil) {
+		return r
+	}
+	return &throttledReader{r: r, name: name, throttle: t}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	name     string
+	throttle *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.throttle.wait(r.name, float64(n), func(l *limiter) *tokenBucket { return l.bytes })
+	}
+	return n, err
+}
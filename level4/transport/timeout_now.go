@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"io"
+	"net/http"
+)
+
+// A TimeoutNowRequest asks a follower to start an election immediately,
+// without waiting for its election timeout.  A leader sends it to a caught-up
+// follower to hand off leadership, e.g. before shutting down for a deploy.
+type TimeoutNowRequest struct {
+	Term       uint64
+	LeaderName string
+}
+
+type TimeoutNowResponse struct {
+	Term    uint64
+	Success bool
+}
+
+// A TimeoutNowServer supports leadership transfer.  raft.Server doesn't, so
+// Install only registers the TimeoutNow route for servers that implement this,
+// typically a wrapper around raft.Server that can start its election.  A
+// cluster.Cluster installs such a wrapper with SetServerExtension and sends
+// the request from TransferLeadership.
+type TimeoutNowServer interface {
+	TimeoutNow(req *TimeoutNowRequest) *TimeoutNowResponse
+}
+
+func (req *TimeoutNowRequest) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(req.Term)
+	m.string(req.LeaderName)
+	return m.result()
+}
+
+func (req *TimeoutNowRequest) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	req.Term = m.uint64()
+	req.LeaderName = m.string()
+	return m.result()
+}
+
+func (resp *TimeoutNowResponse) Encode(w io.Writer) (int, error) {
+	m := &messageWriter{w: w}
+	m.uint64(resp.Term)
+	m.bool(resp.Success)
+	return m.result()
+}
+
+func (resp *TimeoutNowResponse) Decode(r io.Reader) (int, error) {
+	m := &messageReader{r: r}
+	resp.Term = m.uint64()
+	resp.Success = m.bool()
+	return m.result()
+}
+
+// Retrieves the TimeoutNow path.
+func (t *HTTPTransporter) TimeoutNowPath() string {
+	return t.timeoutNowPath
+}
+
+// Sends a TimeoutNow RPC to a peer.
+func (t *HTTPTransporter) SendTimeoutNowRequest(server raft.Server, peer *raft.Peer, req *TimeoutNowRequest) *TimeoutNowResponse {
+	resp := &TimeoutNowResponse{}
+	if err := t.send(server, peer, "tn", latencyLane, t.TimeoutNowPath(), req, resp); err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Handles incoming TimeoutNow requests.
+func (t *HTTPTransporter) timeoutNowHandler(server raft.Server, tn TimeoutNowServer) http.HandlerFunc {
+	return t.handle(server, "tn", "/timeoutNow",
+		func() decoder { return &TimeoutNowRequest{} },
+		func(req decoder) encoder {
+			return tn.TimeoutNow(req.(*TimeoutNowRequest))
+		})
+}
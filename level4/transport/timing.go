@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The header a handler reports how long it spent processing a request in, in
+// microseconds.  Subtracting it from the POST time separates network time from
+// time spent in the state machine.
+const serverTimeHeader = "X-Raft-Server-Time"
+
+// The upper bounds of the latency histogram buckets.  Larger latencies fall in
+// an implicit +Inf bucket.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// A latency histogram.  As in Prometheus, bucket counts are cumulative: each
+// counts the observations no larger than its upper bound.
+type Histogram struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     time.Duration     `json:"sum"`
+}
+
+type HistogramBucket struct {
+	UpperBound time.Duration `json:"upperBound"`
+	Count      uint64        `json:"count"`
+}
+
+// The time outgoing RPCs of one type spend in each phase.  Post runs from
+// sending the request to receiving the response headers, including dialing;
+// it splits into Server, the time the peer reports it spent processing the
+// request, and Network, the rest.  Streamed requests are encoded while they
+// are posted, so they have no Encode observations, and RPCs sent over a
+// WebSocket are not broken down at all.
+type PhaseStats struct {
+	Encode  Histogram `json:"encode"`
+	Post    Histogram `json:"post"`
+	Server  Histogram `json:"server"`
+	Network Histogram `json:"network"`
+	Decode  Histogram `json:"decode"`
+}
+
+type phase int
+
+const (
+	phaseEncode phase = iota
+	phasePost
+	phaseServer
+	phaseNetwork
+	phaseDecode
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"encode", "post", "server", "network", "decode"}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+type rpcPhases [numPhases]histogram
+
+// Retrieves the per-phase latency histograms of outgoing RPCs, keyed by RPC.
+func (t *HTTPTransporter) PhaseStats() map[string]PhaseStats {
+	return t.stats.phaseSnapshot()
+}
+
+// Notes how long an outgoing RPC spent in a phase.
+func (s *transportStats) observe(rpc string, p phase, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phases, ok := s.phases[rpc]
+	if !ok {
+		phases = &rpcPhases{}
+		s.phases[rpc] = phases
+	}
+
+	h := &phases[p]
+	if h.counts == nil {
+		h.counts = make([]uint64, len(LatencyBuckets))
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += d
+}
+
+// Notes the phases of a response: the POST, and the server and network time
+// within it if the peer reported its processing time.
+func (s *transportStats) observePost(rpc string, post time.Duration, resp *http.Response) {
+	s.observe(rpc, phasePost, post)
+
+	us, err := strconv.ParseInt(resp.Header.Get(serverTimeHeader), 10, 64)
+	if err != nil {
+		return
+	}
+	server := time.Duration(us) * time.Microsecond
+	s.observe(rpc, phaseServer, server)
+	s.observe(rpc, phaseNetwork, post-server)
+}
+
+func (s *transportStats) phaseSnapshot() map[string]PhaseStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]PhaseStats, len(s.phases))
+	for rpc, phases := range s.phases {
+		out[rpc] = PhaseStats{
+			Encode:  phases[phaseEncode].export(),
+			Post:    phases[phasePost].export(),
+			Server:  phases[phaseServer].export(),
+			Network: phases[phaseNetwork].export(),
+			Decode:  phases[phaseDecode].export(),
+		}
+	}
+	return out
+}
+
+func (h *histogram) export() Histogram {
+	out := Histogram{
+		Buckets: make([]HistogramBucket, len(LatencyBuckets)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+
+	var cumulative uint64
+	for i, bound := range LatencyBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		out.Buckets[i] = HistogramBucket{bound, cumulative}
+	}
+	return out
+}
+
+// Sets the header reporting how long a handler took.
+func setServerTime(w http.ResponseWriter, start time.Time) {
+	us := time.Since(start).Microseconds()
+	w.Header().Set(serverTimeHeader, strconv.FormatInt(us, 10))
+}
+
+// Writes the RPC counters and phase histograms in the Prometheus text
+// exposition format.
+func (t *HTTPTransporter) WritePrometheus(w io.Writer) error {
+	stats := t.Stats()
+	phases := t.PhaseStats()
+
+	rpcs := make([]string, 0, len(stats))
+	for rpc := range stats {
+		rpcs = append(rpcs, rpc)
+	}
+	sort.Strings(rpcs)
+
+	counters := []struct {
+		name, help string
+		value      func(RPCStats) uint64
+	}{
+		{"raft_transport_rpcs_sent_total", "Outgoing RPCs.", func(s RPCStats) uint64 { return s.Sent }},
+		{"raft_transport_rpcs_failed_total", "Outgoing RPCs that failed.", func(s RPCStats) uint64 { return s.Failed }},
+		{"raft_transport_rpcs_stale_total", "Outgoing RPCs whose responses were discarded as stale.", func(s RPCStats) uint64 { return s.Stale }},
+		{"raft_transport_rpcs_fenced_total", "Outgoing RPCs whose responses were refused for a regressed term.", func(s RPCStats) uint64 { return s.Fenced }},
+		{"raft_transport_rpcs_received_total", "Incoming RPCs.", func(s RPCStats) uint64 { return s.Received }},
+		{"raft_transport_rpcs_rejected_total", "Incoming RPCs that could not be decoded.", func(s RPCStats) uint64 { return s.Rejected }},
+	}
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+			return err
+		}
+		for _, rpc := range rpcs {
+			if _, err := fmt.Fprintf(w, "%s{rpc=%q} %d\n", c.name, rpc, c.value(stats[rpc])); err != nil {
+				return err
+			}
+		}
+	}
+
+	const name = "raft_transport_rpc_phase_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Time outgoing RPCs spend in each phase.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+
+	rpcs = rpcs[:0]
+	for rpc := range phases {
+		rpcs = append(rpcs, rpc)
+	}
+	sort.Strings(rpcs)
+
+	for _, rpc := range rpcs {
+		ps := phases[rpc]
+		for i, h := range []Histogram{ps.Encode, ps.Post, ps.Server, ps.Network, ps.Decode} {
+			labels := fmt.Sprintf("rpc=%q,phase=%q", rpc, phaseNames[i])
+			for _, b := range h.Buckets {
+				if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, b.UpperBound.Seconds(), b.Count); err != nil {
+					return err
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %g\n%s_count{%s} %d\n",
+				name, labels, h.Count, name, labels, h.Sum.Seconds(), name, labels, h.Count); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"github.com/metcalf/raft"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Transporter carries Raft RPCs to peers.  It has the same method set as
+// raft.Transporter, so any Transporter can be handed to raft.NewServer, but
+// lets decorators and alternative transports be written against this package
+// alone.  A method returns nil if the RPC failed.
+type Transporter interface {
+	SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse
+	SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse
+	SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse
+	SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse
+}
+
+var _ Transporter = (*HTTPTransporter)(nil)
+var _ Transporter = (*BinaryTransporter)(nil)
+
+// A Decorator wraps a Transporter to layer on behavior such as metrics,
+// retries or fault injection.  Decorators that only care about some RPCs can
+// embed the wrapped Transporter and override just those methods.
+type Decorator func(Transporter) Transporter
+
+// Wraps base in the given decorators.  The first decorator is the outermost:
+// it sees each request first and each response last.
+func Chain(base Transporter, decorators ...Decorator) Transporter {
+	t := base
+	for i := len(decorators) - 1; i >= 0; i-- {
+		t = decorators[i](t)
+	}
+	return t
+}
+
+//------------------------------------------------------------------------------
+//
+// Retry
+//
+//------------------------------------------------------------------------------
+
+// Retries failed RPCs up to attempts more times, waiting backoff between
+// tries.  Votes and AppendEntries are cheap to repeat, but keep attempts
+// times backoff well under the election timeout or a retried heartbeat will
+// arrive too late to matter.
+func Retry(attempts int, backoff time.Duration) Decorator {
+	return func(next Transporter) Transporter {
+		return &retryTransporter{next, attempts, backoff}
+	}
+}
+
+type retryTransporter struct {
+	next     Transporter
+	attempts int
+	backoff  time.Duration
+}
+
+func (t *retryTransporter) retry(send func() bool) {
+	for i := 0; i <= t.attempts; i++ {
+		if i > 0 {
+			time.Sleep(t.backoff)
+		}
+		if send() {
+			return
+		}
+	}
+}
+
+func (t *retryTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) (resp *raft.RequestVoteResponse) {
+	t.retry(func() bool {
+		resp = t.next.SendVoteRequest(server, peer, req)
+		return resp != nil
+	})
+	return
+}
+
+func (t *retryTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) (resp *raft.AppendEntriesResponse) {
+	t.retry(func() bool {
+		resp = t.next.SendAppendEntriesRequest(server, peer, req)
+		return resp != nil
+	})
+	return
+}
+
+func (t *retryTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) (resp *raft.SnapshotResponse) {
+	t.retry(func() bool {
+		resp = t.next.SendSnapshotRequest(server, peer, req)
+		return resp != nil
+	})
+	return
+}
+
+func (t *retryTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) (resp *raft.SnapshotRecoveryResponse) {
+	t.retry(func() bool {
+		resp = t.next.SendSnapshotRecoveryRequest(server, peer, req)
+		return resp != nil
+	})
+	return
+}
+
+//------------------------------------------------------------------------------
+//
+// Fault injection
+//
+//------------------------------------------------------------------------------
+
+// Describes the faults InjectFaults adds to outgoing RPCs.
+type FaultConfig struct {
+	// Probability in [0, 1] that an RPC is dropped without being sent.
+	DropRate float64
+	// Each RPC is delayed by a random duration up to MaxDelay.
+	MaxDelay time.Duration
+	// Seeds the random source, so a run can be reproduced.
+	Seed int64
+}
+
+// Drops and delays outgoing RPCs at random, for exercising failure handling.
+func InjectFaults(config FaultConfig) Decorator {
+	return func(next Transporter) Transporter {
+		return &faultTransporter{
+			next:   next,
+			config: config,
+			rand:   rand.New(rand.NewSource(config.Seed)),
+		}
+	}
+}
+
+type faultTransporter struct {
+	next   Transporter
+	config FaultConfig
+	mutex  sync.Mutex
+	rand   *rand.Rand
+}
+
+// Reports whether to deliver the next RPC, after sleeping for its delay.
+func (t *faultTransporter) deliver() bool {
+	t.mutex.Lock()
+	drop := t.rand.Float64() < t.config.DropRate
+	var delay time.Duration
+	if t.config.MaxDelay > 0 {
+		delay = time.Duration(t.rand.Int63n(int64(t.config.MaxDelay)))
+	}
+	t.mutex.Unlock()
+
+	time.Sleep(delay)
+	return !drop
+}
+
+func (t *faultTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	if !t.deliver() {
+		return nil
+	}
+	return t.next.SendVoteRequest(server, peer, req)
+}
+
+func (t *faultTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	if !t.deliver() {
+		return nil
+	}
+	return t.next.SendAppendEntriesRequest(server, peer, req)
+}
+
+func (t *faultTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	if !t.deliver() {
+		return nil
+	}
+	return t.next.SendSnapshotRequest(server, peer, req)
+}
+
+func (t *faultTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	if !t.deliver() {
+		return nil
+	}
+	return t.next.SendSnapshotRecoveryRequest(server, peer, req)
+}
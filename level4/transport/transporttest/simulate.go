@@ -0,0 +1,217 @@
+package transporttest
+
+import (
+	"github.com/metcalf/ctf3/level4/transport"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Simulation runs a cluster over a transport.MemoryNetwork through a
+// schedule of writes, partitions, crashes and snapshots drawn from a seed.
+// Each step applies the events drawn for it and then lets the cluster run
+// for Step.
+//
+// The network's delays run on a transport.VirtualClock that advances by Step
+// after each step, so every delayed RPC is delivered in the same step on every
+// run with the same seed.  Raft's election and heartbeat timers live in the
+// raft library and run on the wall clock, which the simulation can only
+// compress by shrinking the election timeout and heartbeat interval so that
+// hundreds of elections' worth of activity take seconds.  The schedule of
+// events and the faults on each link are reproducible from the seed, so a
+// failing seed replays the same scenario, but since raft's timers and
+// goroutine scheduling aren't virtualized a rerun isn't guaranteed to fail
+// the same way.
+type Simulation struct {
+	Seed  int64
+	Nodes int
+
+	// Number of steps, and how long each lasts.  Zero runs 200 steps of
+	// 5ms.
+	Steps int
+	Step  time.Duration
+
+	// Raft timing.  Zero uses a 50ms election timeout and 10ms heartbeats.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+
+	// Faults injected into every link.
+	Faults transport.MemoryFaults
+
+	// Chances of each event happening in a step.  A partition splits the
+	// servers into two random groups; a heal reconnects them.  A crash stops
+	// a random running server; a restart brings back a stopped one.  At most
+	// a minority of servers are down at once.
+	WriteRate     float64
+	PartitionRate float64
+	HealRate      float64
+	CrashRate     float64
+	RestartRate   float64
+	SnapshotRate  float64
+
+	// Directory to keep logs in.  Empty uses a temporary directory.
+	Dir string
+}
+
+// Reasonable rates for a simulation with frequent faults.
+var DefaultSimulation = Simulation{
+	Nodes:         5,
+	WriteRate:     0.8,
+	PartitionRate: 0.02,
+	HealRate:      0.1,
+	CrashRate:     0.02,
+	RestartRate:   0.1,
+	SnapshotRate:  0.01,
+}
+
+// Runs a simulation, then heals the network, restarts every server and checks
+// the invariants as Run does.
+func Simulate(sim Simulation) (*Report, error) {
+	if sim.Steps <= 0 {
+		sim.Steps = 200
+	}
+	if sim.Step <= 0 {
+		sim.Step = 5 * time.Millisecond
+	}
+	if sim.ElectionTimeout <= 0 {
+		sim.ElectionTimeout = 50 * time.Millisecond
+	}
+	if sim.HeartbeatInterval <= 0 {
+		sim.HeartbeatInterval = 10 * time.Millisecond
+	}
+
+	c, err := Start(Config{
+		Nodes:             sim.Nodes,
+		Network:           "memory",
+		Seed:              sim.Seed,
+		ElectionTimeout:   sim.ElectionTimeout,
+		HeartbeatInterval: sim.HeartbeatInterval,
+		Dir:               sim.Dir,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Faults start once the cluster has formed.
+	clock := transport.NewVirtualClock()
+	c.network.SetClock(clock)
+	c.network.SetFaults(sim.Faults)
+
+	report := &Report{}
+	start := time.Now()
+	rnd := rand.New(rand.NewSource(sim.Seed))
+	var writes sync.WaitGroup
+	var counts sync.Mutex
+
+	for step := 0; step < sim.Steps; step++ {
+		// Every draw is made whether or not its event happens, so each
+		// step's choices don't depend on the cluster's state.
+		write, partition, heal := rnd.Float64(), rnd.Float64(), rnd.Float64()
+		crash, restart, snapshot := rnd.Float64(), rnd.Float64(), rnd.Float64()
+		pick, split := rnd.Intn(len(c.nodes)), rnd.Perm(len(c.nodes))
+
+		if write < sim.WriteRate {
+			writes.Add(1)
+			report.Writes++
+			go func() {
+				defer writes.Done()
+				ok := c.write(c.nodes[pick], 5*sim.ElectionTimeout)
+				counts.Lock()
+				if ok {
+					report.Acknowledged++
+				} else {
+					report.Failed++
+				}
+				counts.Unlock()
+			}()
+		}
+		if partition < sim.PartitionRate {
+			c.partition(split)
+			report.Partitions++
+		}
+		if heal < sim.HealRate {
+			c.network.Heal()
+		}
+		if crash < sim.CrashRate && c.crash(pick) {
+			report.Crashes++
+		}
+		if restart < sim.RestartRate {
+			c.restartStopped(pick)
+		}
+		if snapshot < sim.SnapshotRate {
+			if s := c.nodes[pick].Server(); s != nil && s.TakeSnapshot() == nil {
+				report.Snapshots++
+			}
+		}
+
+		time.Sleep(sim.Step)
+		clock.Advance(sim.Step)
+	}
+
+	// Deliver whatever is still delayed before waiting out the writes.
+	c.network.SetFaults(transport.MemoryFaults{})
+	clock.Stop()
+	writes.Wait()
+	c.network.Heal()
+	for _, n := range c.nodes {
+		if n.Server() == nil {
+			if err := n.Restart(); err != nil {
+				c.violate("Could not restart %s: %s", n.name, err)
+			}
+		}
+	}
+	err = c.Check(100 * sim.ElectionTimeout)
+
+	report.Duration = time.Since(start)
+	c.mutex.Lock()
+	report.Terms = len(c.leaders)
+	c.mutex.Unlock()
+	report.Violations = c.Violations()
+	return report, err
+}
+
+// Splits the servers in two at a random point of a permutation.
+func (c *Cluster) partition(perm []int) {
+	if len(perm) < 2 {
+		return
+	}
+	cut := 1 + perm[0]%(len(perm)-1)
+	var a, b []string
+	for i, j := range perm {
+		if i < cut {
+			a = append(a, c.nodes[j].name)
+		} else {
+			b = append(b, c.nodes[j].name)
+		}
+	}
+	c.network.Partition(a, b)
+}
+
+// Stops a server unless that would leave a majority down.
+func (c *Cluster) crash(i int) bool {
+	down := 0
+	for _, n := range c.nodes {
+		if n.Server() == nil {
+			down++
+		}
+	}
+	if (down+1)*2 >= len(c.nodes) || c.nodes[i].Server() == nil {
+		return false
+	}
+	c.nodes[i].Stop()
+	return true
+}
+
+// Restarts the first stopped server at or after i.
+func (c *Cluster) restartStopped(i int) {
+	for j := 0; j < len(c.nodes); j++ {
+		n := c.nodes[(i+j)%len(c.nodes)]
+		if n.Server() == nil {
+			if err := n.Restart(); err != nil {
+				c.violate("Could not restart %s: %s", n.name, err)
+			}
+			return
+		}
+	}
+}
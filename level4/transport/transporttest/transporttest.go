@@ -0,0 +1,854 @@
+// Package transporttest runs soak tests of the HTTP transporter: it starts
+// several in-process Raft servers talking to each other over loopback TCP or
+// Unix sockets, drives writes, elections and snapshots against them, and
+// checks that Raft's safety properties hold throughout.
+package transporttest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metcalf/ctf3/level4/transport"
+	"github.com/metcalf/raft"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	raft.RegisterCommand(&writeCommand{})
+	transport.RegisterCommand(&writeCommand{})
+}
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// Describes the cluster to start.
+type Config struct {
+	// Number of servers.  Zero starts three.
+	Nodes int
+
+	// "tcp" listens on loopback ports; "unix" on sockets in the cluster's
+	// directory; "memory" connects servers through a transport.MemoryNetwork
+	// seeded with Seed, bypassing HTTP.  Empty uses "tcp".
+	Network string
+	Seed    int64
+
+	// Options passed to every server's transporter.
+	Options []transport.Option
+
+	// Applied to every server's transporter.
+	TransportConfig transport.Config
+
+	// Raft timing.  Zero leaves the server defaults.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+
+	// Directory to keep logs and sockets in.  Empty creates a temporary
+	// directory, removed by Close.
+	Dir string
+}
+
+// Describes the load Run drives against the cluster.
+type Workload struct {
+	// How long to run for.
+	Duration time.Duration
+
+	// Number of goroutines proposing writes, each through a random server,
+	// waiting WriteInterval between writes.
+	Writers       int
+	WriteInterval time.Duration
+
+	// How long a write may take, including forwarding to the leader.  Zero
+	// uses transport.MembershipTimeout.
+	WriteTimeout time.Duration
+
+	// How often to force an election by stopping the leader, and how long
+	// it stays down before restarting.  Zero disables elections.
+	ElectionInterval time.Duration
+	Downtime         time.Duration
+
+	// How often a random running server takes a snapshot.  Zero disables
+	// snapshots.
+	SnapshotInterval time.Duration
+
+	// How long to wait at the end for every server to apply every write.
+	// Zero waits ten seconds.
+	SettleTimeout time.Duration
+}
+
+// The outcome of a run.
+type Report struct {
+	Duration     time.Duration
+	Writes       int
+	Acknowledged int
+	Failed       int
+	Elections    int
+	Snapshots    int
+	Terms        int
+	Partitions   int
+	Crashes      int
+
+	// Each invariant violated, in the order found.
+	Violations []string
+}
+
+// Returned by Run and Check when an invariant was violated.
+type ViolationError struct {
+	Violations []string
+}
+
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("%d invariant violations: %s", len(e.Violations), strings.Join(e.Violations, "; "))
+}
+
+// A running set of servers.
+type Cluster struct {
+	config  Config
+	dir     string
+	tempDir bool
+	nodes   []*Node
+	network *transport.MemoryNetwork
+
+	// The server seen leading each term, to check there is only one.
+	mutex      sync.Mutex
+	leaders    map[uint64]string
+	violations []string
+
+	// Writes acknowledged to a client, which must survive on every server.
+	acknowledged map[uint64]bool
+	nextValue    uint64
+}
+
+// A server in the cluster.  Stopping and restarting a node creates a new
+// Raft server and transporter from the same log, as a process restart would.
+type Node struct {
+	cluster          *Cluster
+	name             string
+	addr             string
+	connectionString string
+	path             string
+	httpServer       *http.Server
+	handler          atomic.Value
+
+	mutex       sync.Mutex
+	server      raft.Server
+	transporter *transport.HTTPTransporter
+	applied     []uint64
+}
+
+// The command proposed by writers, appending a value to each server's state.
+type writeCommand struct {
+	Value uint64 `json:"value"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Starts a cluster and waits for it to elect a leader with every server
+// joined.
+func Start(config Config) (*Cluster, error) {
+	if config.Nodes <= 0 {
+		config.Nodes = 3
+	}
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.Network != "tcp" && config.Network != "unix" && config.Network != "memory" {
+		return nil, fmt.Errorf("Unknown network %q", config.Network)
+	}
+
+	c := &Cluster{
+		config:       config,
+		dir:          config.Dir,
+		leaders:      make(map[uint64]string),
+		acknowledged: make(map[uint64]bool),
+	}
+	if config.Network == "memory" {
+		c.network = transport.NewMemoryNetwork(config.Seed)
+	}
+	if c.dir == "" {
+		dir, err := ioutil.TempDir("", "transporttest")
+		if err != nil {
+			return nil, err
+		}
+		c.dir = dir
+		c.tempDir = true
+	}
+
+	for i := 0; i < config.Nodes; i++ {
+		n, err := c.newNode(fmt.Sprintf("node%d", i))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.nodes = append(c.nodes, n)
+	}
+
+	if err := c.bootstrap(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cluster) newNode(name string) (*Node, error) {
+	n := &Node{cluster: c, name: name, path: filepath.Join(c.dir, name)}
+	if err := os.MkdirAll(n.path, 0755); err != nil {
+		return nil, err
+	}
+
+	if c.network != nil {
+		n.connectionString = "memory://" + name
+		if err := n.start(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	addr := "127.0.0.1:0"
+	if c.config.Network == "unix" {
+		addr = filepath.Join(c.dir, name+".sock")
+	}
+	l, err := transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.addr = l.Addr().String()
+	if n.connectionString, err = transport.Encode(n.addr); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	n.handler.Store(http.Handler(http.NotFoundHandler()))
+	n.httpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.handler.Load().(http.Handler).ServeHTTP(w, r)
+	})}
+	// Options such as HTTP/2 decide how the server is configured, so any
+	// transporter built from them will do.
+	transport.NewHTTPTransporter("/raft", c.config.Options...).ConfigureServer(n.httpServer)
+	go n.httpServer.Serve(l)
+
+	if err := n.start(); err != nil {
+		n.close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Has the first server join itself and the rest join it.
+func (c *Cluster) bootstrap() error {
+	first := c.nodes[0]
+	_, err := first.Server().Do(&raft.DefaultJoinCommand{
+		Name:             first.name,
+		ConnectionString: first.connectionString,
+	})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(transport.MembershipTimeout)
+	for _, n := range c.nodes[1:] {
+		if c.network != nil {
+			_, err := first.Server().Do(&raft.DefaultJoinCommand{Name: n.name, ConnectionString: n.connectionString})
+			if err != nil {
+				return fmt.Errorf("Could not join %s: %s", n.name, err)
+			}
+			continue
+		}
+
+		cmd := &raft.DefaultJoinCommand{Name: n.name, ConnectionString: n.connectionString}
+		for {
+			err := n.Transporter().SendJoinRequest(first.connectionString, cmd)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Could not join %s: %s", n.name, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	_, err = c.WaitForLeader(transport.MembershipTimeout)
+	return err
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the directory the cluster keeps its logs in.
+func (c *Cluster) Dir() string {
+	return c.dir
+}
+
+// Retrieves the network connecting the servers, or nil if they are
+// connected over HTTP.
+func (c *Cluster) Network() *transport.MemoryNetwork {
+	return c.network
+}
+
+// Retrieves the cluster's servers.
+func (c *Cluster) Nodes() []*Node {
+	return c.nodes
+}
+
+// Retrieves the running server that believes it is leader, or nil.
+func (c *Cluster) Leader() *Node {
+	for _, n := range c.nodes {
+		if s := n.Server(); s != nil && s.State() == raft.Leader {
+			return n
+		}
+	}
+	return nil
+}
+
+// Retrieves the invariant violations seen so far.
+func (c *Cluster) Violations() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.violations...)
+}
+
+// Retrieves the node's name.
+func (n *Node) Name() string {
+	return n.name
+}
+
+// Retrieves the connection string peers reach the node at.
+func (n *Node) ConnectionString() string {
+	return n.connectionString
+}
+
+// Retrieves the node's Raft server, or nil while it is stopped.
+func (n *Node) Server() raft.Server {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.server
+}
+
+// Retrieves the node's current transporter, or nil on a memory network.
+func (n *Node) Transporter() *transport.HTTPTransporter {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.transporter
+}
+
+// Retrieves the values the node has applied, in order.
+func (n *Node) Applied() []uint64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]uint64{}, n.applied...)
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Lifecycle
+//--------------------------------------
+
+// Starts a Raft server and transporter for the node, serving them in place of
+// any previous ones.
+func (n *Node) start() error {
+	config := n.cluster.config
+	var t *transport.HTTPTransporter
+	var raftTransporter transport.Transporter = n.cluster.network
+	if n.cluster.network == nil {
+		t = transport.NewHTTPTransporter("/raft", config.Options...)
+		if err := t.UpdateConfig(config.TransportConfig); err != nil {
+			return err
+		}
+		raftTransporter = t
+	}
+
+	// Applied values are recovered from the log or a snapshot on start.
+	n.mutex.Lock()
+	n.applied = nil
+	n.mutex.Unlock()
+
+	s, err := raft.NewServer(n.name, n.path, raftTransporter, (*stateMachine)(n), n, n.connectionString)
+	if err != nil {
+		return err
+	}
+	if config.ElectionTimeout > 0 {
+		s.SetElectionTimeout(config.ElectionTimeout)
+	}
+	if config.HeartbeatInterval > 0 {
+		s.SetHeartbeatInterval(config.HeartbeatInterval)
+	}
+	s.AddEventListener(raft.StateChangeEventType, func(e raft.Event) {
+		if e.Value() == raft.Leader {
+			n.cluster.observeLeader(s.Term(), n.name)
+		}
+	})
+
+	if t == nil {
+		n.cluster.network.Install(s)
+	} else {
+		mux := http.NewServeMux()
+		t.Install(s, mux)
+		n.handler.Store(http.Handler(mux))
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	n.server = s
+	n.transporter = t
+	n.mutex.Unlock()
+	return nil
+}
+
+// Stops the node's Raft server.  Over HTTP, its address keeps accepting
+// connections but answers every request with 503, as a restarting process
+// behind a proxy would; on a memory network it becomes unreachable.
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	s, t := n.server, n.transporter
+	n.server = nil
+	n.mutex.Unlock()
+	if s == nil {
+		return
+	}
+
+	if n.cluster.network != nil {
+		n.cluster.network.Remove(n.name)
+		s.Stop()
+		return
+	}
+	n.handler.Store(http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Server is stopped", http.StatusServiceUnavailable)
+	})))
+	s.Stop()
+	t.Close()
+}
+
+// Restarts a stopped node from its log.
+func (n *Node) Restart() error {
+	if n.Server() != nil {
+		return fmt.Errorf("%s is already running", n.name)
+	}
+	return n.start()
+}
+
+func (n *Node) close() {
+	n.Stop()
+	if n.httpServer != nil {
+		n.httpServer.Close()
+	}
+}
+
+// Stops every server and removes the cluster's directory if it was created
+// by Start.
+func (c *Cluster) Close() error {
+	for _, n := range c.nodes {
+		n.close()
+	}
+	if c.tempDir {
+		return os.RemoveAll(c.dir)
+	}
+	return nil
+}
+
+// Blocks until a running server is leader or the timeout expires.
+func (c *Cluster) WaitForLeader(timeout time.Duration) (*Node, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if n := c.Leader(); n != nil {
+			return n, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("No leader elected after %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//--------------------------------------
+// Workload
+//--------------------------------------
+
+// Drives a workload against the cluster, then waits for the servers to
+// converge and checks that no invariant was violated.  The report is
+// returned even if the error is a *ViolationError.
+func (c *Cluster) Run(w Workload) (*Report, error) {
+	report := &Report{}
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var counts sync.Mutex
+
+	timeout := w.WriteTimeout
+	if timeout <= 0 {
+		timeout = transport.MembershipTimeout
+	}
+	for i := 0; i < w.Writers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				ok := c.write(c.nodes[rnd.Intn(len(c.nodes))], timeout)
+				counts.Lock()
+				report.Writes++
+				if ok {
+					report.Acknowledged++
+				} else {
+					report.Failed++
+				}
+				counts.Unlock()
+
+				if w.WriteInterval > 0 {
+					select {
+					case <-done:
+						return
+					case <-time.After(w.WriteInterval):
+					}
+				}
+			}
+		}(start.UnixNano() + int64(i))
+	}
+
+	if w.ElectionInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.every(done, w.ElectionInterval, func() {
+				if c.forceElection(w.Downtime, done) {
+					counts.Lock()
+					report.Elections++
+					counts.Unlock()
+				}
+			})
+		}()
+	}
+
+	if w.SnapshotInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(start.UnixNano()))
+			c.every(done, w.SnapshotInterval, func() {
+				s := c.nodes[rnd.Intn(len(c.nodes))].Server()
+				if s != nil && s.TakeSnapshot() == nil {
+					counts.Lock()
+					report.Snapshots++
+					counts.Unlock()
+				}
+			})
+		}()
+	}
+
+	time.Sleep(w.Duration)
+	close(done)
+	wg.Wait()
+
+	// Servers stopped by an unfinished election are brought back so every
+	// server can be checked.
+	for _, n := range c.nodes {
+		if n.Server() == nil {
+			if err := n.Restart(); err != nil {
+				c.violate("Could not restart %s: %s", n.name, err)
+			}
+		}
+	}
+
+	settle := w.SettleTimeout
+	if settle <= 0 {
+		settle = 10 * time.Second
+	}
+	err := c.Check(settle)
+
+	report.Duration = time.Since(start)
+	c.mutex.Lock()
+	report.Terms = len(c.leaders)
+	c.mutex.Unlock()
+	report.Violations = c.Violations()
+	return report, err
+}
+
+func (c *Cluster) every(done chan struct{}, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// Proposes a write through a node, recording it if it is acknowledged.
+func (c *Cluster) write(n *Node, timeout time.Duration) bool {
+	s := n.Server()
+	if s == nil {
+		return false
+	}
+
+	c.mutex.Lock()
+	c.nextValue++
+	value := c.nextValue
+	c.mutex.Unlock()
+
+	cmd := &writeCommand{Value: value}
+	if c.network != nil {
+		// There is no forward route without HTTP, so writes are proposed to
+		// the leader directly.
+		if !c.proposeToLeader(cmd, timeout) {
+			return false
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if _, err := transport.NewForwarder(n.Transporter(), s).ForwardToLeader(ctx, cmd); err != nil {
+			return false
+		}
+	}
+
+	c.mutex.Lock()
+	c.acknowledged[value] = true
+	c.mutex.Unlock()
+	return true
+}
+
+func (c *Cluster) proposeToLeader(cmd raft.Command, timeout time.Duration) bool {
+	leader := c.Leader()
+	if leader == nil {
+		return false
+	}
+	s := leader.Server()
+	if s == nil {
+		return false
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Do(cmd)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stops the leader, waits for the rest to elect another, and restarts it.
+// Reports whether a new leader was elected.
+func (c *Cluster) forceElection(downtime time.Duration, done chan struct{}) bool {
+	leader := c.Leader()
+	if leader == nil {
+		return false
+	}
+	leader.Stop()
+	defer func() {
+		if err := leader.Restart(); err != nil {
+			c.violate("Could not restart %s: %s", leader.name, err)
+		}
+	}()
+
+	elected := false
+	deadline := time.After(downtime)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return elected
+		case <-deadline:
+			return elected
+		case <-ticker.C:
+			if n := c.Leader(); n != nil && n != leader {
+				elected = true
+			}
+		}
+	}
+}
+
+//--------------------------------------
+// Invariants
+//--------------------------------------
+
+func (c *Cluster) violate(format string, args ...interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.violations = append(c.violations, fmt.Sprintf(format, args...))
+}
+
+// Records that a server became leader of a term, which no other server may
+// also lead.
+func (c *Cluster) observeLeader(term uint64, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if other, ok := c.leaders[term]; ok && other != name {
+		c.violations = append(c.violations, fmt.Sprintf("Both %s and %s led term %d", other, name, term))
+		return
+	}
+	c.leaders[term] = name
+}
+
+// Waits up to timeout for every running server to apply the same values, then
+// checks that they agree on their order and that every acknowledged write is
+// among them.  Returns a *ViolationError listing every violation seen since
+// the cluster started.
+func (c *Cluster) Check(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !c.converged() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var reference *Node
+	for _, n := range c.nodes {
+		if n.Server() == nil {
+			continue
+		}
+		if reference == nil {
+			reference = n
+			continue
+		}
+		if i, ok := divergence(reference.Applied(), n.Applied()); ok {
+			c.violate("%s and %s applied different values at position %d", reference.name, n.name, i)
+		}
+	}
+
+	c.mutex.Lock()
+	acknowledged := make([]uint64, 0, len(c.acknowledged))
+	for value := range c.acknowledged {
+		acknowledged = append(acknowledged, value)
+	}
+	c.mutex.Unlock()
+	sort.Slice(acknowledged, func(i, j int) bool { return acknowledged[i] < acknowledged[j] })
+
+	for _, n := range c.nodes {
+		if n.Server() == nil {
+			continue
+		}
+		applied := make(map[uint64]bool)
+		for _, value := range n.Applied() {
+			if applied[value] {
+				c.violate("%s applied write %d twice", n.name, value)
+			}
+			applied[value] = true
+		}
+		for _, value := range acknowledged {
+			if !applied[value] {
+				c.violate("%s lost acknowledged write %d", n.name, value)
+			}
+		}
+	}
+
+	if violations := c.Violations(); len(violations) > 0 {
+		return &ViolationError{Violations: violations}
+	}
+	return nil
+}
+
+// Reports whether every running server has the same commit index and has
+// applied the same number of values.
+func (c *Cluster) converged() bool {
+	var commit uint64
+	applied := -1
+	for _, n := range c.nodes {
+		s := n.Server()
+		if s == nil {
+			continue
+		}
+		if applied == -1 {
+			commit, applied = s.CommitIndex(), len(n.Applied())
+		} else if s.CommitIndex() != commit || len(n.Applied()) != applied {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the first position at which two servers applied different values,
+// comparing only as far as the shorter has applied.
+func divergence(a, b []uint64) (int, bool) {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+//--------------------------------------
+// State machine
+//--------------------------------------
+
+// The node's applied values, saved to and recovered from snapshots.
+type stateMachine Node
+
+func (m *stateMachine) Save() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return json.Marshal(m.applied)
+}
+
+func (m *stateMachine) Recovery(b []byte) error {
+	var applied []uint64
+	if err := json.Unmarshal(b, &applied); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.applied = applied
+	return nil
+}
+
+func (n *Node) apply(value uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.applied = append(n.applied, value)
+}
+
+func (cmd *writeCommand) CommandName() string {
+	return "transporttest:write"
+}
+
+func (cmd *writeCommand) Apply(context raft.Context) (interface{}, error) {
+	context.Server().Context().(*Node).apply(cmd.Value)
+	return cmd.Value, nil
+}
+
+func (cmd *writeCommand) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(cmd)
+}
+
+func (cmd *writeCommand) Decode(r io.Reader) error {
+	return json.NewDecoder(r).Decode(cmd)
+}
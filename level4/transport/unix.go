@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Options for the Unix sockets Listen creates.  Addresses beginning with @
+// are bound in the Linux abstract namespace; they have no file, so Mode,
+// User, Group and RemoveStale don't apply to them.
+type UnixSocketOptions struct {
+	// The permissions given to the socket file.  Zero leaves the umask's.
+	Mode os.FileMode
+
+	// The user and group, by name or numeric ID, given ownership of the
+	// socket file.  Empty leaves them unchanged.
+	User  string
+	Group string
+
+	// The directory relative socket paths are resolved against, created if
+	// it doesn't exist.  Empty resolves them against the working directory.
+	Dir string
+
+	// Remove a socket file left behind by a process that has exited before
+	// binding.  A socket something is still listening on is never removed.
+	RemoveStale bool
+}
+
+// The options Listen uses.
+var DefaultUnixSocketOptions = UnixSocketOptions{RemoveStale: true}
+
+var errSocketInUse = errors.New("Socket is in use")
+
+// Returns the address a socket at addr is bound to.  Peers must be given the
+// resolved address.
+func (o UnixSocketOptions) Resolve(addr string) string {
+	if o.Dir == "" || Network(addr) != "unix" || isAbstract(addr) || filepath.IsAbs(addr) {
+		return addr
+	}
+	path := filepath.Join(o.Dir, addr)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return "./" + path
+}
+
+// Listens on addr, which may be a Unix socket path or a TCP address, applying
+// the options to Unix sockets.
+func ListenWithOptions(addr string, opts UnixSocketOptions) (net.Listener, error) {
+	if Network(addr) != "unix" || isAbstract(addr) {
+		return listen(addr)
+	}
+
+	addr = opts.Resolve(addr)
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RemoveStale {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.apply(addr); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (o UnixSocketOptions) apply(path string) error {
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return err
+		}
+	}
+
+	if o.User == "" && o.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o.User != "" {
+		u, err := user.Lookup(o.User)
+		if err != nil {
+			if u, err = user.LookupId(o.User); err != nil {
+				return err
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if o.Group != "" {
+		g, err := user.LookupGroup(o.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(o.Group); err != nil {
+				return err
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// Removes the socket file at path if nothing is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: %s", path, errSocketInUse)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func isAbstract(addr string) bool {
+	return len(addr) > 0 && addr[0] == '@'
+}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"errors"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"net"
+	"sync"
+	"time"
+)
+
+// Once a peer can't be dialed, further sends to it fail immediately with
+// ErrPeerUnreachable for Config.UnreachableTTL rather than each waiting out a
+// dial of its own, and the peer is pinged in the background every TTL.  A
+// successful ping, or a send made once the TTL has passed, clears the entry.
+
+// How long after the last send to an unreachable peer its prober gives up, as
+// a multiple of the TTL, so peers removed from the cluster aren't probed
+// forever.
+const unreachableProbeLimit = 10
+
+type unreachablePeers struct {
+	mutex sync.Mutex
+	peers map[string]*unreachablePeer
+}
+
+type unreachablePeer struct {
+	until  time.Time
+	asked  time.Time
+	ttl    time.Duration
+	peer   *raft.Peer
+	probed bool
+}
+
+func newUnreachablePeers() *unreachablePeers {
+	return &unreachablePeers{peers: make(map[string]*unreachablePeer)}
+}
+
+// Reports whether a failure to reach a peer happened while dialing it.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Fails sends to a peer that recently couldn't be dialed.
+func (u *unreachablePeers) check(name string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	p, ok := u.peers[name]
+	if !ok {
+		return nil
+	}
+	p.asked = time.Now()
+	if p.asked.Before(p.until) {
+		return ErrPeerUnreachable
+	}
+	return nil
+}
+
+// Retrieves whether sends to the named peer are currently failing fast.
+func (u *unreachablePeers) unreachable(name string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	p, ok := u.peers[name]
+	return ok && time.Now().Before(p.until)
+}
+
+// Records the outcome of a send to a peer, marking it unreachable for ttl
+// after a dial failure.  Returns true if a prober should be started.
+func (u *unreachablePeers) record(peer *raft.Peer, err error, ttl time.Duration) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if err == nil || !isDialError(err) || ttl <= 0 {
+		if err == nil {
+			delete(u.peers, peer.Name)
+		}
+		return false
+	}
+
+	now := time.Now()
+	p, ok := u.peers[peer.Name]
+	if !ok {
+		p = &unreachablePeer{asked: now}
+		u.peers[peer.Name] = p
+	}
+	p.until = now.Add(ttl)
+	p.ttl = ttl
+	p.peer = peer
+	start := !p.probed
+	p.probed = true
+	return start
+}
+
+// Pings an unreachable peer every TTL until it answers or stops being sent
+// to.
+func (t *HTTPTransporter) probeUnreachable(name string) {
+	for {
+		t.unreachable.mutex.Lock()
+		p, ok := t.unreachable.peers[name]
+		var ttl time.Duration
+		var peer *raft.Peer
+		if ok {
+			ttl, peer = p.ttl, p.peer
+			if time.Since(p.asked) > unreachableProbeLimit*ttl {
+				delete(t.unreachable.peers, name)
+				ok = false
+			}
+		}
+		t.unreachable.mutex.Unlock()
+		if !ok {
+			return
+		}
+
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(ttl):
+		}
+
+		_, err := t.ProbePeer(peer)
+		t.unreachable.mutex.Lock()
+		if p, ok := t.unreachable.peers[name]; ok {
+			if err == nil {
+				debuglog.Debugln("transporter.unreachable.recovered:", name)
+				delete(t.unreachable.peers, name)
+			} else {
+				p.until = time.Now().Add(p.ttl)
+			}
+		}
+		t.unreachable.mutex.Unlock()
+	}
+}
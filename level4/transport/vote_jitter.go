@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// When a network-wide blip makes many servers time out at once, their
+// RequestVotes cross and split the vote, round after round.  With
+// Config.VoteJitter, each candidacy holds its RequestVotes back by a random
+// delay up to the jitter, the same delay to every peer, so one candidate
+// usually gets its requests out first and wins.  The jitter is capped at a
+// quarter of the election timeout, so it can't cost a candidate its term, and
+// votes for a term the server has already left are not sent at all.
+
+type voteJitter struct {
+	mutex sync.Mutex
+
+	// The delay chosen for each group's current candidacy.
+	delays map[string]voteDelay
+}
+
+type voteDelay struct {
+	term  uint64
+	delay time.Duration
+}
+
+func newVoteJitter() *voteJitter {
+	return &voteJitter{delays: make(map[string]voteDelay)}
+}
+
+// Returns how long to hold back the RequestVotes a server sends in a term.
+func (t *HTTPTransporter) voteDelay(server raft.Server, term uint64) time.Duration {
+	jitter := t.config().VoteJitter
+	if limit := server.ElectionTimeout() / 4; jitter > limit {
+		jitter = limit
+	}
+	if jitter <= 0 {
+		return 0
+	}
+
+	group := groupOf(server)
+	t.jitter.mutex.Lock()
+	defer t.jitter.mutex.Unlock()
+
+	d, ok := t.jitter.delays[group]
+	if !ok || d.term != term {
+		d = voteDelay{term, time.Duration(rand.Int63n(int64(jitter)))}
+		t.jitter.delays[group] = d
+	}
+	return d.delay
+}
+
+// Holds back a RequestVote by the jitter, reporting whether it should still
+// be sent.
+func (t *HTTPTransporter) jitterVote(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) bool {
+	delay := t.voteDelay(server, req.Term)
+	if delay <= 0 {
+		return true
+	}
+	time.Sleep(delay)
+	if server.Term() != req.Term {
+		debuglog.Debugln("transporter.rv.jitter.stale:", peer.Name, req.Term)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The watchdog tracks every outgoing RPC and every incoming request being
+// handled, so an operator can see what is stuck and on which peer with
+// InFlightRPCs or the admin in-flight endpoint.  With Config.RPCCeiling set,
+// it also cancels any that run past the ceiling: an outgoing RPC has its
+// request context cancelled, and an incoming one has the deadlines of its
+// connection moved to now, which fails the reads and writes a handler could
+// otherwise block on forever.  A handler stuck inside the server itself
+// can't be cancelled, but still shows up as in flight.
+
+// How often the watchdog looks for RPCs past the ceiling.
+const watchdogInterval = time.Second
+
+// An RPC in flight.  Direction is "outgoing" or "incoming".
+type InFlightRPC struct {
+	Direction string        `json:"direction"`
+	RPC       string        `json:"rpc"`
+	Peer      string        `json:"peer"`
+	Started   time.Time     `json:"started"`
+	Age       time.Duration `json:"age"`
+	Cancelled bool          `json:"cancelled"`
+}
+
+type watchdog struct {
+	mutex     sync.Mutex
+	next      uint64
+	rpcs      map[uint64]*trackedRPC
+	cancelled uint64
+	started   bool
+}
+
+type trackedRPC struct {
+	InFlightRPC
+	cancel func()
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{rpcs: make(map[uint64]*trackedRPC)}
+}
+
+// Retrieves the RPCs in flight, oldest first.
+func (t *HTTPTransporter) InFlightRPCs() []InFlightRPC {
+	now := time.Now()
+
+	t.watchdog.mutex.Lock()
+	defer t.watchdog.mutex.Unlock()
+
+	rpcs := make([]InFlightRPC, 0, len(t.watchdog.rpcs))
+	for _, r := range t.watchdog.rpcs {
+		rpc := r.InFlightRPC
+		rpc.Age = now.Sub(rpc.Started)
+		rpcs = append(rpcs, rpc)
+	}
+	sort.Slice(rpcs, func(i, j int) bool { return rpcs[i].Started.Before(rpcs[j].Started) })
+	return rpcs
+}
+
+// Retrieves how many RPCs the watchdog has cancelled for exceeding
+// Config.RPCCeiling.
+func (t *HTTPTransporter) WatchdogCancellations() uint64 {
+	t.watchdog.mutex.Lock()
+	defer t.watchdog.mutex.Unlock()
+	return t.watchdog.cancelled
+}
+
+// Starts tracking an RPC, which cancel aborts.  The returned function must be
+// called once the RPC is over.
+func (t *HTTPTransporter) track(direction, rpc, peer string, cancel func()) func() {
+	w := t.watchdog
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.next++
+	id := w.next
+	w.rpcs[id] = &trackedRPC{
+		InFlightRPC: InFlightRPC{
+			Direction: direction,
+			RPC:       rpc,
+			Peer:      peer,
+			Started:   time.Now(),
+		},
+		cancel: cancel,
+	}
+	if !w.started {
+		w.started = true
+		go t.watch()
+	}
+
+	return func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		delete(w.rpcs, id)
+	}
+}
+
+// Cancels RPCs past the ceiling, checking every watchdogInterval.
+func (t *HTTPTransporter) watch() {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-t.stop:
+			return
+		case now = <-ticker.C:
+		}
+
+		ceiling := t.config().RPCCeiling
+		if ceiling <= 0 {
+			continue
+		}
+
+		var cancels []func()
+		t.watchdog.mutex.Lock()
+		for _, r := range t.watchdog.rpcs {
+			if r.Cancelled || now.Sub(r.Started) < ceiling {
+				continue
+			}
+			debuglog.Debugln("transporter."+r.RPC+".watchdog.cancel:", r.Direction, r.Peer, now.Sub(r.Started))
+			r.Cancelled = true
+			t.watchdog.cancelled++
+			cancels = append(cancels, r.cancel)
+		}
+		t.watchdog.mutex.Unlock()
+
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// Returns a function that fails the pending and future reads and writes of
+// an incoming request's connection.
+func cancelResponse(w http.ResponseWriter) func() {
+	return func() {
+		rc := http.NewResponseController(w)
+		now := time.Now()
+		rc.SetReadDeadline(now)
+		rc.SetWriteDeadline(now)
+	}
+}
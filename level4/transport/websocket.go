@@ -0,0 +1,431 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/metcalf/ctf3/level4/debuglog"
+	"github.com/metcalf/raft"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In WebSocket mode each pair of peers shares one persistent connection over
+// which AppendEntries, RequestVote and the snapshot RPCs are multiplexed.
+// Sessions are symmetric: once a peer has dialed us we send our own RPCs back
+// over the same connection, so a leader can push heartbeats down a connection
+// its follower opened.  Only servers with WebSocket mode enabled accept
+// upgrades, so every peer must opt in; the others answer the upgrade with a
+// 404 and are sent plain HTTP.
+//
+// Every WebSocket message is one frame:
+//
+//   kind (uint8) | rpc (uint8) | id (uint64) | payload
+//
+// A request's payload is the encoded raft request.  The reply carries the same
+// id and either the encoded response or, for an error frame, a message.
+//
+// Frames are checked less than HTTP requests.  The cluster ID is checked once,
+// at the handshake, and handler limits apply to each request, but frames carry
+// no checksums or request IDs, and are not throttled, counted against snapshot
+// quotas, captured or strictly validated.  The accepting side also takes the
+// peer's name from the X-Raft-Name header of the upgrade without verifying it,
+// so a client able to connect can claim another peer's session for RPCs sent
+// to that peer.  Enable WebSocket mode only where those checks aren't needed,
+// as between peers on a trusted network.
+
+const (
+	wsRequest  uint8 = 1
+	wsResponse uint8 = 2
+	wsError    uint8 = 3
+
+	wsFrameHeader = 10
+)
+
+// Identifies the sending server, so that the accepting side of a WebSocket can
+// reuse the session for its own RPCs and snapshot bytes are accounted to the
+// right peer.
+const nameHeader = "X-Raft-Name"
+
+const (
+	wsHandshakeTimeout = time.Second
+
+	// How long to send plain HTTP to a peer that refused the upgrade before
+	// offering it again.
+	wsRetryInterval = time.Minute
+)
+
+var (
+	errSessionClosed = errors.New("WebSocket session closed")
+	errNoResponse    = errors.New("Server gave no response")
+)
+
+// The RPCs that are carried over WebSocket sessions, keyed by the names send
+// uses for them.
+var wsRPCs = map[string]RPCType{
+	"rv":  VoteRPC,
+	"ae":  AppendEntriesRPC,
+	"ss":  SnapshotRPC,
+	"ssr": SnapshotRecoveryRPC,
+}
+
+type wsFrame struct {
+	kind    uint8
+	rpc     RPCType
+	id      uint64
+	payload []byte
+}
+
+type wsPool struct {
+	mu       sync.Mutex
+	sessions map[string]*wsSession
+	refused  map[string]time.Time
+	dialer   *websocket.Dialer
+	upgrader websocket.Upgrader
+}
+
+type wsSession struct {
+	t       *HTTPTransporter
+	conn    *websocket.Conn
+	server  raft.Server
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan wsFrame
+	closed  bool
+	onClose func()
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the WebSocket path.
+func (t *HTTPTransporter) WebSocketPath() string {
+	return t.webSocketPath
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Returns the open session to a peer, dialing one if needed.  Returns nil if
+// the peer cannot be reached over WebSocket, in which case the caller should
+// fall back to plain HTTP.
+func (t *HTTPTransporter) wsSession(server raft.Server, peer *raft.Peer) *wsSession {
+	p := t.ws
+
+	p.mu.Lock()
+	if s, ok := p.sessions[peer.Name]; ok {
+		p.mu.Unlock()
+		return s
+	}
+	if at, ok := p.refused[peer.Name]; ok && time.Since(at) < wsRetryInterval {
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	url, err := t.peerURL(peer, t.WebSocketPath())
+	if err != nil {
+		return nil
+	}
+	header := http.Header{}
+	header.Set(nameHeader, server.Name())
+	t.stampClusterID(header)
+
+	scheme := "ws"
+	if t.config().TLS != nil {
+		scheme = "wss"
+	}
+	ctx := withPeerName(context.Background(), peer.Name)
+	conn, resp, err := p.dialer.DialContext(ctx, scheme+strings.TrimPrefix(url, "http"), header)
+	if err == nil {
+		if err = t.checkClusterID(resp.Header); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		debuglog.Debugln("transporter.ws.dial.error:", err)
+		if err == websocket.ErrBadHandshake {
+			p.mu.Lock()
+			p.refused[peer.Name] = time.Now()
+			p.mu.Unlock()
+		}
+		return nil
+	}
+
+	s := newWSSession(t, conn, server)
+	if r := p.register(peer.Name, s); r != s {
+		conn.Close()
+		return r
+	}
+	go s.serve()
+
+	return s
+}
+
+// Handles incoming WebSocket upgrades.  Frames aren't sealed, so upgrades are
+// refused while encryption keys are set.
+func (t *HTTPTransporter) webSocketHandler(server raft.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t.config().sealKey() != nil {
+			http.Error(w, ErrNotEncrypted.Error(), http.StatusForbidden)
+			return
+		}
+
+		header := http.Header{}
+		t.stampClusterID(header)
+		conn, err := t.ws.upgrader.Upgrade(w, r, header)
+		if err != nil {
+			debuglog.Debugln("transporter.ws.upgrade.error:", err)
+			return
+		}
+
+		s := newWSSession(t, conn, server)
+		if name := r.Header.Get(nameHeader); name != "" {
+			t.ws.register(name, s)
+		}
+		go s.serve()
+	}
+}
+
+func newWSPool() *wsPool {
+	return &wsPool{
+		sessions: make(map[string]*wsSession),
+		refused:  make(map[string]time.Time),
+		dialer: &websocket.Dialer{
+			HandshakeTimeout: wsHandshakeTimeout,
+		},
+	}
+}
+
+// Registers s as the session for a peer unless one already exists, returning
+// whichever session is registered.
+func (p *wsPool) register(name string, s *wsSession) *wsSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existing, ok := p.sessions[name]; ok {
+		return existing
+	}
+
+	p.sessions[name] = s
+	delete(p.refused, name)
+	s.onClose = func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.sessions[name] == s {
+			delete(p.sessions, name)
+		}
+	}
+
+	return s
+}
+
+func newWSSession(t *HTTPTransporter, conn *websocket.Conn, server raft.Server) *wsSession {
+	return &wsSession{
+		t:       t,
+		conn:    conn,
+		server:  server,
+		pending: make(map[uint64]chan wsFrame),
+	}
+}
+
+// Sends a request over the session and waits for the response.
+func (s *wsSession) call(rpc RPCType, req encoder, resp decoder) error {
+	var b bytes.Buffer
+	if _, err := req.Encode(&b); err != nil {
+		return err
+	}
+
+	ch := make(chan wsFrame, 1)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSessionClosed
+	}
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	if err := s.write(wsFrame{wsRequest, rpc, id, b.Bytes()}); err != nil {
+		s.close()
+		return err
+	}
+
+	timer := time.NewTimer(s.server.ElectionTimeout())
+	defer timer.Stop()
+
+	select {
+	case f, ok := <-ch:
+		if !ok {
+			return errSessionClosed
+		}
+		if f.kind == wsError {
+			return errors.New(string(f.payload))
+		}
+		_, err := resp.Decode(bytes.NewReader(f.payload))
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%s timed out over WebSocket", rpc)
+	}
+}
+
+// Reads frames until the connection fails, answering requests and delivering
+// responses to their callers.
+func (s *wsSession) serve() {
+	defer s.close()
+
+	for {
+		kind, data, err := s.conn.ReadMessage()
+		if err != nil {
+			debuglog.Debugln("transporter.ws.read.error:", err)
+			return
+		}
+		if kind != websocket.BinaryMessage {
+			continue
+		}
+
+		f, err := decodeFrame(data)
+		if err != nil {
+			debuglog.Debugln("transporter.ws.frame.error:", err)
+			return
+		}
+
+		switch f.kind {
+		case wsRequest:
+			go s.handle(f)
+		case wsResponse, wsError:
+			s.deliver(f)
+		}
+	}
+}
+
+func (s *wsSession) handle(f wsFrame) {
+	debuglog.DebugTagln("transporter.ws.recv", s.server.Name(), "RECV", "ws", f.rpc)
+
+	// Keys may have been set since the session was opened.
+	if s.t.config().sealKey() != nil {
+		s.write(wsFrame{wsError, f.rpc, f.id, []byte(ErrNotEncrypted.Error())})
+		return
+	}
+
+	req, _, err := newMessages(f.rpc)
+	if err == nil {
+		_, err = req.Decode(bytes.NewReader(f.payload))
+	}
+	s.t.stats.received(f.rpc.key(), err)
+	if err != nil {
+		s.write(wsFrame{wsError, f.rpc, f.id, []byte(err.Error())})
+		return
+	}
+
+	// The caller gives up after an election timeout, so don't queue longer.
+	ctx, cancel := context.WithTimeout(context.Background(), s.server.ElectionTimeout())
+	release := s.t.admit(ctx, f.rpc.key())
+	cancel()
+	if release == nil {
+		s.write(wsFrame{wsError, f.rpc, f.id, []byte("Too many concurrent " + f.rpc.key() + " requests")})
+		return
+	}
+	defer release()
+
+	resp := dispatch(s.server, f.rpc, req)
+	if resp == nil {
+		s.write(wsFrame{wsError, f.rpc, f.id, []byte(errNoResponse.Error())})
+		return
+	}
+	var b bytes.Buffer
+	if _, err := resp.Encode(&b); err != nil {
+		s.write(wsFrame{wsError, f.rpc, f.id, []byte(err.Error())})
+		return
+	}
+
+	if err := s.write(wsFrame{wsResponse, f.rpc, f.id, b.Bytes()}); err != nil {
+		debuglog.Debugln("transporter.ws.write.error:", err)
+	}
+}
+
+func (s *wsSession) deliver(f wsFrame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch, ok := s.pending[f.id]; ok {
+		ch <- f
+	}
+}
+
+func (s *wsSession) write(f wsFrame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.server.ElectionTimeout()))
+	return s.conn.WriteMessage(websocket.BinaryMessage, encodeFrame(f))
+}
+
+func (s *wsSession) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for _, ch := range s.pending {
+		close(ch)
+	}
+	s.pending = make(map[uint64]chan wsFrame)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+func encodeFrame(f wsFrame) []byte {
+	b := make([]byte, wsFrameHeader+len(f.payload))
+	b[0] = f.kind
+	b[1] = uint8(f.rpc)
+	binary.BigEndian.PutUint64(b[2:], f.id)
+	copy(b[wsFrameHeader:], f.payload)
+	return b
+}
+
+func decodeFrame(b []byte) (wsFrame, error) {
+	if len(b) < wsFrameHeader {
+		return wsFrame{}, fmt.Errorf("Short WebSocket frame of %d bytes", len(b))
+	}
+	return wsFrame{
+		kind:    b[0],
+		rpc:     RPCType(b[1]),
+		id:      binary.BigEndian.Uint64(b[2:]),
+		payload: b[wsFrameHeader:],
+	}, nil
+}
+
+// The name send uses for an RPC type.
+func (r RPCType) key() string {
+	for key, rpc := range wsRPCs {
+		if rpc == r {
+			return key
+		}
+	}
+	return r.String()
+}